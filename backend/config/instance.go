@@ -0,0 +1,21 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+)
+
+// InstanceID identifies this process among the API instances sharing the
+// database, e.g. to hold leases on background jobs
+var InstanceID = newInstanceID()
+
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return host + "-" + hex.EncodeToString(suffix)
+}
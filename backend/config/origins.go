@@ -0,0 +1,24 @@
+package config
+
+import "strings"
+
+// IsAllowedOrigin reports whether browser requests from origin are accepted.
+// It is shared by the CORS config and the WebSocket upgrader.
+func IsAllowedOrigin(origin string) bool {
+	if origin == "" || origin == "null" {
+		return true
+	}
+	if origin == "http://localhost:5173" {
+		return true
+	}
+	if strings.HasPrefix(origin, "chrome-extension://") {
+		return true
+	}
+	if strings.HasPrefix(origin, "moz-extension://") {
+		return true
+	}
+	if origin == "https://heyboo.ca" {
+		return true
+	}
+	return false
+}
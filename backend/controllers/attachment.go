@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/KevinChaves65/Project_Boo/services"
+	"github.com/KevinChaves65/Project_Boo/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UploadAttachment stores a photo or voice note sent as the "file" field of a
+// multipart form. The returned ID is then sent with a chat message.
+func UploadAttachment(c *gin.Context) {
+	// Leave some room for the multipart framing around the file
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, services.MaxAttachmentSize+64*1024)
+
+	file, _, err := c.Request.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": services.ErrAttachmentTooLarge.Error()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A file is required"})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, services.MaxAttachmentSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+
+	attachment, err := services.UploadAttachment(middlewares.CurrentPrincipal(c), data)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrAttachmentTooLarge), errors.Is(err, services.ErrImageTooLarge):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrUnsupportedAttachment):
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrE2EUnavailable):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store attachment"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, attachment)
+}
+
+// GetAttachment returns an attachment's metadata with fresh download links
+func GetAttachment(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment ID"})
+		return
+	}
+
+	attachment, err := models.GetAttachment(id)
+	if err != nil || attachment.CoupleID != *middlewares.CurrentPrincipal(c).CoupleID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+
+	services.SignAttachment(&attachment)
+	c.JSON(http.StatusOK, attachment)
+}
+
+// DownloadAttachment serves a decrypted attachment. It needs no Authorization
+// header: the signed link handed out to couple members is the authorization.
+func DownloadAttachment(c *gin.Context) {
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || !utils.VerifyResourceSignature(c.Request.URL.Path, expires, c.Query("sig")) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired link"})
+		return
+	}
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment ID"})
+		return
+	}
+	attachment, err := models.GetAttachment(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+
+	thumbnail := c.FullPath() == "/attachments/:id/thumbnail"
+	data, contentType, err := services.OpenAttachment(attachment, thumbnail)
+	if err != nil {
+		if errors.Is(err, models.ErrAttachmentNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read attachment"})
+		return
+	}
+
+	c.Header("Cache-Control", "private, max-age=900")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, contentType, data)
+}
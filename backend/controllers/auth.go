@@ -5,9 +5,11 @@ import (
 	"net/http"
 	"regexp"
 
+	"github.com/KevinChaves65/Project_Boo/middlewares"
 	"github.com/KevinChaves65/Project_Boo/models"
 	"github.com/KevinChaves65/Project_Boo/utils"
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type RegisterUser struct {
@@ -109,13 +111,130 @@ func Login(c *gin.Context) {
 		return
 	}
 
-	token, err := utils.GenerateToken(user.Username)
+	refreshToken, err := utils.GenerateRefreshToken()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"token": token})
+	session, err := models.CreateSession(user.ID, utils.HashToken(refreshToken), c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+
+	token, err := utils.GenerateToken(user.Username, session.ID.Hex())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":         token,
+		"refresh_token": refreshToken,
+		"expires_in":    int(utils.AccessTokenTTL.Seconds()),
+	})
+}
+
+// RefreshToken exchanges a refresh token for a new access token and a new refresh token
+func RefreshToken(c *gin.Context) {
+	var request struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	newRefreshToken, err := utils.GenerateRefreshToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	session, err := models.RotateRefreshToken(utils.HashToken(request.RefreshToken), utils.HashToken(newRefreshToken))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidRefreshToken) || errors.Is(err, models.ErrRefreshTokenReused) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh session"})
+		return
+	}
+
+	user, err := models.GetUserByID(session.UserID)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	token, err := utils.GenerateToken(user.Username, session.ID.Hex())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":         token,
+		"refresh_token": newRefreshToken,
+		"expires_in":    int(utils.AccessTokenTTL.Seconds()),
+	})
+}
+
+// Logout revokes the session of the current access token
+func Logout(c *gin.Context) {
+	principal := middlewares.CurrentPrincipal(c)
+
+	if err := models.RevokeSession(principal.UserID, principal.SessionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// LogoutAll revokes every session of the current user, on all devices
+func LogoutAll(c *gin.Context) {
+	principal := middlewares.CurrentPrincipal(c)
+
+	revoked, err := models.RevokeAllSessions(principal.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out of all devices", "revoked_sessions": revoked})
+}
+
+// GetSessions lists the active sessions of the current user
+func GetSessions(c *gin.Context) {
+	principal := middlewares.CurrentPrincipal(c)
+
+	sessions, err := models.GetUserSessions(principal.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions, "current_session_id": principal.SessionID.Hex()})
+}
+
+// RevokeSession revokes one of the current user's sessions, e.g. a lost device
+func RevokeSession(c *gin.Context) {
+	principal := middlewares.CurrentPrincipal(c)
+
+	sessionID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+
+	if err := models.RevokeSession(principal.UserID, sessionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked successfully"})
 }
 
 func Profile(c *gin.Context) {
@@ -227,6 +346,16 @@ func ChangePassword(c *gin.Context) {
 		return
 	}
 
+	// Sign out every other device that knew the old password. The password is
+	// already changed, so a failure is retried once before it is reported.
+	principal := middlewares.CurrentPrincipal(c)
+	if _, err := models.RevokeOtherSessions(principal.UserID, principal.SessionID); err != nil {
+		if _, err := models.RevokeOtherSessions(principal.UserID, principal.SessionID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Password changed, but other devices could not be signed out. Sign them out with /auth/logout-all."})
+			return
+		}
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully"})
 }
 
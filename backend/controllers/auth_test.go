@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestChangePasswordReportsUnrevokedSessions(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	principal := &middlewares.Principal{UserID: primitive.NewObjectID(), Username: "alice", SessionID: primitive.NewObjectID()}
+
+	hash, err := models.HashPassword("Old-password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changePassword := func() *httptest.ResponseRecorder {
+		gin.SetMode(gin.TestMode)
+		r := gin.New()
+		r.PUT("/auth/password", func(c *gin.Context) {
+			middlewares.SetPrincipal(c, principal)
+			c.Set("user", principal.Username)
+			c.Next()
+		}, ChangePassword)
+		w := httptest.NewRecorder()
+		body := `{"old_password":"Old-password1","new_password":"New-password2!"}`
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/auth/password", strings.NewReader(body)))
+		return w
+	}
+	storedUser := func() bson.D {
+		return mtest.CreateCursorResponse(0, "db.users", mtest.FirstBatch, bson.D{
+			{Key: "_id", Value: principal.UserID},
+			{Key: "username", Value: principal.Username},
+			{Key: "password", Value: hash},
+		})
+	}
+	failure := mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 2, Message: "bad value"})
+
+	mt.Run("retries a failed revocation", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(storedUser(), mtest.CreateSuccessResponse(), failure, mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}))
+		if w := changePassword(); w.Code != http.StatusOK {
+			mt.Fatalf("got %d: %s", w.Code, w.Body)
+		}
+	})
+
+	mt.Run("fails when other sessions stay valid", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(storedUser(), mtest.CreateSuccessResponse(), failure, failure)
+		if w := changePassword(); w.Code != http.StatusInternalServerError {
+			mt.Fatalf("got %d: %s", w.Code, w.Body)
+		}
+	})
+}
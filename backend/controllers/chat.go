@@ -1,12 +1,17 @@
 package controllers
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/KevinChaves65/Project_Boo/middlewares"
 	"github.com/KevinChaves65/Project_Boo/models"
 	"github.com/KevinChaves65/Project_Boo/services"
 	"github.com/KevinChaves65/Project_Boo/utils"
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // ChatHandler handles WebSocket connections for real-time chat
@@ -14,49 +19,190 @@ func ChatHandler(w http.ResponseWriter, r *http.Request) {
 	services.HandleConnections(w, r)
 }
 
+// ChatEventsHandler streams real-time chat events as Server-Sent Events
+func ChatEventsHandler(c *gin.Context) {
+	services.HandleEventStream(c.Writer, c.Request, middlewares.CurrentPrincipal(c))
+}
+
+// CreateEventStreamTicket issues a ticket for opening the event stream as
+// /auth/chat/events?ticket=..., since EventSource cannot send an Authorization header
+func CreateEventStreamTicket(c *gin.Context) {
+	ticket, expires := middlewares.IssueStreamTicket(middlewares.CurrentPrincipal(c))
+	c.JSON(http.StatusOK, gin.H{"ticket": ticket, "expires_at": expires})
+}
+
 func SendMessage(c *gin.Context) {
-	var message models.Message
-	if err := c.ShouldBindJSON(&message); err != nil {
+	var request struct {
+		Receiver      string   `json:"receiver" binding:"required"`
+		Content       string   `json:"content"`
+		AttachmentIDs []string `json:"attachment_ids"`
+
+		// End-to-end encrypted messages send ciphertexts instead of content
+		SenderDevice string                    `json:"sender_device"`
+		Ciphertexts  []models.DeviceCiphertext `json:"ciphertexts"`
+
+		// Overrides the couple's default lifetime for a disappearing message
+		Expiry *models.MessageExpiry `json:"expiry"`
+		// Sending again with the same ID returns the stored message instead of a duplicate
+		ClientMsgID string `json:"client_msg_id"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	principal := middlewares.CurrentPrincipal(c)
 
-	// Validate that the receiver exists
-	_, err := models.GetUserByUsername(message.Receiver)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Receiver not found"})
+	// Messages only go to the partner; unknown users are rejected the same way
+	// so the endpoint cannot be used to probe usernames
+	receiver, err := models.GetUserByUsername(request.Receiver)
+	if err != nil || !principal.HasCouple() || *principal.PartnerID != receiver.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": services.ErrReceiverNotPartner.Error()})
 		return
 	}
 
-	// Encrypt the message content
-	encryptedMessage, err := utils.EncryptMessage(message.Content)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt message"})
-		return
+	attachmentIDs := make([]primitive.ObjectID, 0, len(request.AttachmentIDs))
+	for _, hexID := range request.AttachmentIDs {
+		id, err := primitive.ObjectIDFromHex(hexID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment ID"})
+			return
+		}
+		attachmentIDs = append(attachmentIDs, id)
 	}
-	message.Content = encryptedMessage
 
-	// Save the message to the database
-	if err := models.SaveMessage(message); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send message"})
+	message, err := services.PostChatMessage(services.ChatPost{
+		SenderID:      principal.UserID,
+		ReceiverID:    receiver.ID,
+		Sender:        principal.Username,
+		Receiver:      receiver.Username,
+		CoupleID:      *principal.CoupleID,
+		Content:       request.Content,
+		AttachmentIDs: attachmentIDs,
+		SenderDevice:  request.SenderDevice,
+		Ciphertexts:   request.Ciphertexts,
+		Expiry:        request.Expiry,
+		ClientMsgID:   request.ClientMsgID,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrEmptyMessage), errors.Is(err, services.ErrMessageTooLong),
+			errors.Is(err, services.ErrTooManyAttachments), errors.Is(err, services.ErrE2ERequired),
+			errors.Is(err, services.ErrE2EDisabled), errors.Is(err, services.ErrInvalidCiphertext),
+			errors.Is(err, services.ErrInvalidDeviceID), errors.Is(err, models.ErrInvalidMessageExpiry),
+			errors.Is(err, services.ErrInvalidClientMsgID):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrE2EUnavailable):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrReceiverNotPartner):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		case errors.Is(err, models.ErrAttachmentNotFound), errors.Is(err, models.ErrAttachmentInUse):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Attachments must be your own unsent uploads"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send message"})
+		}
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Message sent successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "Message sent successfully", "chat_message": message})
 }
 
+// ReceiveMessages returns one page of the conversation, newest first.
+// Use before=<id> to load older messages, after=<id> or since=<unix time> to
+// poll for new ones, and limit to set the page size.
 func ReceiveMessages(c *gin.Context) {
-	user, _ := c.Get("user")
+	principal := middlewares.CurrentPrincipal(c)
+
+	query := models.MessageQuery{
+		CoupleID: principal.CoupleID,
+		UserID:   principal.UserID,
+	}
+
+	cursors := 0
+	if before := c.Query("before"); before != "" {
+		id, err := primitive.ObjectIDFromHex(before)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid before cursor"})
+			return
+		}
+		query.Before = &id
+		cursors++
+	}
+	if after := c.Query("after"); after != "" {
+		id, err := primitive.ObjectIDFromHex(after)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid after cursor"})
+			return
+		}
+		query.After = &id
+		cursors++
+	}
+	if since := c.Query("since"); since != "" {
+		ts, err := strconv.ParseInt(since, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid since timestamp"})
+			return
+		}
+		query.Since = &ts
+		cursors++
+	}
+	if cursors > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Use only one of before, after and since"})
+		return
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		query.Limit = n
+	}
 
 	// Retrieve messages for the user
-	messages, err := models.GetMessages(user.(string))
+	page, err := models.GetMessages(query)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve messages"})
 		return
 	}
 
-	// Decrypt the message content
+	// Fetching a page hands its new messages to the caller, so they count as delivered
+	messages := page.Messages
+	var undelivered []primitive.ObjectID
+	for _, msg := range messages {
+		if msg.ReceiverID == principal.UserID && msg.Status == models.MessageSent {
+			undelivered = append(undelivered, msg.ID)
+		}
+	}
+	delivered := make(map[primitive.ObjectID]*time.Time)
+	for _, msg := range services.AcknowledgeDelivered(principal.UserID, undelivered) {
+		delivered[msg.ID] = msg.DeliveredAt
+	}
+
+	ids := make([]primitive.ObjectID, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	reactions, err := models.GetReactionSummaries(ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve reactions"})
+		return
+	}
+	if err := services.LoadMessageAttachments(messages); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve attachments"})
+		return
+	}
+
+	// Decrypt only the messages of this page
 	for i, msg := range messages {
+		messages[i].Reactions = reactions[msg.ID]
+		if at, ok := delivered[msg.ID]; ok {
+			messages[i].Status = models.MessageDelivered
+			messages[i].DeliveredAt = at
+		}
+		if msg.Deleted || msg.E2E {
+			// Tombstones have no content left to decrypt, and end-to-end messages are decrypted by the clients
+			continue
+		}
 		decryptedMessage, err := utils.DecryptMessage(msg.Content)
 		if err != nil {
 			// Log the error and skip this message
@@ -66,5 +212,181 @@ func ReceiveMessages(c *gin.Context) {
 		messages[i].Content = decryptedMessage
 	}
 
-	c.JSON(http.StatusOK, gin.H{"messages": messages})
+	response := gin.H{"messages": messages, "has_more": page.HasMore}
+	if len(messages) > 0 {
+		response["newest_id"] = messages[0].ID.Hex()
+		response["oldest_id"] = messages[len(messages)-1].ID.Hex()
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// MarkMessagesRead marks every message the caller received up to read_up_to as read
+func MarkMessagesRead(c *gin.Context) {
+	var request struct {
+		ReadUpTo string `json:"read_up_to" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	upTo, err := primitive.ObjectIDFromHex(request.ReadUpTo)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	receipt, err := services.AcknowledgeRead(middlewares.CurrentPrincipal(c), upTo)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark messages as read"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"marked_read": receipt.Count, "read_at": receipt.ReadAt})
+}
+
+// GetUnreadCount returns how many received messages the caller has not read yet
+func GetUnreadCount(c *gin.Context) {
+	count, err := models.CountUnreadMessages(middlewares.CurrentPrincipal(c).UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count unread messages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"unread_count": count})
+}
+
+// EditMessage replaces the content of one of the caller's messages
+func EditMessage(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+	var request struct {
+		Content string `json:"content"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	message, err := services.EditChatMessage(middlewares.CurrentPrincipal(c).UserID, id, request.Content)
+	if err != nil {
+		respondMessageChangeError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Message edited successfully", "chat_message": message})
+}
+
+// UnsendMessage replaces one of the caller's messages with a tombstone
+func UnsendMessage(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	message, err := services.UnsendChatMessage(middlewares.CurrentPrincipal(c).UserID, id)
+	if err != nil {
+		respondMessageChangeError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Message unsent successfully", "chat_message": message})
+}
+
+// GetMessageHistory returns the earlier versions of an edited message to either participant
+func GetMessageHistory(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+	message, err := models.GetMessageByID(id)
+	if err != nil || !message.IsParticipant(middlewares.CurrentPrincipal(c).UserID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	history := make([]models.MessageEdit, len(message.EditHistory))
+	for i, edit := range message.EditHistory {
+		history[i].EditedAt = edit.EditedAt
+		content, err := utils.DecryptMessage(edit.Content)
+		if err != nil {
+			content = "[Failed to decrypt message]"
+		}
+		history[i].Content = content
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": message.ID, "edited": message.Edited, "history": history})
+}
+
+func respondMessageChangeError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrEmptyMessage), errors.Is(err, services.ErrMessageTooLong):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrMessageNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+	case errors.Is(err, models.ErrNotMessageSender), errors.Is(err, models.ErrEditWindowClosed):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrMessageDeleted), errors.Is(err, services.ErrE2EUnavailable):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update message"})
+	}
+}
+
+// AddReaction adds the caller's emoji reaction to a message
+func AddReaction(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+	var request struct {
+		Emoji string `json:"emoji" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.AddReaction(middlewares.CurrentPrincipal(c), id, request.Emoji); err != nil {
+		respondReactionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Reaction added successfully"})
+}
+
+// RemoveReaction removes the caller's emoji reaction from a message
+func RemoveReaction(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	if err := services.RemoveReaction(middlewares.CurrentPrincipal(c), id, c.Param("emoji")); err != nil {
+		respondReactionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Reaction removed successfully"})
+}
+
+func respondReactionError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrInvalidEmoji):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrMessageNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+	case errors.Is(err, models.ErrReactionNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reaction not found"})
+	case errors.Is(err, models.ErrMessageDeleted):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update reaction"})
+	}
 }
@@ -1,142 +1,235 @@
 package controllers
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
+	"github.com/KevinChaves65/Project_Boo/middlewares"
 	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/KevinChaves65/Project_Boo/services"
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-func LinkCouple(c *gin.Context) {
-	var request struct {
-		PartnerID string `json:"partner_id"`
-	}
-
-	if err := c.ShouldBindJSON(&request); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+func GetCouple(c *gin.Context) {
+	objectID, ok := middlewares.AuthorizeCouple(c, c.Param("id"))
+	if !ok {
 		return
 	}
 
-	// Get current user from JWT token
-	currentUsername, exists := c.Get("user")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+	// Retrieve the couple by ID
+	couple, err := models.GetCoupleByID(objectID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Couple not found"})
 		return
 	}
 
-	// Retrieve current user by username
-	currentUser, err := models.GetUser(currentUsername.(string))
+	// Fetch usernames for user1 and user2
+	user1, err := models.GetUserByID(couple.User1ID)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Current user not found"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user1"})
 		return
 	}
 
-	// Convert partner ID string to ObjectID
-	partnerObjectID, err := primitive.ObjectIDFromHex(request.PartnerID)
+	user2, err := models.GetUserByID(couple.User2ID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid partner ID format"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user2"})
 		return
 	}
 
-	// Retrieve partner by ID
-	partner, err := models.GetUserByID(partnerObjectID)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Partner not found"})
+	// Return the couple info along with usernames
+	c.JSON(http.StatusOK, gin.H{
+		"couple": gin.H{
+			"id":             couple.ID.Hex(),
+			"user1_id":       couple.User1ID.Hex(),
+			"user1_username": user1.Username,
+			"user2_id":       couple.User2ID.Hex(),
+			"user2_username": user2.Username,
+			"created_at":     couple.CreatedAt,
+			"status":         couple.Status,
+			"purge_at":       couple.PurgeAt,
+		},
+	})
+}
+
+// maxCoolingOffDays is the longest cooling-off period that can be asked for
+const maxCoolingOffDays = 365
+
+// DeleteCouple starts unlinking the couple, with the cooling-off period from
+// the cooling_off_days query parameter or the server default
+func DeleteCouple(c *gin.Context) {
+	objectID, ok := middlewares.AuthorizeCouple(c, c.Param("id"))
+	if !ok {
 		return
 	}
 
-	// Check if current user is already in a couple
-	_, err = models.GetCoupleByUserID(currentUser.ID)
-	if err == nil {
-		c.JSON(http.StatusConflict, gin.H{"error": "You are already in a couple"})
-		return
+	coolingOffDays := defaultCoolingOffDays()
+	if days := c.Query("cooling_off_days"); days != "" {
+		parsed, err := strconv.Atoi(days)
+		if err != nil || parsed < 0 || parsed > maxCoolingOffDays {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cooling_off_days"})
+			return
+		}
+		coolingOffDays = parsed
 	}
 
-	// Check if partner is already in a couple
-	_, err = models.GetCoupleByUserID(partner.ID)
-	if err == nil {
-		c.JSON(http.StatusConflict, gin.H{"error": "Partner is already in a couple"})
+	requestUnlink(c, objectID, coolingOffDays)
+}
+
+// UnlinkCouple starts unlinking the caller's couple
+func UnlinkCouple(c *gin.Context) {
+	coupleID, ok := middlewares.AuthorizeCouple(c, "")
+	if !ok {
 		return
 	}
 
-	// Create a couple entry
-	coupleID, err := models.AddCouple(currentUser.ID, partner.ID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link couple"})
-		return
+	var request struct {
+		CoolingOffDays *int `json:"cooling_off_days"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 	}
 
-	// Update users with the couple ID
-	err = models.UpdateUser(currentUser.ID, bson.M{"couple_id": coupleID})
+	coolingOffDays := defaultCoolingOffDays()
+	if request.CoolingOffDays != nil {
+		if *request.CoolingOffDays < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cooling_off_days cannot be negative"})
+			return
+		}
+		if *request.CoolingOffDays > maxCoolingOffDays {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("cooling_off_days cannot be more than %d", maxCoolingOffDays)})
+			return
+		}
+		coolingOffDays = *request.CoolingOffDays
+	}
+
+	requestUnlink(c, coupleID, coolingOffDays)
+}
+
+func requestUnlink(c *gin.Context, coupleID primitive.ObjectID, coolingOffDays int) {
+	principal := middlewares.CurrentPrincipal(c)
+
+	couple, err := models.RequestUnlink(coupleID, principal.UserID, time.Duration(coolingOffDays)*24*time.Hour)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update current user"})
+		if errors.Is(err, models.ErrUnlinkPending) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlink couple"})
 		return
 	}
 
-	err = models.UpdateUser(partner.ID, bson.M{"couple_id": coupleID})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update partner"})
+	if partner, err := models.GetUserByID(*principal.PartnerID); err == nil {
+		data := bson.M{"couple_id": coupleID.Hex()}
+		if coolingOffDays == 0 {
+			services.Notify(partner, "couple_unlinked", principal.Username+" unlinked your couple", data)
+		} else {
+			data["purge_at"] = couple.PurgeAt
+			services.Notify(partner, "unlink_requested", principal.Username+" asked to unlink. Either of you can undo it until the cooling-off period ends.", data)
+		}
+	}
+
+	if coolingOffDays == 0 {
+		c.JSON(http.StatusOK, gin.H{"message": "Couple unlinked successfully", "data_policy": models.CurrentDataPolicy()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Couple linked successfully", "couple_id": coupleID.Hex()})
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Unlink requested",
+		"purge_at":    couple.PurgeAt,
+		"data_policy": models.CurrentDataPolicy(),
+	})
 }
 
-func GetCouple(c *gin.Context) {
-	coupleID := c.Param("id")
-	objectID, err := primitive.ObjectIDFromHex(coupleID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid couple ID"})
+// CancelUnlinkCouple lets either partner undo a pending unlink
+func CancelUnlinkCouple(c *gin.Context) {
+	coupleID, ok := middlewares.AuthorizeCouple(c, "")
+	if !ok {
 		return
 	}
+	principal := middlewares.CurrentPrincipal(c)
 
-	// Retrieve the couple by ID
-	couple, err := models.GetCoupleByID(objectID)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Couple not found"})
+	if err := models.CancelUnlink(coupleID); err != nil {
+		switch {
+		case errors.Is(err, models.ErrNoUnlinkPending):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, models.ErrCoolingOffEnded):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel unlink"})
+		}
 		return
 	}
 
-	// Fetch usernames for user1 and user2
-	user1, err := models.GetUserByID(couple.User1ID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user1"})
+	if partner, err := models.GetUserByID(*principal.PartnerID); err == nil {
+		services.Notify(partner, "unlink_cancelled", principal.Username+" cancelled the unlink", bson.M{"couple_id": coupleID.Hex()})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Unlink cancelled"})
+}
+
+// ExportCouple downloads the caller's copy of the couple's shared data
+func ExportCouple(c *gin.Context) {
+	coupleID, ok := middlewares.AuthorizeCouple(c, "")
+	if !ok {
 		return
 	}
 
-	user2, err := models.GetUserByID(couple.User2ID)
+	export, err := models.ExportCoupleData(coupleID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user2"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export couple data"})
 		return
 	}
 
-	// Return the couple info along with usernames
-	c.JSON(http.StatusOK, gin.H{
-		"couple": gin.H{
-			"id":             couple.ID.Hex(),
-			"user1_id":       couple.User1ID.Hex(),
-			"user1_username": user1.Username,
-			"user2_id":       couple.User2ID.Hex(),
-			"user2_username": user2.Username,
-			"created_at":     couple.CreatedAt,
-		},
-	})
+	filename := "heyboo-export-" + export.ExportedAt.Format("2006-01-02") + ".json"
+	c.Header("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	c.JSON(http.StatusOK, export)
 }
 
-func DeleteCouple(c *gin.Context) {
-	coupleID := c.Param("id")
-	objectID, err := primitive.ObjectIDFromHex(coupleID)
+// GetMessageExpiry returns how long the couple's new messages live
+func GetMessageExpiry(c *gin.Context) {
+	couple, err := models.GetCoupleByID(*middlewares.CurrentPrincipal(c).CoupleID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid couple ID"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve couple"})
+		return
+	}
+
+	c.JSON(http.StatusOK, couple.MessageExpiry)
+}
+
+// SetMessageExpiry changes the couple's default lifetime for new messages, in
+// seconds after sending and after reading; 0 turns a limit off
+func SetMessageExpiry(c *gin.Context) {
+	var expiry models.MessageExpiry
+	if err := c.ShouldBindJSON(&expiry); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err := models.DeleteCouple(objectID); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete couple"})
+	if err := services.SetMessageExpiry(middlewares.CurrentPrincipal(c), expiry); err != nil {
+		if errors.Is(err, models.ErrInvalidMessageExpiry) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update message expiry"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Couple deleted successfully"})
+	c.JSON(http.StatusOK, expiry)
+}
+
+// defaultCoolingOffDays reads COUPLE_COOLING_OFF_DAYS, defaulting to 7 days
+func defaultCoolingOffDays() int {
+	if days, err := strconv.Atoi(os.Getenv("COUPLE_COOLING_OFF_DAYS")); err == nil && days >= 0 && days <= maxCoolingOffDays {
+		return days
+	}
+	return 7
 }
@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// serveAs sends one request through the handler as the given principal
+func serveAs(principal *middlewares.Principal, method, route, target, body string, handler gin.HandlerFunc) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Handle(method, route, func(c *gin.Context) {
+		middlewares.SetPrincipal(c, principal)
+		c.Next()
+	}, handler)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+// otherCouple is a mock response for a couple the caller is not part of
+func otherCouple(id primitive.ObjectID) bson.D {
+	return mtest.CreateCursorResponse(0, "db.couples", mtest.FirstBatch, bson.D{
+		{Key: "_id", Value: id},
+		{Key: "user1_id", Value: primitive.NewObjectID()},
+		{Key: "user2_id", Value: primitive.NewObjectID()},
+	})
+}
+
+// assertScopedTo checks that the last command filtered on the caller's couple
+func assertScopedTo(mt *mtest.T, coupleID interface{}) {
+	mt.Helper()
+	event := mt.GetStartedEvent()
+	if event == nil {
+		mt.Fatal("no command was sent")
+	}
+	if !strings.Contains(event.Command.String(), "couple_id") {
+		mt.Fatalf("%s is not scoped to a couple", event.CommandName)
+	}
+	if id, ok := coupleID.(primitive.ObjectID); ok {
+		coupleID = id.Hex()
+	}
+	if !strings.Contains(event.Command.String(), coupleID.(string)) {
+		mt.Fatalf("%s is not scoped to the caller's couple: %s", event.CommandName, event.Command)
+	}
+}
+
+func TestCrossCoupleAccessIsDenied(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	ownCouple := primitive.NewObjectID()
+	principal := &middlewares.Principal{UserID: primitive.NewObjectID(), Username: "alice", CoupleID: &ownCouple}
+
+	mt.Run("list another couple's milestones", func(mt *mtest.T) {
+		config.DB = mt.DB
+		other := primitive.NewObjectID()
+		mt.AddMockResponses(otherCouple(other))
+		w := serveAs(principal, http.MethodGet, "/milestones", "/milestones?couple_id="+other.Hex(), "", GetMilestones)
+		if w.Code != http.StatusForbidden {
+			mt.Fatalf("got %d, want 403", w.Code)
+		}
+	})
+
+	mt.Run("list milestones of an unknown couple", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.couples", mtest.FirstBatch))
+		w := serveAs(principal, http.MethodGet, "/milestones", "/milestones?couple_id="+primitive.NewObjectID().Hex(), "", GetMilestones)
+		if w.Code != http.StatusNotFound {
+			mt.Fatalf("got %d, want 404", w.Code)
+		}
+	})
+
+	mt.Run("list milestones with a malformed couple ID", func(mt *mtest.T) {
+		w := serveAs(principal, http.MethodGet, "/milestones", "/milestones?couple_id=xyz", "", GetMilestones)
+		if w.Code != http.StatusBadRequest {
+			mt.Fatalf("got %d, want 400", w.Code)
+		}
+	})
+
+	mt.Run("add a milestone to another couple", func(mt *mtest.T) {
+		config.DB = mt.DB
+		other := primitive.NewObjectID()
+		mt.AddMockResponses(otherCouple(other))
+		body := `{"title":"Trip","couple_id":"` + other.Hex() + `","date":"2025-02-14T00:00:00Z"}`
+		w := serveAs(principal, http.MethodPost, "/milestones", "/milestones", body, AddMilestone)
+		if w.Code != http.StatusForbidden {
+			mt.Fatalf("got %d, want 403", w.Code)
+		}
+	})
+
+	mt.Run("edit another couple's milestone", func(mt *mtest.T) {
+		config.DB = mt.DB
+		// The milestone is not matched within the caller's couple
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}))
+		target := "/milestones/" + primitive.NewObjectID().Hex()
+		w := serveAs(principal, http.MethodPut, "/milestones/:id", target, `{"title":"Mine now"}`, UpdateMilestone)
+		if w.Code != http.StatusNotFound {
+			mt.Fatalf("got %d, want 404", w.Code)
+		}
+		assertScopedTo(mt, ownCouple)
+	})
+
+	mt.Run("delete another couple's milestone", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}))
+		target := "/milestones/" + primitive.NewObjectID().Hex()
+		w := serveAs(principal, http.MethodDelete, "/milestones/:id", target, "", DeleteMilestone)
+		if w.Code != http.StatusNotFound {
+			mt.Fatalf("got %d, want 404", w.Code)
+		}
+		assertScopedTo(mt, ownCouple)
+	})
+
+	mt.Run("edit a word in another couple's word bank", func(mt *mtest.T) {
+		config.DB = mt.DB
+		other := primitive.NewObjectID()
+		mt.AddMockResponses(otherCouple(other))
+		body := `{"couple_id":"` + other.Hex() + `","word_id":"w1","new_theme_id":"romantic"}`
+		w := serveAs(principal, http.MethodPut, "/word-bank/theme", "/word-bank/theme", body, UpdateWordThemeHandler)
+		if w.Code != http.StatusForbidden {
+			mt.Fatalf("got %d, want 403", w.Code)
+		}
+	})
+
+	mt.Run("edit another couple's word through the caller's couple", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}))
+		body := `{"word_id":"someone-elses-word","new_theme_id":"romantic"}`
+		w := serveAs(principal, http.MethodPut, "/word-bank/theme", "/word-bank/theme", body, UpdateWordThemeHandler)
+		if w.Code != http.StatusNotFound {
+			mt.Fatalf("got %d, want 404", w.Code)
+		}
+		assertScopedTo(mt, ownCouple)
+	})
+
+	mt.Run("delete a word from another couple's word bank", func(mt *mtest.T) {
+		config.DB = mt.DB
+		other := primitive.NewObjectID()
+		mt.AddMockResponses(otherCouple(other))
+		target := "/word-bank?word_id=w1&couple_id=" + other.Hex()
+		w := serveAs(principal, http.MethodDelete, "/word-bank", target, "", DeleteWordFromBankHandler)
+		if w.Code != http.StatusForbidden {
+			mt.Fatalf("got %d, want 403", w.Code)
+		}
+	})
+
+	mt.Run("delete another couple's word through the caller's couple", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}))
+		w := serveAs(principal, http.MethodDelete, "/word-bank", "/word-bank?word_id=someone-elses-word", "", DeleteWordFromBankHandler)
+		if w.Code != http.StatusNotFound {
+			mt.Fatalf("got %d, want 404", w.Code)
+		}
+		assertScopedTo(mt, ownCouple)
+	})
+}
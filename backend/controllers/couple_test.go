@@ -0,0 +1,27 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestUnlinkRejectsOutOfRangeCoolingOff(t *testing.T) {
+	coupleID := primitive.NewObjectID()
+	principal := &middlewares.Principal{UserID: primitive.NewObjectID(), Username: "alice", CoupleID: &coupleID}
+
+	// Large values would overflow into a period that has already ended
+	for _, days := range []string{"-1", "366", "106752"} {
+		w := serveAs(principal, http.MethodPost, "/couple/unlink", "/couple/unlink", `{"cooling_off_days":`+days+`}`, UnlinkCouple)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("cooling_off_days=%s: got %d, want 400", days, w.Code)
+		}
+		target := "/couples/" + coupleID.Hex() + "?cooling_off_days=" + days
+		w = serveAs(principal, http.MethodDelete, "/couples/:id", target, "", DeleteCouple)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("cooling_off_days=%s: got %d, want 400", days, w.Code)
+		}
+	}
+}
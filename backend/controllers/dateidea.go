@@ -228,7 +228,7 @@ func generateFallbackIdeas(location, preferences, budget string) string {
 			"address": "%s restaurant district",
 			"mapUrl": "https://maps.google.com/maps?q=restaurants+near+%s"
 		}
-	]`, location, location, location, locationEncoded, location, location, location, locationEncoded, location, location, location, locationEncoded)
+	]`, location, location, locationEncoded, location, location, locationEncoded, location, location, locationEncoded)
 
 	return fallbackJSON
 }
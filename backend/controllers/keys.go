@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/KevinChaves65/Project_Boo/services"
+	"github.com/gin-gonic/gin"
+)
+
+// PublishDeviceKey registers the X25519 identity key of one of the caller's devices
+func PublishDeviceKey(c *gin.Context) {
+	var request struct {
+		PublicKey string `json:"public_key" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	key, err := services.PublishDeviceKey(middlewares.CurrentPrincipal(c), c.Param("device_id"), request.PublicKey)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidDeviceID) || errors.Is(err, services.ErrInvalidPublicKey) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to publish device key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, key)
+}
+
+// GetDeviceKeys lists the caller's own device keys
+func GetDeviceKeys(c *gin.Context) {
+	keys, err := models.GetDeviceKeys(middlewares.CurrentPrincipal(c).UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve device keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"devices": keys})
+}
+
+// DeleteDeviceKey removes one of the caller's devices from the key directory
+func DeleteDeviceKey(c *gin.Context) {
+	if err := services.RemoveDeviceKey(middlewares.CurrentPrincipal(c), c.Param("device_id")); err != nil {
+		if errors.Is(err, models.ErrDeviceKeyNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Device key not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove device key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Device key removed successfully"})
+}
+
+// GetPartnerKeys returns the partner's device keys, for sealing messages to
+// them, together with the couple's safety number
+func GetPartnerKeys(c *gin.Context) {
+	principal := middlewares.CurrentPrincipal(c)
+
+	keys, err := models.GetDeviceKeys(*principal.PartnerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve device keys"})
+		return
+	}
+	safetyNumber, err := services.SafetyNumber(principal.UserID, *principal.PartnerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute safety number"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":       principal.PartnerID.Hex(),
+		"devices":       keys,
+		"safety_number": safetyNumber,
+	})
+}
+
+// GetE2EStatus reports whether the caller's couple uses end-to-end encryption
+func GetE2EStatus(c *gin.Context) {
+	principal := middlewares.CurrentPrincipal(c)
+
+	couple, err := models.GetCoupleByID(*principal.CoupleID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve couple"})
+		return
+	}
+	safetyNumber, err := services.SafetyNumber(principal.UserID, *principal.PartnerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute safety number"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":          couple.E2EEnabled,
+		"changed_at":       couple.E2EChangedAt,
+		"changed_by":       couple.E2EChangedBy,
+		"off_requested_by": couple.E2EOffRequestedBy,
+		"safety_number":    safetyNumber,
+	})
+}
+
+// SetE2E turns end-to-end encryption on or off for the caller's couple.
+// Turning it off is only requested until the partner agrees.
+func SetE2E(c *gin.Context) {
+	var request struct {
+		Enabled *bool `json:"enabled" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.SetE2E(middlewares.CurrentPrincipal(c), *request.Enabled); err != nil {
+		if errors.Is(err, services.ErrE2EOffPending) {
+			c.JSON(http.StatusAccepted, gin.H{"message": err.Error(), "enabled": true, "off_requested": true})
+			return
+		}
+		if errors.Is(err, services.ErrPartnerHasNoKeys) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update end-to-end encryption"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "End-to-end encryption updated successfully", "enabled": *request.Enabled})
+}
@@ -1,12 +1,15 @@
 package controllers
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
+	"github.com/KevinChaves65/Project_Boo/middlewares"
 	"github.com/KevinChaves65/Project_Boo/models"
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func AddMilestone(c *gin.Context) {
@@ -26,6 +29,18 @@ func AddMilestone(c *gin.Context) {
 		milestone.Date = parsedDate
 	}
 
+	// The caller must belong to the couple the milestone is added to
+	coupleID := ""
+	if !milestone.CoupleID.IsZero() {
+		coupleID = milestone.CoupleID.Hex()
+	}
+	objectID, ok := middlewares.AuthorizeCouple(c, coupleID)
+	if !ok {
+		return
+	}
+	milestone.ID = primitive.NilObjectID
+	milestone.CoupleID = objectID
+
 	// Add the milestone to the database
 	if err := models.AddMilestone(milestone); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add milestone"})
@@ -36,10 +51,9 @@ func AddMilestone(c *gin.Context) {
 }
 
 func GetMilestones(c *gin.Context) {
-	coupleID := c.Query("couple_id")                     // Retrieve the couple_id from the query parameters
-	objectID, err := primitive.ObjectIDFromHex(coupleID) // Convert couple_id to ObjectID
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid couple ID"})
+	// Defaults to the caller's couple when couple_id is omitted
+	objectID, ok := middlewares.AuthorizeCouple(c, c.Query("couple_id"))
+	if !ok {
 		return
 	}
 
@@ -67,7 +81,16 @@ func UpdateMilestone(c *gin.Context) {
 		return
 	}
 
-	if err := models.UpdateMilestone(objectID, milestone); err != nil {
+	coupleID, ok := middlewares.AuthorizeCouple(c, "")
+	if !ok {
+		return
+	}
+
+	if err := models.UpdateMilestone(coupleID, objectID, milestone); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Milestone not found"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update milestone"})
 		return
 	}
@@ -83,7 +106,16 @@ func DeleteMilestone(c *gin.Context) {
 		return
 	}
 
-	if err := models.DeleteMilestone(objectID); err != nil {
+	coupleID, ok := middlewares.AuthorizeCouple(c, "")
+	if !ok {
+		return
+	}
+
+	if err := models.DeleteMilestone(coupleID, objectID); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Milestone not found"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete milestone"})
 		return
 	}
@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// GetNotifications returns the latest notifications of the current user
+func GetNotifications(c *gin.Context) {
+	principal := middlewares.CurrentPrincipal(c)
+
+	notifications, err := models.GetNotifications(principal.UserID, c.Query("unread") == "true")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve notifications"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"notifications": notifications})
+}
+
+// MarkNotificationRead marks one notification of the current user as read
+func MarkNotificationRead(c *gin.Context) {
+	principal := middlewares.CurrentPrincipal(c)
+
+	notificationID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification ID"})
+		return
+	}
+
+	if err := models.MarkNotificationRead(principal.UserID, notificationID); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notification"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Notification marked as read"})
+}
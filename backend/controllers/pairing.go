@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/KevinChaves65/Project_Boo/services"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func inviteResponse(invite models.PairingInvite) gin.H {
+	return gin.H{
+		"id":           invite.ID.Hex(),
+		"code":         invite.Code,
+		"qr_payload":   invite.QRPayload(),
+		"status":       invite.Status,
+		"created_at":   invite.CreatedAt,
+		"expires_at":   invite.ExpiresAt,
+		"responded_at": invite.RespondedAt,
+		"couple_id":    invite.CoupleID,
+	}
+}
+
+// CreatePairingInvite creates a pairing code the caller can share with their partner
+func CreatePairingInvite(c *gin.Context) {
+	principal := middlewares.CurrentPrincipal(c)
+	if principal.HasCouple() {
+		c.JSON(http.StatusConflict, gin.H{"error": "You are already in a couple"})
+		return
+	}
+
+	invite, err := models.CreatePairingInvite(principal.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invite"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"invite": inviteResponse(invite)})
+}
+
+// GetPairingInvites lists the invites the caller created or answered
+func GetPairingInvites(c *gin.Context) {
+	principal := middlewares.CurrentPrincipal(c)
+
+	invites, err := models.GetPairingInvites(principal.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve invites"})
+		return
+	}
+
+	response := make([]gin.H, 0, len(invites))
+	for _, invite := range invites {
+		response = append(response, inviteResponse(invite))
+	}
+	c.JSON(http.StatusOK, gin.H{"invites": response})
+}
+
+// PreviewPairingInvite shows who sent an invite so the partner can decide
+func PreviewPairingInvite(c *gin.Context) {
+	invite, err := models.GetPairingInviteByCode(c.Param("code"))
+	if err != nil {
+		respondInviteError(c, err)
+		return
+	}
+
+	inviter, err := models.GetUserByID(invite.InviterID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Inviter not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"invite": gin.H{
+			"code":       invite.Code,
+			"status":     invite.Status,
+			"expires_at": invite.ExpiresAt,
+			"inviter": gin.H{
+				"username":  inviter.Username,
+				"full_name": inviter.FullName,
+			},
+		},
+	})
+}
+
+// AcceptPairingInvite links the caller with the inviter
+func AcceptPairingInvite(c *gin.Context) {
+	respondToPairingInvite(c, true)
+}
+
+// DeclinePairingInvite turns down an invite without linking
+func DeclinePairingInvite(c *gin.Context) {
+	respondToPairingInvite(c, false)
+}
+
+func respondToPairingInvite(c *gin.Context, accept bool) {
+	principal := middlewares.CurrentPrincipal(c)
+	if accept && principal.HasCouple() {
+		c.JSON(http.StatusConflict, gin.H{"error": "You are already in a couple"})
+		return
+	}
+
+	invite, err := models.RespondToPairingInvite(c.Param("code"), principal.UserID, accept)
+	if err != nil {
+		respondInviteError(c, err)
+		return
+	}
+
+	inviter, err := models.GetUserByID(invite.InviterID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch inviter"})
+		return
+	}
+	invitee, err := models.GetUserByID(principal.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+
+	data := bson.M{"invite_id": invite.ID.Hex(), "status": invite.Status}
+	if !accept {
+		services.Notify(inviter, "pairing_declined", invitee.Username+" declined your invite", data)
+		c.JSON(http.StatusOK, gin.H{"message": "Invite declined", "invite": inviteResponse(invite)})
+		return
+	}
+
+	data["couple_id"] = invite.CoupleID.Hex()
+	services.Notify(inviter, "pairing_accepted", invitee.Username+" accepted your invite. You are now linked!", data)
+	services.Notify(invitee, "pairing_accepted", "You are now linked with "+inviter.Username, data)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":   "Couple linked successfully",
+		"couple_id": invite.CoupleID.Hex(),
+		"invite":    inviteResponse(invite),
+	})
+}
+
+// CancelPairingInvite withdraws a pending invite created by the caller
+func CancelPairingInvite(c *gin.Context) {
+	principal := middlewares.CurrentPrincipal(c)
+
+	if err := models.CancelPairingInvite(principal.UserID, c.Param("code")); err != nil {
+		respondInviteError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invite cancelled"})
+}
+
+func respondInviteError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrInviteNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found"})
+	case errors.Is(err, models.ErrInviteExpired):
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrInviteNotPending), errors.Is(err, models.ErrAlreadyInCouple):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrOwnInvite):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process invite"})
+	}
+}
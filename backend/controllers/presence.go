@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"github.com/KevinChaves65/Project_Boo/services"
+	"github.com/gin-gonic/gin"
+)
+
+// GetPartnerPresence returns whether the partner is online, away or offline
+// and, unless they hide it, when they were last seen
+func GetPartnerPresence(c *gin.Context) {
+	presence, err := services.PartnerPresence(middlewares.CurrentPrincipal(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve presence"})
+		return
+	}
+
+	c.JSON(http.StatusOK, presence)
+}
+
+// SetPresencePrivacy lets the caller hide their last-seen time from the partner
+func SetPresencePrivacy(c *gin.Context) {
+	var request struct {
+		HideLastSeen *bool `json:"hide_last_seen" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.SetHideLastSeen(middlewares.CurrentPrincipal(c), *request.HideLastSeen); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update presence privacy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"hide_last_seen": *request.HideLastSeen})
+}
@@ -1,15 +1,14 @@
 package controllers
 
 import (
-	"context"
+	"errors"
 	"net/http"
-	"time"
 
-	"github.com/KevinChaves65/Project_Boo/config"
+	"github.com/KevinChaves65/Project_Boo/middlewares"
 	"github.com/KevinChaves65/Project_Boo/models"
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // SaveSuggestionRequest represents the request body for saving a suggestion
@@ -27,18 +26,8 @@ type SaveSuggestionRequest struct {
 
 // SaveSuggestion saves a date suggestion for a couple
 func SaveSuggestion(c *gin.Context) {
-	// Get couple ID from context (you'll need to set this in your auth middleware)
-	coupleIDStr, exists := c.Get("couple_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Couple not authenticated"})
-		return
-	}
-
-	coupleID, err := primitive.ObjectIDFromHex(coupleIDStr.(string))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid couple ID"})
-		return
-	}
+	// Couple ID is resolved by the auth middleware; RequireCouple guarantees it is set
+	coupleID := *middlewares.CurrentPrincipal(c).CoupleID
 
 	var req SaveSuggestionRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -46,26 +35,7 @@ func SaveSuggestion(c *gin.Context) {
 		return
 	}
 
-	db := config.GetDB()
-	collection := db.Collection("saved_suggestions")
-
-	// Check if suggestion already exists for this couple
-	filter := bson.M{
-		"couple_id": coupleID,
-		"title":     req.Title,
-	}
-
-	var existingSuggestion models.SavedSuggestion
-	err = collection.FindOne(context.TODO(), filter).Decode(&existingSuggestion)
-	if err == nil {
-		c.JSON(http.StatusConflict, gin.H{"error": "Suggestion already saved"})
-		return
-	}
-
-	// Create new saved suggestion
-	now := time.Now()
-	savedSuggestion := models.SavedSuggestion{
-		ID:            primitive.NewObjectID(),
+	savedSuggestion, err := models.SaveSuggestion(models.SavedSuggestion{
 		CoupleID:      coupleID,
 		Title:         req.Title,
 		Description:   req.Description,
@@ -76,12 +46,11 @@ func SaveSuggestion(c *gin.Context) {
 		MapURL:        req.MapURL,
 		ImageURL:      req.ImageURL,
 		IsAIGenerated: req.IsAIGenerated,
-		SavedAt:       now,
-		CreatedAt:     now,
-		UpdatedAt:     now,
+	})
+	if errors.Is(err, models.ErrSuggestionAlreadySaved) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Suggestion already saved"})
+		return
 	}
-
-	_, err = collection.InsertOne(context.TODO(), savedSuggestion)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save suggestion"})
 		return
@@ -95,34 +64,13 @@ func SaveSuggestion(c *gin.Context) {
 
 // GetSavedSuggestions retrieves all saved suggestions for a couple
 func GetSavedSuggestions(c *gin.Context) {
-	coupleIDStr, exists := c.Get("couple_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Couple not authenticated"})
-		return
-	}
+	coupleID := *middlewares.CurrentPrincipal(c).CoupleID
 
-	coupleID, err := primitive.ObjectIDFromHex(coupleIDStr.(string))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid couple ID"})
-		return
-	}
-
-	db := config.GetDB()
-	collection := db.Collection("saved_suggestions")
-
-	filter := bson.M{"couple_id": coupleID}
-	cursor, err := collection.Find(context.TODO(), filter)
+	savedSuggestions, err := models.GetSavedSuggestions(coupleID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve saved suggestions"})
 		return
 	}
-	defer cursor.Close(context.TODO())
-
-	var savedSuggestions []models.SavedSuggestion
-	if err = cursor.All(context.TODO(), &savedSuggestions); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode saved suggestions"})
-		return
-	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"suggestions": savedSuggestions,
@@ -132,17 +80,7 @@ func GetSavedSuggestions(c *gin.Context) {
 
 // DeleteSavedSuggestion removes a saved suggestion
 func DeleteSavedSuggestion(c *gin.Context) {
-	coupleIDStr, exists := c.Get("couple_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Couple not authenticated"})
-		return
-	}
-
-	coupleID, err := primitive.ObjectIDFromHex(coupleIDStr.(string))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid couple ID"})
-		return
-	}
+	coupleID := *middlewares.CurrentPrincipal(c).CoupleID
 
 	suggestionIDStr := c.Param("id")
 	suggestionID, err := primitive.ObjectIDFromHex(suggestionIDStr)
@@ -151,41 +89,21 @@ func DeleteSavedSuggestion(c *gin.Context) {
 		return
 	}
 
-	db := config.GetDB()
-	collection := db.Collection("saved_suggestions")
-
-	filter := bson.M{
-		"_id":       suggestionID,
-		"couple_id": coupleID,
-	}
-
-	result, err := collection.DeleteOne(context.TODO(), filter)
-	if err != nil {
+	if err := models.DeleteSavedSuggestion(coupleID, suggestionID); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Suggestion not found"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete suggestion"})
 		return
 	}
 
-	if result.DeletedCount == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Suggestion not found"})
-		return
-	}
-
 	c.JSON(http.StatusOK, gin.H{"message": "Suggestion deleted successfully"})
 }
 
 // CheckIfSaved checks if a suggestion is already saved
 func CheckIfSaved(c *gin.Context) {
-	coupleIDStr, exists := c.Get("couple_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Couple not authenticated"})
-		return
-	}
-
-	coupleID, err := primitive.ObjectIDFromHex(coupleIDStr.(string))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid couple ID"})
-		return
-	}
+	coupleID := *middlewares.CurrentPrincipal(c).CoupleID
 
 	title := c.Query("title")
 	if title == "" {
@@ -193,16 +111,7 @@ func CheckIfSaved(c *gin.Context) {
 		return
 	}
 
-	db := config.GetDB()
-	collection := db.Collection("saved_suggestions")
-
-	filter := bson.M{
-		"couple_id": coupleID,
-		"title":     title,
-	}
-
-	var savedSuggestion models.SavedSuggestion
-	err = collection.FindOne(context.TODO(), filter).Decode(&savedSuggestion)
+	savedSuggestion, err := models.FindSavedSuggestion(coupleID, title)
 
 	isSaved := err == nil
 	var suggestionID string
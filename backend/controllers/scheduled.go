@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/KevinChaves65/Project_Boo/services"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ScheduleMessage queues a message to the partner for later delivery.
+// send_at is either RFC 3339 or a local time read in timezone.
+func ScheduleMessage(c *gin.Context) {
+	var request struct {
+		Content  string `json:"content" binding:"required"`
+		SendAt   string `json:"send_at" binding:"required"`
+		Timezone string `json:"timezone"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	scheduled, err := services.ScheduleMessage(middlewares.CurrentPrincipal(c), request.Content, request.SendAt, request.Timezone)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrEmptyMessage),
+			errors.Is(err, services.ErrMessageTooLong),
+			errors.Is(err, services.ErrInvalidTimezone),
+			errors.Is(err, services.ErrInvalidSendAt),
+			errors.Is(err, services.ErrSendAtInPast),
+			errors.Is(err, services.ErrSendAtTooFar):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrE2EUnavailable), errors.Is(err, services.ErrTooManyScheduled):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to schedule message"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, scheduled)
+}
+
+// GetScheduledMessages lists the caller's messages waiting to be sent, and those that failed
+func GetScheduledMessages(c *gin.Context) {
+	scheduled, err := services.ListScheduledMessages(middlewares.CurrentPrincipal(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve scheduled messages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"scheduled_messages": scheduled})
+}
+
+// CancelScheduledMessage cancels one of the caller's pending messages or clears a failed one
+func CancelScheduledMessage(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scheduled message ID"})
+		return
+	}
+
+	if err := models.CancelScheduledMessage(id, middlewares.CurrentPrincipal(c).UserID); err != nil {
+		switch {
+		case errors.Is(err, models.ErrScheduledMessageNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Scheduled message not found"})
+		case errors.Is(err, models.ErrScheduledMessageSending), errors.Is(err, models.ErrScheduledMessageNotPending):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel scheduled message"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Scheduled message cancelled successfully"})
+}
@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/KevinChaves65/Project_Boo/services"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+)
+
+// parseSearchDate accepts a date (YYYY-MM-DD, UTC) or an RFC 3339 time. With
+// endOfDay a bare date covers the whole day.
+func parseSearchDate(value string, endOfDay bool) (*int64, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		unix := t.Unix()
+		return &unix, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return nil, err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Second)
+	}
+	unix := t.Unix()
+	return &unix, nil
+}
+
+// SearchMessages searches the caller's couple chat. q supports "quoted
+// phrases" and prefix* words; from and to limit the dates, and before
+// continues from the next_before of an earlier page.
+func SearchMessages(c *gin.Context) {
+	query, err := services.ParseSearchQuery(c.Query("q"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filter := models.SearchFilter{Limit: defaultSearchLimit}
+	if from := c.Query("from"); from != "" {
+		if filter.From, err = parseSearchDate(from, false); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date"})
+			return
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		if filter.To, err = parseSearchDate(to, true); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date"})
+			return
+		}
+	}
+	if before := c.Query("before"); before != "" {
+		id, err := primitive.ObjectIDFromHex(before)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid before cursor"})
+			return
+		}
+		filter.Before = &id
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		filter.Limit = min(n, maxSearchLimit)
+	}
+
+	results, err := services.SearchMessages(*middlewares.CurrentPrincipal(c).CoupleID, query, filter)
+	if err != nil {
+		if errors.Is(err, services.ErrE2EUnavailable) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search messages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, results)
+}
@@ -1,11 +1,14 @@
 package controllers
 
 import (
+	"errors"
 	"net/http"
 
+	"github.com/KevinChaves65/Project_Boo/middlewares"
 	"github.com/KevinChaves65/Project_Boo/models"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // GetWordThemesHandler returns all available word themes
@@ -36,9 +39,14 @@ func AddWordToBankHandler(c *gin.Context) {
 		return
 	}
 
+	coupleID, ok := middlewares.AuthorizeCouple(c, body.CoupleID)
+	if !ok {
+		return
+	}
+
 	wordBank := models.WordBank{
 		ID:       uuid.New().String(),
-		CoupleID: body.CoupleID,
+		CoupleID: coupleID.Hex(),
 		WordName: body.WordName,
 		ThemeID:  body.ThemeID,
 	}
@@ -53,13 +61,13 @@ func AddWordToBankHandler(c *gin.Context) {
 
 // GetWordBankHandler retrieves all words for a couple
 func GetWordBankHandler(c *gin.Context) {
-	coupleID := c.Query("couple_id")
-	if coupleID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing couple_id"})
+	// Defaults to the caller's couple when couple_id is omitted
+	coupleID, ok := middlewares.AuthorizeCouple(c, c.Query("couple_id"))
+	if !ok {
 		return
 	}
 
-	wordBank, err := models.GetWordBankByCoupleID(coupleID)
+	wordBank, err := models.GetWordBankByCoupleID(coupleID.Hex())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve word bank"})
 		return
@@ -81,7 +89,16 @@ func UpdateWordThemeHandler(c *gin.Context) {
 		return
 	}
 
-	if err := models.UpdateWordTheme(body.CoupleID, body.WordID, body.NewThemeID); err != nil {
+	coupleID, ok := middlewares.AuthorizeCouple(c, body.CoupleID)
+	if !ok {
+		return
+	}
+
+	if err := models.UpdateWordTheme(coupleID.Hex(), body.WordID, body.NewThemeID); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Word not found"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update word theme"})
 		return
 	}
@@ -91,15 +108,22 @@ func UpdateWordThemeHandler(c *gin.Context) {
 
 // DeleteWordFromBankHandler removes a word from couple's word bank
 func DeleteWordFromBankHandler(c *gin.Context) {
-	coupleID := c.Query("couple_id")
 	wordID := c.Query("word_id")
+	if wordID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing word_id"})
+		return
+	}
 
-	if coupleID == "" || wordID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing couple_id or word_id"})
+	coupleID, ok := middlewares.AuthorizeCouple(c, c.Query("couple_id"))
+	if !ok {
 		return
 	}
 
-	if err := models.DeleteWordFromBank(coupleID, wordID); err != nil {
+	if err := models.DeleteWordFromBank(coupleID.Hex(), wordID); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Word not found"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete word"})
 		return
 	}
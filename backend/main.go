@@ -4,12 +4,15 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/KevinChaves65/Project_Boo/config"
 	"github.com/KevinChaves65/Project_Boo/controllers"
 	"github.com/KevinChaves65/Project_Boo/middlewares"
 	"github.com/KevinChaves65/Project_Boo/models"
 	"github.com/KevinChaves65/Project_Boo/services"
+	"github.com/KevinChaves65/Project_Boo/storage"
+	"github.com/KevinChaves65/Project_Boo/utils"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -21,37 +24,52 @@ func main() {
 		godotenv.Load()
 	}
 
+	if err := utils.CheckSearchIndexKey(); err != nil {
+		log.Fatalf("❌ Search index error: %v", err)
+	}
+
 	config.ConnectDB()
+	storage.ConnectBlobStore()
+
+	if err := models.RepairCoupleLinks(); err != nil {
+		log.Printf("Failed to repair couple links: %v", err)
+	}
+
+	if err := models.BackfillMessageCoupleIDs(); err != nil {
+		log.Printf("Failed to backfill message couple IDs: %v", err)
+	}
+
+	if err := models.BackfillMessageUserIDs(); err != nil {
+		log.Printf("Failed to backfill message user IDs: %v", err)
+	}
+
+	if err := models.RemoveDuplicateSavedSuggestions(); err != nil {
+		log.Printf("Failed to remove duplicate saved suggestions: %v", err)
+	}
+
+	if err := models.EnsureIndexes(); err != nil {
+		log.Printf("Failed to ensure indexes: %v", err)
+	}
 
 	if err := models.InitializeDefaultThemes(); err != nil {
 		log.Printf("Failed to initialize default themes: %v", err)
 	}
+	services.ConnectBackplane()
+	services.ConnectEntityChanges()
 	go services.HandleMessages()
+	go services.RunUnlinkFinalizer(time.Minute)
+	go services.BackfillSearchIndex()
+	go services.RunMessageReencryption(5 * time.Minute)
+	go services.RunScheduledMessages()
+	go services.RunMessageExpiry(30 * time.Second)
+	go services.RunAttachmentCleanup(time.Hour)
 
 	r := gin.Default()
 
 	r.Use(cors.New(cors.Config{
-		AllowOriginFunc: func(origin string) bool {
-			
-        	if origin == "" || origin == "null" {
-            return true
-        	}
-			if origin == "http://localhost:5173" {
-				return true
-			}
-			if len(origin) > 16 && origin[:16] == "chrome-extension" {
-				return true
-			}
-			if len(origin) > 13 && origin[:13] == "moz-extension" {
-				return true
-			}
-			if origin == "https://heyboo.ca" {
-				return true
-			}
-			return false
-		},
+		AllowOriginFunc:  config.IsAllowedOrigin,
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Content-Type", "Authorization", "Origin", "Accept"},
+		AllowHeaders:     []string{"Content-Type", "Authorization", "Origin", "Accept", "Last-Event-ID"},
 		AllowCredentials: true,
 		MaxAge:           12 * 60 * 60,
 	}))
@@ -76,22 +94,72 @@ func main() {
 
 	r.POST("/register", controllers.Register)
 	r.POST("/login", controllers.Login)
+	r.POST("/refresh", controllers.RefreshToken)
 	r.GET("/user/public", controllers.GetPublicUserInfo)
 	r.GET("/ws", gin.WrapF(controllers.ChatHandler))
+	// EventSource cannot send headers, so the stream also accepts a ticket
+	r.GET("/auth/chat/events", middlewares.StreamAuthMiddleware(), middlewares.RequireCouple(), controllers.ChatEventsHandler)
+
+	// Attachment downloads are authorized by their signed link
+	r.GET("/attachments/:id", controllers.DownloadAttachment)
+	r.GET("/attachments/:id/thumbnail", controllers.DownloadAttachment)
 
 	auth := r.Group("/auth")
 	auth.Use(middlewares.JWTAuthMiddleware())
 	auth.GET("/profile", controllers.Profile)
 	auth.PUT("/profile", controllers.UpdateProfile)
 	auth.PUT("/password", controllers.ChangePassword)
+	auth.POST("/logout", controllers.Logout)
+	auth.POST("/logout-all", controllers.LogoutAll)
+	auth.GET("/sessions", controllers.GetSessions)
+	auth.DELETE("/sessions/:id", controllers.RevokeSession)
 
 	auth.POST("/chat/send", controllers.SendMessage)
 	auth.GET("/chat/receive", controllers.ReceiveMessages)
-
-	auth.POST("/couple/link", controllers.LinkCouple)
+	auth.POST("/chat/events/ticket", middlewares.RequireCouple(), controllers.CreateEventStreamTicket)
+	auth.POST("/chat/read", controllers.MarkMessagesRead)
+	auth.GET("/chat/unread-count", controllers.GetUnreadCount)
+	auth.PUT("/chat/messages/:id", controllers.EditMessage)
+	auth.DELETE("/chat/messages/:id", controllers.UnsendMessage)
+	auth.GET("/chat/messages/:id/history", controllers.GetMessageHistory)
+	auth.POST("/chat/messages/:id/reactions", controllers.AddReaction)
+	auth.DELETE("/chat/messages/:id/reactions/:emoji", controllers.RemoveReaction)
+	auth.POST("/chat/attachments", middlewares.RequireCouple(), controllers.UploadAttachment)
+	auth.GET("/chat/attachments/:id", middlewares.RequireCouple(), controllers.GetAttachment)
+	auth.GET("/chat/search", middlewares.RequireCouple(), controllers.SearchMessages)
+	auth.POST("/chat/scheduled", middlewares.RequireCouple(), controllers.ScheduleMessage)
+	auth.GET("/chat/scheduled", controllers.GetScheduledMessages)
+	auth.DELETE("/chat/scheduled/:id", controllers.CancelScheduledMessage)
+
+	// End-to-end encryption key directory
+	auth.GET("/keys/devices", controllers.GetDeviceKeys)
+	auth.PUT("/keys/devices/:device_id", controllers.PublishDeviceKey)
+	auth.DELETE("/keys/devices/:device_id", controllers.DeleteDeviceKey)
+	auth.GET("/keys/partner", middlewares.RequireCouple(), controllers.GetPartnerKeys)
+
+	auth.GET("/presence/partner", middlewares.RequireCouple(), controllers.GetPartnerPresence)
+	auth.PUT("/presence/privacy", controllers.SetPresencePrivacy)
+
+	auth.POST("/pairing/invites", controllers.CreatePairingInvite)
+	auth.GET("/pairing/invites", controllers.GetPairingInvites)
+	auth.GET("/pairing/invites/:code", controllers.PreviewPairingInvite)
+	auth.POST("/pairing/invites/:code/accept", controllers.AcceptPairingInvite)
+	auth.POST("/pairing/invites/:code/decline", controllers.DeclinePairingInvite)
+	auth.DELETE("/pairing/invites/:code", controllers.CancelPairingInvite)
+
+	auth.POST("/couple/unlink", controllers.UnlinkCouple)
+	auth.POST("/couple/unlink/cancel", controllers.CancelUnlinkCouple)
+	auth.GET("/couple/export", controllers.ExportCouple)
+	auth.GET("/couple/e2e", middlewares.RequireCouple(), controllers.GetE2EStatus)
+	auth.PUT("/couple/e2e", middlewares.RequireCouple(), controllers.SetE2E)
+	auth.GET("/couple/expiry", middlewares.RequireCouple(), controllers.GetMessageExpiry)
+	auth.PUT("/couple/expiry", middlewares.RequireCouple(), controllers.SetMessageExpiry)
 	auth.GET("/couple/:id", controllers.GetCouple)
 	auth.DELETE("/couple/:id", controllers.DeleteCouple)
 
+	auth.GET("/notifications", controllers.GetNotifications)
+	auth.PUT("/notifications/:id/read", controllers.MarkNotificationRead)
+
 	auth.POST("/milestones", controllers.AddMilestone)
 	auth.GET("/milestones", controllers.GetMilestones)
 	auth.PUT("/milestones/:id", controllers.UpdateMilestone)
@@ -102,10 +170,10 @@ func main() {
 
 	auth.POST("/dateideas/generate", controllers.GenerateDateIdeas)
 
-	auth.POST("/saved-suggestions", controllers.SaveSuggestion)
-	auth.GET("/saved-suggestions", controllers.GetSavedSuggestions)
-	auth.DELETE("/saved-suggestions/:id", controllers.DeleteSavedSuggestion)
-	auth.GET("/saved-suggestions/check", controllers.CheckIfSaved)
+	auth.POST("/saved-suggestions", middlewares.RequireCouple(), controllers.SaveSuggestion)
+	auth.GET("/saved-suggestions", middlewares.RequireCouple(), controllers.GetSavedSuggestions)
+	auth.DELETE("/saved-suggestions/:id", middlewares.RequireCouple(), controllers.DeleteSavedSuggestion)
+	auth.GET("/saved-suggestions/check", middlewares.RequireCouple(), controllers.CheckIfSaved)
 
 	auth.GET("/word-themes", controllers.GetWordThemesHandler)
 	auth.POST("/word-bank", controllers.AddWordToBankHandler)
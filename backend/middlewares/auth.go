@@ -1,12 +1,75 @@
 package middlewares
 
 import (
+	"errors"
 	"net/http"
+	"time"
 
+	"github.com/KevinChaves65/Project_Boo/models"
 	"github.com/KevinChaves65/Project_Boo/utils"
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
+var (
+	ErrInvalidToken   = errors.New("invalid or expired token")
+	ErrSessionRevoked = errors.New("session has been revoked")
+	ErrUserNotFound   = errors.New("user not found")
+)
+
+// Authenticate validates an access token, checks that its session is still
+// active and resolves the caller's principal
+func Authenticate(token string) (*Principal, error) {
+	parsedToken, err := utils.ParseToken(token)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	// Extract claims from the token
+	claims, ok := parsedToken.Claims.(*utils.Claims)
+	if !ok || !parsedToken.Valid {
+		return nil, ErrInvalidToken
+	}
+
+	// Reject tokens whose session was logged out or revoked
+	sessionID, err := primitive.ObjectIDFromHex(claims.SessionID)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	principal, err := resolveSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	principal.ExpiresAt = time.Unix(claims.ExpiresAt, 0)
+	return principal, nil
+}
+
+// resolveSession resolves the principal of an active session. Only a missing
+// session or user rejects the credentials; a failed lookup is returned as is.
+func resolveSession(sessionID primitive.ObjectID) (*Principal, error) {
+	session, err := models.GetActiveSession(sessionID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrSessionRevoked
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	principal, err := ResolvePrincipal(session)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrUserNotFound
+	}
+	return principal, err
+}
+
+// IsUnauthenticated reports whether an error of Authenticate rejects the
+// credentials, rather than the lookup failing
+func IsUnauthenticated(err error) bool {
+	return errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrSessionRevoked) ||
+		errors.Is(err, ErrUserNotFound) || errors.Is(err, ErrInvalidTicket)
+}
+
 func JWTAuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token := c.GetHeader("Authorization")
@@ -24,23 +87,35 @@ func JWTAuthMiddleware() gin.HandlerFunc {
 		}
 
 		token = token[7:] // Remove "Bearer " prefix
-		parsedToken, err := utils.ParseToken(token)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
-			c.Abort()
-			return
-		}
 
-		// Extract claims from the token
-		claims, ok := parsedToken.Claims.(*utils.Claims)
-		if !ok || !parsedToken.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
-			c.Abort()
+		// Resolve the caller's user and couple once for the whole request
+		principal, err := Authenticate(token)
+		if err != nil {
+			abortUnauthenticated(c, err)
 			return
 		}
 
-		// Store the username in the context
-		c.Set("user", claims.Username)
+		// Store the principal and username in the context
+		SetPrincipal(c, principal)
+		c.Set("user", principal.Username)
 		c.Next()
 	}
 }
+
+// abortUnauthenticated rejects a request whose credentials failed to
+// authenticate. Only rejected credentials are answered with 401.
+func abortUnauthenticated(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrSessionRevoked):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked"})
+	case errors.Is(err, ErrUserNotFound):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+	case errors.Is(err, ErrInvalidTicket):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired ticket"})
+	case errors.Is(err, ErrInvalidToken):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+	}
+	c.Abort()
+}
@@ -0,0 +1,78 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"github.com/KevinChaves65/Project_Boo/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// getProfile requests a JWT protected route with the given access token
+func getProfile(token string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/profile", JWTAuthMiddleware(), func(c *gin.Context) { c.Status(http.StatusOK) })
+	req := httptest.NewRequest(http.MethodGet, "/profile", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestJWTAuthOnlyRejectsMissingUsers(t *testing.T) {
+	t.Setenv("JWT_SECRET_KEY", "test-secret")
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	userID, sessionID := primitive.NewObjectID(), primitive.NewObjectID()
+	token, err := utils.GenerateToken("alice", sessionID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := bson.D{{Key: "_id", Value: sessionID}, {Key: "user_id", Value: userID}}
+	lookupFailed := mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 2, Message: "lookup failed"})
+
+	mt.Run("deleted user", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "db.sessions", mtest.FirstBatch, session),
+			mtest.CreateCursorResponse(0, "db.users", mtest.FirstBatch),
+		)
+		if w := getProfile(token); w.Code != http.StatusUnauthorized {
+			mt.Fatalf("got %d, want 401", w.Code)
+		}
+	})
+
+	mt.Run("user lookup fails", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.sessions", mtest.FirstBatch, session), lookupFailed)
+		if w := getProfile(token); w.Code != http.StatusInternalServerError {
+			mt.Fatalf("got %d, want 500", w.Code)
+		}
+	})
+
+	mt.Run("couple lookup fails", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "db.sessions", mtest.FirstBatch, session),
+			mtest.CreateCursorResponse(0, "db.users", mtest.FirstBatch, bson.D{{Key: "_id", Value: userID}, {Key: "username", Value: "alice"}}),
+			lookupFailed,
+		)
+		if w := getProfile(token); w.Code != http.StatusInternalServerError {
+			mt.Fatalf("got %d, want 500", w.Code)
+		}
+	})
+
+	mt.Run("session lookup fails", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(lookupFailed)
+		if w := getProfile(token); w.Code != http.StatusInternalServerError {
+			mt.Fatalf("got %d, want 500", w.Code)
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package middlewares
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AuthorizeCouple checks that the caller belongs to the couple with the given
+// hex ID and writes the error response when not. An empty ID falls back to the
+// caller's own couple. Unknown couples get 404, other couples get 403.
+func AuthorizeCouple(c *gin.Context, coupleIDHex string) (primitive.ObjectID, bool) {
+	principal := CurrentPrincipal(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return primitive.NilObjectID, false
+	}
+
+	if coupleIDHex == "" {
+		if !principal.HasCouple() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You are not linked with a partner"})
+			return primitive.NilObjectID, false
+		}
+		return *principal.CoupleID, true
+	}
+
+	coupleID, err := primitive.ObjectIDFromHex(coupleIDHex)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid couple ID"})
+		return primitive.NilObjectID, false
+	}
+
+	// The principal's couple was loaded for this request, so no lookup is needed
+	if principal.HasCouple() && *principal.CoupleID == coupleID {
+		return coupleID, true
+	}
+
+	if _, err := models.AuthorizeCoupleMember(coupleID, principal.UserID); err != nil {
+		switch {
+		case errors.Is(err, models.ErrCoupleNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Couple not found"})
+		case errors.Is(err, models.ErrNotCoupleMember):
+			c.JSON(http.StatusForbidden, gin.H{"error": "You do not have access to this couple"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify couple membership"})
+		}
+		return primitive.NilObjectID, false
+	}
+	return coupleID, true
+}
@@ -0,0 +1,82 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// authorizeRequest runs AuthorizeCouple for the principal on the given couple ID
+func authorizeRequest(principal *Principal, coupleIDHex string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", func(c *gin.Context) {
+		SetPrincipal(c, principal)
+		if _, ok := AuthorizeCouple(c, coupleIDHex); ok {
+			c.Status(http.StatusOK)
+		}
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	return w
+}
+
+func TestAuthorizeCouple(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	userID := primitive.NewObjectID()
+	ownCouple := primitive.NewObjectID()
+	principal := &Principal{UserID: userID, Username: "alice", CoupleID: &ownCouple}
+
+	mt.Run("own couple", func(mt *mtest.T) {
+		if w := authorizeRequest(principal, ownCouple.Hex()); w.Code != http.StatusOK {
+			mt.Fatalf("got %d, want 200", w.Code)
+		}
+	})
+
+	mt.Run("empty ID falls back to own couple", func(mt *mtest.T) {
+		if w := authorizeRequest(principal, ""); w.Code != http.StatusOK {
+			mt.Fatalf("got %d, want 200", w.Code)
+		}
+	})
+
+	mt.Run("malformed ID", func(mt *mtest.T) {
+		if w := authorizeRequest(principal, "not-a-hex-id"); w.Code != http.StatusBadRequest {
+			mt.Fatalf("got %d, want 400", w.Code)
+		}
+	})
+
+	mt.Run("another couple", func(mt *mtest.T) {
+		config.DB = mt.DB
+		other := primitive.NewObjectID()
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.couples", mtest.FirstBatch, bson.D{
+			{Key: "_id", Value: other},
+			{Key: "user1_id", Value: primitive.NewObjectID()},
+			{Key: "user2_id", Value: primitive.NewObjectID()},
+		}))
+		if w := authorizeRequest(principal, other.Hex()); w.Code != http.StatusForbidden {
+			mt.Fatalf("got %d, want 403", w.Code)
+		}
+	})
+
+	mt.Run("unknown couple", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.couples", mtest.FirstBatch))
+		if w := authorizeRequest(principal, primitive.NewObjectID().Hex()); w.Code != http.StatusNotFound {
+			mt.Fatalf("got %d, want 404", w.Code)
+		}
+	})
+
+	mt.Run("caller without a couple", func(mt *mtest.T) {
+		single := &Principal{UserID: primitive.NewObjectID(), Username: "bob"}
+		if w := authorizeRequest(single, ""); w.Code != http.StatusForbidden {
+			mt.Fatalf("got %d, want 403", w.Code)
+		}
+	})
+}
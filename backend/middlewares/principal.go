@@ -0,0 +1,89 @@
+package middlewares
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const principalKey = "principal"
+
+// Principal is the authenticated caller of a request. It is resolved from the
+// database on every request, so linking or unlinking a partner takes effect
+// without logging in again.
+type Principal struct {
+	UserID    primitive.ObjectID
+	Username  string
+	SessionID primitive.ObjectID
+	CoupleID  *primitive.ObjectID
+	PartnerID *primitive.ObjectID
+	ExpiresAt time.Time // Expiry of the access token the principal was resolved from
+}
+
+// HasCouple reports whether the caller is currently linked with a partner
+func (p *Principal) HasCouple() bool {
+	return p.CoupleID != nil
+}
+
+// ResolvePrincipal loads the caller's user and current couple for a session
+func ResolvePrincipal(session models.Session) (*Principal, error) {
+	user, err := models.GetUserByID(session.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	principal := &Principal{
+		UserID:    user.ID,
+		Username:  user.Username,
+		SessionID: session.ID,
+	}
+
+	couple, err := models.GetCoupleByUserID(user.ID)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return principal, nil
+		}
+		return nil, err
+	}
+
+	partnerID := couple.User1ID
+	if partnerID == user.ID {
+		partnerID = couple.User2ID
+	}
+	principal.CoupleID = &couple.ID
+	principal.PartnerID = &partnerID
+	return principal, nil
+}
+
+// SetPrincipal records the authenticated caller of the request
+func SetPrincipal(c *gin.Context, principal *Principal) {
+	c.Set(principalKey, principal)
+}
+
+// CurrentPrincipal returns the principal set by JWTAuthMiddleware, or nil
+func CurrentPrincipal(c *gin.Context) *Principal {
+	value, exists := c.Get(principalKey)
+	if !exists {
+		return nil
+	}
+	principal, _ := value.(*Principal)
+	return principal
+}
+
+// RequireCouple rejects callers that are not linked with a partner
+func RequireCouple() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := CurrentPrincipal(c)
+		if principal == nil || !principal.HasCouple() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You are not linked with a partner"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
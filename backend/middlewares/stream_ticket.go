@@ -0,0 +1,81 @@
+package middlewares
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// streamTicketTTL is how long a ticket for the event stream stays valid. The
+// stream ends when it expires and the client opens a new one with a fresh
+// ticket, resuming from the last event it saw.
+const streamTicketTTL = 15 * time.Minute
+
+var ErrInvalidTicket = errors.New("invalid or expired ticket")
+
+// streamTicketResource is what a ticket signs, so it cannot stand in for any
+// other signed link
+func streamTicketResource(sessionID string) string {
+	return "event-stream:" + sessionID
+}
+
+// IssueStreamTicket creates a ticket that opens the caller's event stream,
+// for browsers whose EventSource cannot send an Authorization header. It is
+// tied to the session, so revoking the session revokes it too.
+func IssueStreamTicket(principal *Principal) (string, time.Time) {
+	expires := time.Now().Add(streamTicketTTL)
+	sessionID := principal.SessionID.Hex()
+	signature := utils.SignResource(streamTicketResource(sessionID), expires)
+	return sessionID + "." + strconv.FormatInt(expires.Unix(), 10) + "." + signature, expires
+}
+
+// authenticateStreamTicket checks a ticket made by IssueStreamTicket and
+// resolves the caller's principal
+func authenticateStreamTicket(ticket string) (*Principal, error) {
+	parts := strings.Split(ticket, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidTicket
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || !utils.VerifyResourceSignature(streamTicketResource(parts[0]), expires, parts[2]) {
+		return nil, ErrInvalidTicket
+	}
+	sessionID, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil {
+		return nil, ErrInvalidTicket
+	}
+
+	principal, err := resolveSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	principal.ExpiresAt = time.Unix(expires, 0)
+	return principal, nil
+}
+
+// StreamAuthMiddleware authenticates the event stream by the Authorization
+// header, or by a ticket from IssueStreamTicket in the ticket query parameter
+func StreamAuthMiddleware() gin.HandlerFunc {
+	jwtAuth := JWTAuthMiddleware()
+	return func(c *gin.Context) {
+		ticket := c.Query("ticket")
+		if ticket == "" {
+			jwtAuth(c)
+			return
+		}
+
+		principal, err := authenticateStreamTicket(ticket)
+		if err != nil {
+			abortUnauthenticated(c, err)
+			return
+		}
+		SetPrincipal(c, principal)
+		c.Set("user", principal.Username)
+		c.Next()
+	}
+}
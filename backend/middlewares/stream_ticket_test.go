@@ -0,0 +1,89 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"github.com/KevinChaves65/Project_Boo/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// openStream requests the event stream route with the given query
+func openStream(query string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/events", StreamAuthMiddleware(), func(c *gin.Context) {
+		c.String(http.StatusOK, CurrentPrincipal(c).Username)
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/events?"+query, nil))
+	return w
+}
+
+func TestStreamTicket(t *testing.T) {
+	t.Setenv("JWT_SECRET_KEY", "test-secret")
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	userID, sessionID := primitive.NewObjectID(), primitive.NewObjectID()
+	principal := &Principal{UserID: userID, Username: "alice", SessionID: sessionID}
+
+	mt.Run("valid ticket", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "db.sessions", mtest.FirstBatch, bson.D{{Key: "_id", Value: sessionID}, {Key: "user_id", Value: userID}}),
+			mtest.CreateCursorResponse(0, "db.users", mtest.FirstBatch, bson.D{{Key: "_id", Value: userID}, {Key: "username", Value: "alice"}}),
+			mtest.CreateCursorResponse(0, "db.couples", mtest.FirstBatch),
+		)
+		ticket, _ := IssueStreamTicket(principal)
+		w := openStream("ticket=" + ticket)
+		if w.Code != http.StatusOK || w.Body.String() != "alice" {
+			mt.Fatalf("got %d %q, want 200 alice", w.Code, w.Body)
+		}
+	})
+
+	mt.Run("revoked session", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.sessions", mtest.FirstBatch))
+		ticket, _ := IssueStreamTicket(principal)
+		if w := openStream("ticket=" + ticket); w.Code != http.StatusUnauthorized {
+			mt.Fatalf("got %d, want 401", w.Code)
+		}
+	})
+
+	mt.Run("tampered or expired ticket", func(mt *mtest.T) {
+		ticket, _ := IssueStreamTicket(principal)
+		other := primitive.NewObjectID().Hex() + ticket[strings.Index(ticket, "."):]
+
+		expires := time.Now().Add(-time.Minute)
+		expired := sessionID.Hex() + "." + strconv.FormatInt(expires.Unix(), 10) + "." +
+			utils.SignResource(streamTicketResource(sessionID.Hex()), expires)
+
+		for _, bad := range []string{"nonsense", other, expired} {
+			if w := openStream("ticket=" + bad); w.Code != http.StatusUnauthorized {
+				mt.Fatalf("ticket %q: got %d, want 401", bad, w.Code)
+			}
+		}
+	})
+
+	mt.Run("ticket is not an access token", func(mt *mtest.T) {
+		ticket, _ := IssueStreamTicket(principal)
+		gin.SetMode(gin.TestMode)
+		r := gin.New()
+		r.GET("/profile", JWTAuthMiddleware(), func(c *gin.Context) { c.Status(http.StatusOK) })
+		req := httptest.NewRequest(http.MethodGet, "/profile", nil)
+		req.Header.Set("Authorization", "Bearer "+ticket)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			mt.Fatalf("got %d, want 401", w.Code)
+		}
+	})
+}
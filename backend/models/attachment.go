@@ -0,0 +1,215 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"github.com/KevinChaves65/Project_Boo/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type AttachmentKind string
+
+const (
+	AttachmentImage AttachmentKind = "image"
+	AttachmentVoice AttachmentKind = "voice"
+)
+
+var (
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	ErrAttachmentInUse    = errors.New("attachment is already part of a message")
+)
+
+// Attachment is an uploaded file. The blob itself is encrypted in blob
+// storage under StorageKey; this document only holds its metadata.
+type Attachment struct {
+	ID           primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	CoupleID     primitive.ObjectID  `bson:"couple_id" json:"couple_id"`
+	UploaderID   primitive.ObjectID  `bson:"uploader_id" json:"uploader_id"`
+	MessageID    *primitive.ObjectID `bson:"message_id,omitempty" json:"message_id,omitempty"` // Set once the attachment is sent
+	Kind         AttachmentKind      `bson:"kind" json:"kind"`
+	ContentType  string              `bson:"content_type" json:"content_type"`
+	Size         int64               `bson:"size" json:"size"`
+	Width        int                 `bson:"width,omitempty" json:"width,omitempty"`
+	Height       int                 `bson:"height,omitempty" json:"height,omitempty"`
+	StorageKey   string              `bson:"storage_key" json:"-"`
+	ThumbnailKey string              `bson:"thumbnail_key,omitempty" json:"-"`
+	CreatedAt    time.Time           `bson:"created_at" json:"created_at"`
+
+	// Signed download links, filled in per request
+	URL          string `bson:"-" json:"url,omitempty"`
+	ThumbnailURL string `bson:"-" json:"thumbnail_url,omitempty"`
+}
+
+// CreateAttachment stores the metadata of an uploaded attachment
+func CreateAttachment(attachment Attachment) (Attachment, error) {
+	collection := config.GetDB().Collection("attachments")
+	if attachment.ID.IsZero() {
+		attachment.ID = primitive.NewObjectID()
+	}
+	attachment.CreatedAt = time.Now()
+	_, err := collection.InsertOne(context.TODO(), attachment)
+	return attachment, err
+}
+
+// GetAttachment retrieves an attachment by ID
+func GetAttachment(id primitive.ObjectID) (Attachment, error) {
+	collection := config.GetDB().Collection("attachments")
+	var attachment Attachment
+	err := collection.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&attachment)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return attachment, ErrAttachmentNotFound
+	}
+	return attachment, err
+}
+
+// GetAttachments retrieves the attachments with the given IDs, keyed by ID
+func GetAttachments(ids []primitive.ObjectID) (map[primitive.ObjectID]Attachment, error) {
+	attachments := make(map[primitive.ObjectID]Attachment)
+	if len(ids) == 0 {
+		return attachments, nil
+	}
+
+	collection := config.GetDB().Collection("attachments")
+	cursor, err := collection.Find(context.TODO(), bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	var found []Attachment
+	if err := cursor.All(context.TODO(), &found); err != nil {
+		return nil, err
+	}
+	for _, attachment := range found {
+		attachments[attachment.ID] = attachment
+	}
+	return attachments, nil
+}
+
+// ClaimAttachments ties unsent attachments of the uploader to a message. All
+// of them must belong to the uploader and couple and not be sent yet.
+func ClaimAttachments(ids []primitive.ObjectID, uploaderID, coupleID, messageID primitive.ObjectID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	collection := config.GetDB().Collection("attachments")
+	filter := bson.M{
+		"_id":         bson.M{"$in": ids},
+		"uploader_id": uploaderID,
+		"couple_id":   coupleID,
+		"message_id":  bson.M{"$exists": false},
+	}
+
+	count, err := collection.CountDocuments(context.TODO(), filter)
+	if err != nil {
+		return err
+	}
+	if count != int64(len(ids)) {
+		return ErrAttachmentInUse
+	}
+
+	result, err := collection.UpdateMany(context.TODO(), filter, bson.M{"$set": bson.M{"message_id": messageID}})
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount != int64(len(ids)) {
+		// Another message claimed some of them in between
+		return ErrAttachmentInUse
+	}
+	return nil
+}
+
+// ReleaseAttachments makes the attachments claimed by a message that was never stored sendable again
+func ReleaseAttachments(messageID primitive.ObjectID) error {
+	collection := config.GetDB().Collection("attachments")
+	_, err := collection.UpdateMany(context.TODO(), bson.M{"message_id": messageID}, bson.M{"$unset": bson.M{"message_id": ""}})
+	return err
+}
+
+// GetAttachmentsAfter returns up to limit attachments after the given ID,
+// oldest first, for jobs that walk the whole collection
+func GetAttachmentsAfter(after primitive.ObjectID, limit int) ([]Attachment, error) {
+	collection := config.GetDB().Collection("attachments")
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := collection.Find(context.TODO(), bson.M{"_id": bson.M{"$gt": after}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var attachments []Attachment
+	if err := cursor.All(context.TODO(), &attachments); err != nil {
+		return nil, err
+	}
+	return attachments, nil
+}
+
+// DeleteAttachments removes the attachments matching filter along with their blobs
+func DeleteAttachments(filter bson.M) error {
+	collection := config.GetDB().Collection("attachments")
+	cursor, err := collection.Find(context.TODO(), filter)
+	if err != nil {
+		return err
+	}
+	var attachments []Attachment
+	if err := cursor.All(context.TODO(), &attachments); err != nil {
+		return err
+	}
+
+	blobs := storage.GetBlobs()
+	for _, attachment := range attachments {
+		for _, key := range []string{attachment.StorageKey, attachment.ThumbnailKey} {
+			if key == "" {
+				continue
+			}
+			if err := blobs.Delete(context.TODO(), key); err != nil {
+				log.Printf("Failed to delete blob %s: %v", key, err)
+			}
+		}
+	}
+
+	_, err = collection.DeleteMany(context.TODO(), filter)
+	return err
+}
+
+// DeleteUnclaimedAttachments removes attachments uploaded before the cutoff
+// that were never sent, along with their blobs. An attachment claimed by a
+// message while the sweep runs is kept.
+func DeleteUnclaimedAttachments(before time.Time) (int, error) {
+	collection := config.GetDB().Collection("attachments")
+	unclaimed := bson.M{"message_id": bson.M{"$exists": false}, "created_at": bson.M{"$lt": before}}
+	cursor, err := collection.Find(context.TODO(), unclaimed)
+	if err != nil {
+		return 0, err
+	}
+	var attachments []Attachment
+	if err := cursor.All(context.TODO(), &attachments); err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	blobs := storage.GetBlobs()
+	for _, attachment := range attachments {
+		// The blobs only go once the record is gone for good
+		result, err := collection.DeleteOne(context.TODO(), bson.M{"_id": attachment.ID, "message_id": bson.M{"$exists": false}})
+		if err != nil {
+			return deleted, err
+		}
+		if result.DeletedCount == 0 {
+			continue
+		}
+		deleted++
+		for _, key := range []string{attachment.StorageKey, attachment.ThumbnailKey} {
+			if key == "" {
+				continue
+			}
+			if err := blobs.Delete(context.TODO(), key); err != nil {
+				log.Printf("Failed to delete blob %s: %v", key, err)
+			}
+		}
+	}
+	return deleted, nil
+}
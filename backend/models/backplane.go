@@ -0,0 +1,48 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BackplaneEventTTL is how long relayed chat frames are kept; they are only
+// needed until every instance's change stream has seen them
+const BackplaneEventTTL = time.Hour
+
+// BackplaneEvent is a chat frame relayed between API instances
+type BackplaneEvent struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Origin    string             `bson:"origin"`
+	Payload   string             `bson:"payload"` // Encrypted envelope
+	CreatedAt time.Time          `bson:"created_at"`
+}
+
+// InsertBackplaneEvent stores an encrypted frame for the other instances to
+// pick up
+func InsertBackplaneEvent(origin, payload string) error {
+	collection := config.GetDB().Collection("backplane_events")
+	_, err := collection.InsertOne(context.TODO(), BackplaneEvent{
+		Origin:    origin,
+		Payload:   payload,
+		CreatedAt: time.Now(),
+	})
+	return err
+}
+
+// WatchBackplaneEvents opens a change stream of newly inserted frames,
+// resuming after resumeToken when one is given
+func WatchBackplaneEvents(ctx context.Context, resumeToken bson.Raw) (*mongo.ChangeStream, error) {
+	collection := config.GetDB().Collection("backplane_events")
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{"operationType": "insert"}}}}
+	opts := options.ChangeStream()
+	if resumeToken != nil {
+		opts.SetResumeAfter(resumeToken)
+	}
+	return collection.Watch(ctx, pipeline, opts)
+}
@@ -0,0 +1,281 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"github.com/KevinChaves65/Project_Boo/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type CoupleStatus string
+
+const (
+	CoupleActive    CoupleStatus = "active"
+	CoupleUnlinking CoupleStatus = "unlinking"
+)
+
+// DataPolicy decides what happens to couple-owned data once an unlink is final
+type DataPolicy string
+
+const (
+	// DataPolicyArchive moves couple data to archived_* collections
+	DataPolicyArchive DataPolicy = "archive"
+	// DataPolicyDelete removes couple data for good
+	DataPolicyDelete DataPolicy = "delete"
+)
+
+var (
+	ErrUnlinkPending   = errors.New("an unlink is already pending for this couple")
+	ErrNoUnlinkPending = errors.New("no unlink is pending for this couple")
+	ErrCoolingOffEnded = errors.New("the cooling-off period has already ended")
+)
+
+// CurrentDataPolicy reads COUPLE_DATA_POLICY, defaulting to archive
+func CurrentDataPolicy() DataPolicy {
+	if DataPolicy(os.Getenv("COUPLE_DATA_POLICY")) == DataPolicyDelete {
+		return DataPolicyDelete
+	}
+	return DataPolicyArchive
+}
+
+// IsUnlinking reports whether an unlink was requested and is still in its cooling-off period
+func (c Couple) IsUnlinking() bool {
+	return c.Status == CoupleUnlinking
+}
+
+// RequestUnlink starts unlinking a couple. With a cooling-off period the couple
+// stays linked until PurgeAt so either partner can undo it; without one the
+// unlink is finalized straight away.
+func RequestUnlink(coupleID, requestedBy primitive.ObjectID, coolingOff time.Duration) (Couple, error) {
+	if coolingOff <= 0 {
+		couple, err := GetCoupleByID(coupleID)
+		if err != nil {
+			return couple, err
+		}
+		return couple, FinalizeUnlink(coupleID)
+	}
+
+	collection := config.GetDB().Collection("couples")
+	now := time.Now()
+	update := bson.M{"$set": bson.M{
+		"status":              CoupleUnlinking,
+		"unlink_requested_by": requestedBy,
+		"unlink_requested_at": now,
+		"purge_at":            now.Add(coolingOff),
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var couple Couple
+	err := collection.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"_id": coupleID, "status": bson.M{"$ne": CoupleUnlinking}},
+		update,
+		opts,
+	).Decode(&couple)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return couple, ErrUnlinkPending
+	}
+	if err != nil {
+		return couple, err
+	}
+	publishChange(EntityCouple, EntityUpdated, coupleID, coupleID.Hex(), couple)
+	return couple, nil
+}
+
+// CancelUnlink undoes a pending unlink while the cooling-off period is running
+func CancelUnlink(coupleID primitive.ObjectID) error {
+	collection := config.GetDB().Collection("couples")
+	couple, err := GetCoupleByID(coupleID)
+	if err != nil {
+		return err
+	}
+	if !couple.IsUnlinking() {
+		return ErrNoUnlinkPending
+	}
+
+	result, err := collection.UpdateOne(
+		context.TODO(),
+		bson.M{"_id": coupleID, "status": CoupleUnlinking, "purge_at": bson.M{"$gt": time.Now()}},
+		bson.M{
+			"$set":   bson.M{"status": CoupleActive},
+			"$unset": bson.M{"unlink_requested_by": "", "unlink_requested_at": "", "purge_at": ""},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount == 0 {
+		return ErrCoolingOffEnded
+	}
+	publishCoupleUpdate(coupleID)
+	return nil
+}
+
+// GetDueUnlinks lists couples whose cooling-off period has ended
+func GetDueUnlinks() ([]Couple, error) {
+	collection := config.GetDB().Collection("couples")
+	cursor, err := collection.Find(context.TODO(), bson.M{
+		"status":   CoupleUnlinking,
+		"purge_at": bson.M{"$lte": time.Now()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	var couples []Couple
+	if err := cursor.All(context.TODO(), &couples); err != nil {
+		return nil, err
+	}
+	return couples, nil
+}
+
+// coupleDataFilters returns, per couple-owned collection, the filter selecting the couple's documents
+func coupleDataFilters(couple Couple) map[string]bson.M {
+	return map[string]bson.M{
+		"milestones":         {"couple_id": couple.ID},
+		"saved_suggestions":  {"couple_id": couple.ID},
+		"word_bank":          {"couple_id": couple.ID.Hex()},
+		"message_reactions":  {"couple_id": couple.ID},
+		"attachments":        {"couple_id": couple.ID},
+		"search_tokens":      {"couple_id": couple.ID},
+		"chat_events":        {"couple_id": couple.ID},
+		"scheduled_messages": {"couple_id": couple.ID},
+		"messages": {"$or": []bson.M{
+			{"couple_id": couple.ID},
+			{"sender_id": couple.User1ID, "receiver_id": couple.User2ID},
+			{"sender_id": couple.User2ID, "receiver_id": couple.User1ID},
+		}},
+	}
+}
+
+// FinalizeUnlink applies the data policy to the couple's data and then deletes
+// the couple. Archiving is idempotent, so a finalize interrupted part-way can
+// simply be run again.
+func FinalizeUnlink(coupleID primitive.ObjectID) error {
+	couple, err := GetCoupleByID(coupleID)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrCoupleNotFound
+		}
+		return err
+	}
+
+	filters := coupleDataFilters(couple)
+
+	db := config.GetDB()
+	policy := CurrentDataPolicy()
+	now := time.Now()
+
+	// Archived attachment documents keep pointing at their blobs; deleted ones take them along
+	if policy == DataPolicyDelete {
+		if err := DeleteAttachments(filters["attachments"]); err != nil {
+			return err
+		}
+	}
+
+	for name, filter := range filters {
+		if policy == DataPolicyArchive {
+			cursor, err := db.Collection(name).Aggregate(context.TODO(), mongo.Pipeline{
+				{{Key: "$match", Value: filter}},
+				{{Key: "$set", Value: bson.M{"archived_at": now, "archived_couple_id": couple.ID}}},
+				{{Key: "$merge", Value: bson.M{"into": "archived_" + name, "whenMatched": "replace"}}},
+			})
+			if err != nil {
+				return err
+			}
+			cursor.Close(context.TODO())
+		}
+		if _, err := db.Collection(name).DeleteMany(context.TODO(), filter); err != nil {
+			return err
+		}
+	}
+
+	return DeleteCouple(coupleID)
+}
+
+// CoupleExport is one partner's copy of the data the couple shared
+type CoupleExport struct {
+	ExportedAt       time.Time         `json:"exported_at"`
+	Couple           Couple            `json:"couple"`
+	Milestones       []Milestone       `json:"milestones"`
+	SavedSuggestions []SavedSuggestion `json:"saved_suggestions"`
+	WordBank         []WordBank        `json:"word_bank"`
+	Messages         []Message         `json:"messages"`
+	Reactions        []Reaction        `json:"reactions"`
+	Attachments      []Attachment      `json:"attachments"`
+}
+
+// ExportCoupleData collects the couple's shared data with messages decrypted
+func ExportCoupleData(coupleID primitive.ObjectID) (CoupleExport, error) {
+	export := CoupleExport{ExportedAt: time.Now()}
+
+	couple, err := GetCoupleByID(coupleID)
+	if err != nil {
+		return export, err
+	}
+	export.Couple = couple
+
+	filters := coupleDataFilters(couple)
+
+	targets := map[string]interface{}{
+		"milestones":        &export.Milestones,
+		"saved_suggestions": &export.SavedSuggestions,
+		"word_bank":         &export.WordBank,
+		"messages":          &export.Messages,
+		"message_reactions": &export.Reactions,
+		"attachments":       &export.Attachments,
+	}
+	// Disappearing messages past their expiry are gone even if not swept yet
+	filters["messages"] = excludeExpired(filters["messages"], time.Now())
+	for name, target := range targets {
+		cursor, err := config.GetDB().Collection(name).Find(context.TODO(), filters[name])
+		if err != nil {
+			return export, err
+		}
+		if err := cursor.All(context.TODO(), target); err != nil {
+			return export, err
+		}
+	}
+
+	// Reactions and attachments of those messages go with them
+	exported := make(map[primitive.ObjectID]bool, len(export.Messages))
+	for _, msg := range export.Messages {
+		exported[msg.ID] = true
+	}
+	reactions := export.Reactions[:0]
+	for _, reaction := range export.Reactions {
+		if exported[reaction.MessageID] {
+			reactions = append(reactions, reaction)
+		}
+	}
+	export.Reactions = reactions
+	attachments := export.Attachments[:0]
+	for _, attachment := range export.Attachments {
+		if attachment.MessageID == nil || exported[*attachment.MessageID] {
+			attachments = append(attachments, attachment)
+		}
+	}
+	export.Attachments = attachments
+
+	for i, msg := range export.Messages {
+		if msg.Deleted || msg.E2E {
+			continue
+		}
+		decrypted, err := utils.DecryptMessage(msg.Content)
+		if err != nil {
+			export.Messages[i].Content = "[Failed to decrypt message]"
+			continue
+		}
+		export.Messages[i].Content = decrypted
+	}
+	fillParticipantNames(export.Messages)
+	return export, nil
+}
@@ -0,0 +1,120 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ChatEventTTL is how long a couple's events stay available for resuming a stream
+const ChatEventTTL = 24 * time.Hour
+
+// ChatEvent is one real-time event in a couple's log. Seq numbers increase by
+// one per couple, so a client that saw seq n resumes with everything after n.
+type ChatEvent struct {
+	ID        primitive.ObjectID  `bson:"_id,omitempty"`
+	CoupleID  primitive.ObjectID  `bson:"couple_id"`
+	Seq       int64               `bson:"seq"`
+	MessageID *primitive.ObjectID `bson:"message_id,omitempty"` // The chat message the event is about, if any
+	Payload   string              `bson:"payload"`              // Encrypted frame as sent to clients
+	CreatedAt time.Time           `bson:"created_at"`
+}
+
+// nextChatEventSeq allocates the couple's next event sequence number
+func nextChatEventSeq(coupleID primitive.ObjectID) (int64, error) {
+	collection := config.GetDB().Collection("chat_event_counters")
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := collection.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"_id": coupleID},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	return counter.Seq, err
+}
+
+// GetChatEventSeq returns the couple's latest event sequence number, 0 before the first event
+func GetChatEventSeq(coupleID primitive.ObjectID) (int64, error) {
+	collection := config.GetDB().Collection("chat_event_counters")
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := collection.FindOne(context.TODO(), bson.M{"_id": coupleID}).Decode(&counter)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	}
+	return counter.Seq, err
+}
+
+// AppendChatEvent numbers a frame and stores it in the couple's log. encode
+// receives the seq so it can be part of the stored frame.
+func AppendChatEvent(coupleID primitive.ObjectID, messageID *primitive.ObjectID, encode func(seq int64) (string, error)) (int64, error) {
+	seq, err := nextChatEventSeq(coupleID)
+	if err != nil {
+		return 0, err
+	}
+	payload, err := encode(seq)
+	if err != nil {
+		return 0, err
+	}
+
+	collection := config.GetDB().Collection("chat_events")
+	_, err = collection.InsertOne(context.TODO(), ChatEvent{
+		CoupleID:  coupleID,
+		Seq:       seq,
+		MessageID: messageID,
+		Payload:   payload,
+		CreatedAt: time.Now(),
+	})
+	return seq, err
+}
+
+// GetChatEventsAfter lists up to limit of the couple's events after seq, oldest first
+func GetChatEventsAfter(coupleID primitive.ObjectID, seq int64, limit int64) ([]ChatEvent, error) {
+	collection := config.GetDB().Collection("chat_events")
+	cursor, err := collection.Find(
+		context.TODO(),
+		bson.M{"couple_id": coupleID, "seq": bson.M{"$gt": seq}},
+		options.Find().SetSort(bson.M{"seq": 1}).SetLimit(limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var events []ChatEvent
+	if err := cursor.All(context.TODO(), &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// GetMessageEventSeq returns the seq of the first event logged about a
+// message, which is the one announcing it, or 0 when none was logged
+func GetMessageEventSeq(messageID primitive.ObjectID) (int64, error) {
+	collection := config.GetDB().Collection("chat_events")
+	var event ChatEvent
+	err := collection.FindOne(
+		context.TODO(),
+		bson.M{"message_id": messageID},
+		options.FindOne().SetSort(bson.M{"seq": 1}),
+	).Decode(&event)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	}
+	return event.Seq, err
+}
+
+// DeleteMessageEvents removes the logged events about a message, so nothing
+// of a disappearing message can be replayed
+func DeleteMessageEvents(messageID primitive.ObjectID) error {
+	collection := config.GetDB().Collection("chat_events")
+	_, err := collection.DeleteMany(context.TODO(), bson.M{"message_id": messageID})
+	return err
+}
@@ -2,33 +2,116 @@ package models
 
 import (
 	"context"
+	"errors"
+	"log"
 	"time"
 
 	"github.com/KevinChaves65/Project_Boo/config"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrCoupleNotFound  = errors.New("couple not found")
+	ErrNotCoupleMember = errors.New("user is not a member of this couple")
 )
 
 type Couple struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`      // Primary key
-	User1ID   primitive.ObjectID `bson:"user1_id" json:"user1_id"`     // First user's ID
-	User2ID   primitive.ObjectID `bson:"user2_id" json:"user2_id"`     // Second user's ID
-	CreatedAt time.Time          `bson:"created_at" json:"created_at"` // Timestamp when the couple was created
+	ID                primitive.ObjectID   `bson:"_id,omitempty" json:"id"`                                              // Primary key
+	User1ID           primitive.ObjectID   `bson:"user1_id" json:"user1_id"`                                             // First user's ID
+	User2ID           primitive.ObjectID   `bson:"user2_id" json:"user2_id"`                                             // Second user's ID
+	Members           []primitive.ObjectID `bson:"members" json:"-"`                                                     // Both user IDs, uniquely indexed so a user is in one couple only
+	Status            CoupleStatus         `bson:"status,omitempty" json:"status"`                                       // Empty for couples created before unlinking existed
+	UnlinkRequestedBy *primitive.ObjectID  `bson:"unlink_requested_by,omitempty" json:"unlink_requested_by,omitempty"`   // Partner who asked to unlink
+	UnlinkRequestedAt *time.Time           `bson:"unlink_requested_at,omitempty" json:"unlink_requested_at,omitempty"`   // When the unlink was requested
+	PurgeAt           *time.Time           `bson:"purge_at,omitempty" json:"purge_at,omitempty"`                         // When the cooling-off period ends
+	E2EEnabled        bool                 `bson:"e2e_enabled,omitempty" json:"e2e_enabled"`                             // Messages are end-to-end encrypted by the clients
+	E2EChangedAt      *time.Time           `bson:"e2e_changed_at,omitempty" json:"e2e_changed_at,omitempty"`             // When end-to-end encryption was last turned on or off
+	E2EChangedBy      *primitive.ObjectID  `bson:"e2e_changed_by,omitempty" json:"e2e_changed_by,omitempty"`             // Partner who last turned it on, or agreed to turn it off
+	E2EOffRequestedBy *primitive.ObjectID  `bson:"e2e_off_requested_by,omitempty" json:"e2e_off_requested_by,omitempty"` // Partner waiting for the other to agree to turn it off
+	E2EOffRequestedAt *time.Time           `bson:"e2e_off_requested_at,omitempty" json:"e2e_off_requested_at,omitempty"` // When turning it off was requested
+	MessageExpiry     MessageExpiry        `bson:"message_expiry" json:"message_expiry"`                                 // Default lifetime of the couple's messages
+	CreatedAt         time.Time            `bson:"created_at" json:"created_at"`                                         // Timestamp when the couple was created
+	DetachedAt        *time.Time           `bson:"detached_at,omitempty" json:"-"`                                       // Set by RepairCoupleLinks on a couple that lost a shared member
 }
 
-// AddCouple creates a new couple entry in the database
-func AddCouple(user1ID, user2ID primitive.ObjectID) (primitive.ObjectID, error) {
-	collection := config.GetDB().Collection("couples")
+// IsMember reports whether the user is one of the two partners of the couple.
+// Nobody is a member of a detached couple any more.
+func (c Couple) IsMember(userID primitive.ObjectID) bool {
+	return c.DetachedAt == nil && (c.User1ID == userID || c.User2ID == userID)
+}
+
+// AuthorizeCoupleMember loads a couple and checks that the user belongs to it.
+// Every couple-scoped operation should go through this check first.
+func AuthorizeCoupleMember(coupleID, userID primitive.ObjectID) (Couple, error) {
+	couple, err := GetCoupleByID(coupleID)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return couple, ErrCoupleNotFound
+		}
+		return couple, err
+	}
+	if !couple.IsMember(userID) {
+		return couple, ErrNotCoupleMember
+	}
+	return couple, nil
+}
+
+// LinkUsers creates a couple for two users who are not in a couple yet and
+// records the couple ID on both users, all in one transaction
+func LinkUsers(user1ID, user2ID primitive.ObjectID) (primitive.ObjectID, error) {
+	var coupleID primitive.ObjectID
+	err := withTransaction(func(sc mongo.SessionContext) error {
+		var err error
+		coupleID, err = linkUsers(sc, user1ID, user2ID)
+		return err
+	})
+	if err != nil {
+		return coupleID, err
+	}
+	publishCoupleChange(EntityCreated, coupleID)
+	return coupleID, nil
+}
+
+// linkUsers claims both users and inserts the couple inside a transaction.
+// The users are only claimed while they have no couple_id, and the unique
+// index on members catches any concurrent link that slips past that check.
+func linkUsers(sc mongo.SessionContext, user1ID, user2ID primitive.ObjectID) (primitive.ObjectID, error) {
+	users := config.GetDB().Collection("users")
+	couples := config.GetDB().Collection("couples")
+
+	now := time.Now()
+	coupleID := primitive.NewObjectID()
+	for _, userID := range []primitive.ObjectID{user1ID, user2ID} {
+		result, err := users.UpdateOne(
+			sc,
+			bson.M{"_id": userID, "couple_id": nil},
+			bson.M{"$set": bson.M{"couple_id": coupleID, "updated_at": now}},
+		)
+		if err != nil {
+			return primitive.NilObjectID, err
+		}
+		if result.MatchedCount == 0 {
+			return primitive.NilObjectID, ErrAlreadyInCouple
+		}
+	}
+
 	couple := Couple{
+		ID:        coupleID,
 		User1ID:   user1ID,
 		User2ID:   user2ID,
-		CreatedAt: time.Now(),
+		Members:   []primitive.ObjectID{user1ID, user2ID},
+		Status:    CoupleActive,
+		CreatedAt: now,
 	}
-	result, err := collection.InsertOne(context.TODO(), couple)
-	if err != nil {
+	if _, err := couples.InsertOne(sc, couple); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return primitive.NilObjectID, ErrAlreadyInCouple
+		}
 		return primitive.NilObjectID, err
 	}
-	return result.InsertedID.(primitive.ObjectID), nil
+	return coupleID, nil
 }
 
 // GetCoupleByID retrieves a couple by their couple ID
@@ -43,16 +126,216 @@ func GetCoupleByID(coupleID primitive.ObjectID) (Couple, error) {
 func GetCoupleByUserID(userID primitive.ObjectID) (Couple, error) {
 	collection := config.GetDB().Collection("couples")
 	var couple Couple
-	err := collection.FindOne(context.TODO(), bson.M{"$or": []bson.M{
-		{"user1_id": userID},
-		{"user2_id": userID},
-	}}).Decode(&couple)
+	// members is unique per user, so this is the one couple the user is in
+	err := collection.FindOne(context.TODO(), bson.M{"members": userID}).Decode(&couple)
 	return couple, err
 }
 
-// DeleteCouple deletes a couple by their couple ID
+// DeleteCouple deletes a couple by their couple ID and clears couple_id on
+// both users in the same transaction
 func DeleteCouple(coupleID primitive.ObjectID) error {
-	collection := config.GetDB().Collection("couples")
-	_, err := collection.DeleteOne(context.TODO(), bson.M{"_id": coupleID})
+	err := withTransaction(func(sc mongo.SessionContext) error {
+		return unlinkCouple(sc, coupleID)
+	})
+	if err != nil {
+		return err
+	}
+	publishChange(EntityCouple, EntityDeleted, coupleID, coupleID.Hex(), nil)
+	return nil
+}
+
+func unlinkCouple(sc mongo.SessionContext, coupleID primitive.ObjectID) error {
+	users := config.GetDB().Collection("users")
+	couples := config.GetDB().Collection("couples")
+
+	result, err := couples.DeleteOne(sc, bson.M{"_id": coupleID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrCoupleNotFound
+	}
+
+	_, err = users.UpdateMany(
+		sc,
+		bson.M{"couple_id": coupleID},
+		bson.M{"$unset": bson.M{"couple_id": ""}, "$set": bson.M{"updated_at": time.Now()}},
+	)
 	return err
 }
+
+// RepairCoupleLinks backfills members on couples created before it existed
+// and clears couple_id on users whose couple no longer exists or no longer
+// has them as a member. Old data can have a user in more than one couple,
+// which the unique index on members forbids: the couple the user's couple_id
+// points to is kept, or else the newest, and the others are detached. They
+// stay stored, with their data, but no longer resolve for their members.
+func RepairCoupleLinks() error {
+	users := config.GetDB().Collection("users")
+	couples := config.GetDB().Collection("couples")
+
+	if err := detachSharedCouples(); err != nil {
+		return err
+	}
+
+	_, err := couples.UpdateMany(
+		context.TODO(),
+		bson.M{"members": bson.M{"$exists": false}, "detached_at": bson.M{"$exists": false}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"members": bson.A{"$user1_id", "$user2_id"}}}}},
+	)
+	if err != nil {
+		return err
+	}
+
+	cursor, err := users.Aggregate(context.TODO(), mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"couple_id": bson.M{"$ne": nil}}}},
+		{{Key: "$lookup", Value: bson.M{"from": "couples", "localField": "couple_id", "foreignField": "_id", "as": "couple"}}},
+		{{Key: "$match", Value: bson.M{"$expr": bson.M{"$not": bson.A{
+			bson.M{"$in": bson.A{"$_id", bson.M{"$ifNull": bson.A{bson.M{"$arrayElemAt": bson.A{"$couple.members", 0}}, bson.A{}}}}},
+		}}}}},
+		{{Key: "$project", Value: bson.M{"_id": 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.TODO())
+
+	var stale []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(context.TODO(), &stale); err != nil {
+		return err
+	}
+	for _, user := range stale {
+		if _, err := users.UpdateOne(context.TODO(), bson.M{"_id": user.ID}, bson.M{"$unset": bson.M{"couple_id": ""}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// detachSharedCouples leaves every user in at most one couple
+func detachSharedCouples() error {
+	couples := config.GetDB().Collection("couples")
+	cursor, err := couples.Aggregate(context.TODO(), mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"detached_at": bson.M{"$exists": false}}}},
+		{{Key: "$project", Value: bson.M{"user": bson.A{"$user1_id", "$user2_id"}}}},
+		{{Key: "$unwind", Value: "$user"}},
+		{{Key: "$group", Value: bson.M{"_id": "$user", "couples": bson.M{"$addToSet": "$_id"}}}},
+		{{Key: "$match", Value: bson.M{"couples.1": bson.M{"$exists": true}}}},
+	})
+	if err != nil {
+		return err
+	}
+	var shared []struct {
+		UserID  primitive.ObjectID   `bson:"_id"`
+		Couples []primitive.ObjectID `bson:"couples"`
+	}
+	if err := cursor.All(context.TODO(), &shared); err != nil {
+		return err
+	}
+
+	detached := make(map[primitive.ObjectID]bool)
+	for _, entry := range shared {
+		// Couples detached for an earlier user are out of the running
+		var candidates []primitive.ObjectID
+		for _, coupleID := range entry.Couples {
+			if !detached[coupleID] {
+				candidates = append(candidates, coupleID)
+			}
+		}
+		if len(candidates) < 2 {
+			continue
+		}
+
+		// ObjectIDs grow with time, so the largest is the newest couple
+		keep := candidates[0]
+		for _, coupleID := range candidates {
+			if coupleID.Hex() > keep.Hex() {
+				keep = coupleID
+			}
+		}
+		if user, err := GetUserByID(entry.UserID); err == nil && user.CoupleID != nil {
+			for _, coupleID := range candidates {
+				if coupleID == *user.CoupleID {
+					keep = coupleID
+				}
+			}
+		}
+
+		for _, coupleID := range candidates {
+			if coupleID == keep {
+				continue
+			}
+			_, err := couples.UpdateOne(
+				context.TODO(),
+				bson.M{"_id": coupleID},
+				bson.M{"$set": bson.M{"detached_at": time.Now()}, "$unset": bson.M{"members": ""}},
+			)
+			if err != nil {
+				return err
+			}
+			detached[coupleID] = true
+			log.Printf("Detached couple %s: user %s is also in couple %s", coupleID.Hex(), entry.UserID.Hex(), keep.Hex())
+		}
+	}
+	return nil
+}
+
+// SetCoupleE2E turns end-to-end encryption on or off for a couple on behalf of
+// one partner and drops any pending request to turn it off. Neither partner
+// can turn it off alone: that only happens while the other partner's request
+// to turn it off is pending. changed is false if nothing changed.
+func SetCoupleE2E(coupleID, userID primitive.ObjectID, enabled bool) (changed bool, err error) {
+	collection := config.GetDB().Collection("couples")
+	filter := bson.M{"_id": coupleID, "e2e_enabled": bson.M{"$ne": true}}
+	if !enabled {
+		filter = bson.M{"_id": coupleID, "e2e_enabled": true, "e2e_off_requested_by": bson.M{"$exists": true, "$ne": userID}}
+	}
+	result, err := collection.UpdateOne(context.TODO(), filter, bson.M{
+		"$set": bson.M{
+			"e2e_enabled":    enabled,
+			"e2e_changed_at": time.Now(),
+			"e2e_changed_by": userID,
+		},
+		"$unset": bson.M{"e2e_off_requested_by": "", "e2e_off_requested_at": ""},
+	})
+	if err != nil || result.ModifiedCount == 0 {
+		return false, err
+	}
+	publishCoupleUpdate(coupleID)
+	return true, nil
+}
+
+// RequestCoupleE2EOff records that a partner wants end-to-end encryption
+// turned off; it stays on until the other partner agrees. requested is false
+// if it is not on.
+func RequestCoupleE2EOff(coupleID, userID primitive.ObjectID) (requested bool, err error) {
+	collection := config.GetDB().Collection("couples")
+	result, err := collection.UpdateOne(
+		context.TODO(),
+		bson.M{"_id": coupleID, "e2e_enabled": true},
+		bson.M{"$set": bson.M{"e2e_off_requested_by": userID, "e2e_off_requested_at": time.Now()}},
+	)
+	if err != nil || result.MatchedCount == 0 {
+		return false, err
+	}
+	publishCoupleUpdate(coupleID)
+	return true, nil
+}
+
+// CancelCoupleE2EOff drops a pending request to turn end-to-end encryption
+// off. cancelled is false if none was pending.
+func CancelCoupleE2EOff(coupleID primitive.ObjectID) (cancelled bool, err error) {
+	collection := config.GetDB().Collection("couples")
+	result, err := collection.UpdateOne(
+		context.TODO(),
+		bson.M{"_id": coupleID, "e2e_off_requested_by": bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{"e2e_off_requested_by": "", "e2e_off_requested_at": ""}},
+	)
+	if err != nil || result.ModifiedCount == 0 {
+		return false, err
+	}
+	publishCoupleUpdate(coupleID)
+	return true, nil
+}
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrDeviceKeyNotFound = errors.New("device key not found")
+
+// DeviceKey is the X25519 identity key one of a user's devices published.
+// Only public keys ever reach the server.
+type DeviceKey struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	DeviceID  string             `bson:"device_id" json:"device_id"`
+	PublicKey string             `bson:"public_key" json:"public_key"` // Base64 of the 32-byte X25519 key
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// PublishDeviceKey stores a device's identity key. changed reports whether the
+// user's set of keys is different from before, i.e. a new device or a new
+// key for a known one.
+func PublishDeviceKey(userID primitive.ObjectID, deviceID, publicKey string) (key DeviceKey, changed bool, err error) {
+	collection := config.GetDB().Collection("device_keys")
+	now := time.Now()
+
+	var previous DeviceKey
+	err = collection.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"user_id": userID, "device_id": deviceID},
+		bson.M{
+			"$set":         bson.M{"public_key": publicKey, "updated_at": now},
+			"$setOnInsert": bson.M{"created_at": now},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before),
+	).Decode(&previous)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return key, false, err
+	}
+	changed = errors.Is(err, mongo.ErrNoDocuments) || previous.PublicKey != publicKey
+
+	err = collection.FindOne(context.TODO(), bson.M{"user_id": userID, "device_id": deviceID}).Decode(&key)
+	return key, changed, err
+}
+
+// GetDeviceKeys lists a user's device keys, oldest device first
+func GetDeviceKeys(userID primitive.ObjectID) ([]DeviceKey, error) {
+	collection := config.GetDB().Collection("device_keys")
+	cursor, err := collection.Find(context.TODO(), bson.M{"user_id": userID}, options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		return nil, err
+	}
+	keys := []DeviceKey{}
+	if err := cursor.All(context.TODO(), &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// DeleteDeviceKey removes a device from the user's key directory
+func DeleteDeviceKey(userID primitive.ObjectID, deviceID string) error {
+	collection := config.GetDB().Collection("device_keys")
+	result, err := collection.DeleteOne(context.TODO(), bson.M{"user_id": userID, "device_id": deviceID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrDeviceKeyNotFound
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// EntityKind names a kind of couple data that clients keep in sync
+type EntityKind string
+
+const (
+	EntityMilestone       EntityKind = "milestone"
+	EntitySavedSuggestion EntityKind = "saved_suggestion"
+	EntityWordBank        EntityKind = "word_bank"
+	EntityCouple          EntityKind = "couple"
+)
+
+// EntityAction is what happened to an entity
+type EntityAction string
+
+const (
+	EntityCreated EntityAction = "created"
+	EntityUpdated EntityAction = "updated"
+	EntityDeleted EntityAction = "deleted"
+)
+
+// EntityChange describes one change to a couple's data. Data holds the entity
+// as stored after the change and is empty for deletions.
+type EntityChange struct {
+	Entity   EntityKind         `json:"entity"`
+	Action   EntityAction       `json:"action"`
+	ID       string             `json:"id"`
+	CoupleID primitive.ObjectID `json:"couple_id"`
+	Data     interface{}        `json:"data,omitempty"`
+}
+
+// entityChangeHandler receives every change once it is stored
+var entityChangeHandler func(EntityChange)
+
+// OnEntityChange sets the function told about every stored change to couple
+// data. It must be set before the server starts handling requests.
+func OnEntityChange(handler func(EntityChange)) {
+	entityChangeHandler = handler
+}
+
+// publishChange tells the registered handler, if any, about a change
+func publishChange(entity EntityKind, action EntityAction, coupleID primitive.ObjectID, id string, data interface{}) {
+	if entityChangeHandler == nil {
+		return
+	}
+	entityChangeHandler(EntityChange{
+		Entity:   entity,
+		Action:   action,
+		ID:       id,
+		CoupleID: coupleID,
+		Data:     data,
+	})
+}
+
+// publishCoupleUpdate reloads a couple after it changed and publishes it
+func publishCoupleUpdate(coupleID primitive.ObjectID) {
+	publishCoupleChange(EntityUpdated, coupleID)
+}
+
+// publishCoupleChange reloads a couple after it was created or changed and
+// publishes it
+func publishCoupleChange(action EntityAction, coupleID primitive.ObjectID) {
+	if entityChangeHandler == nil {
+		return
+	}
+	couple, err := GetCoupleByID(coupleID)
+	if err != nil {
+		return
+	}
+	publishChange(EntityCouple, action, coupleID, coupleID.Hex(), couple)
+}
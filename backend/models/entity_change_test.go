@@ -0,0 +1,122 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestMutatorsPublishEntityChanges(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	var published []EntityChange
+	OnEntityChange(func(change EntityChange) { published = append(published, change) })
+	defer OnEntityChange(nil)
+
+	coupleID := primitive.NewObjectID()
+	id := primitive.NewObjectID()
+	written := func(n int) bson.D {
+		return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: n}, bson.E{Key: "nModified", Value: n})
+	}
+	found := func(doc bson.D) bson.D {
+		return mtest.CreateSuccessResponse(bson.E{Key: "value", Value: doc})
+	}
+	couple := func(fields ...bson.E) bson.D {
+		doc := append(bson.D{{Key: "_id", Value: coupleID}}, fields...)
+		return mtest.CreateCursorResponse(0, "db.couples", mtest.FirstBatch, doc)
+	}
+
+	tests := []struct {
+		name      string
+		responses []bson.D
+		mutate    func() error
+		entity    EntityKind
+		action    EntityAction
+	}{
+		{"AddMilestone", []bson.D{written(1)}, func() error {
+			return AddMilestone(Milestone{CoupleID: coupleID, Title: "First date"})
+		}, EntityMilestone, EntityCreated},
+		{"UpdateMilestone", []bson.D{found(bson.D{{Key: "_id", Value: id}})}, func() error {
+			return UpdateMilestone(coupleID, id, Milestone{Title: "First date"})
+		}, EntityMilestone, EntityUpdated},
+		{"DeleteMilestone", []bson.D{written(1)}, func() error {
+			return DeleteMilestone(coupleID, id)
+		}, EntityMilestone, EntityDeleted},
+		{"SaveWordToBank", []bson.D{written(1)}, func() error {
+			return SaveWordToBank(WordBank{ID: "word", CoupleID: coupleID.Hex(), WordName: "sunset"})
+		}, EntityWordBank, EntityCreated},
+		{"UpdateWordTheme", []bson.D{found(bson.D{{Key: "_id", Value: "word"}})}, func() error {
+			return UpdateWordTheme(coupleID.Hex(), "word", "theme")
+		}, EntityWordBank, EntityUpdated},
+		{"DeleteWordFromBank", []bson.D{written(1)}, func() error {
+			return DeleteWordFromBank(coupleID.Hex(), "word")
+		}, EntityWordBank, EntityDeleted},
+		{"SaveSuggestion", []bson.D{written(1)}, func() error {
+			_, err := SaveSuggestion(SavedSuggestion{CoupleID: coupleID, Title: "Picnic"})
+			return err
+		}, EntitySavedSuggestion, EntityCreated},
+		{"DeleteSavedSuggestion", []bson.D{written(1)}, func() error {
+			return DeleteSavedSuggestion(coupleID, id)
+		}, EntitySavedSuggestion, EntityDeleted},
+		{"SetCoupleE2E", []bson.D{written(1), couple()}, func() error {
+			_, err := SetCoupleE2E(coupleID, id, true)
+			return err
+		}, EntityCouple, EntityUpdated},
+		{"RequestCoupleE2EOff", []bson.D{written(1), couple()}, func() error {
+			_, err := RequestCoupleE2EOff(coupleID, id)
+			return err
+		}, EntityCouple, EntityUpdated},
+		{"CancelCoupleE2EOff", []bson.D{written(1), couple()}, func() error {
+			_, err := CancelCoupleE2EOff(coupleID)
+			return err
+		}, EntityCouple, EntityUpdated},
+		{"SetCoupleMessageExpiry", []bson.D{written(1), couple()}, func() error {
+			return SetCoupleMessageExpiry(coupleID, MessageExpiry{})
+		}, EntityCouple, EntityUpdated},
+		{"RequestUnlink", []bson.D{found(bson.D{{Key: "_id", Value: coupleID}})}, func() error {
+			_, err := RequestUnlink(coupleID, id, time.Hour)
+			return err
+		}, EntityCouple, EntityUpdated},
+		{"CancelUnlink", []bson.D{couple(bson.E{Key: "status", Value: CoupleUnlinking}), written(1), couple()}, func() error {
+			return CancelUnlink(coupleID)
+		}, EntityCouple, EntityUpdated},
+		{"DeleteCouple", []bson.D{written(1), written(2), written(1)}, func() error {
+			return DeleteCouple(coupleID)
+		}, EntityCouple, EntityDeleted},
+	}
+
+	for _, test := range tests {
+		mt.Run(test.name, func(mt *mtest.T) {
+			config.DB = mt.DB
+			published = nil
+			mt.AddMockResponses(test.responses...)
+			if err := test.mutate(); err != nil {
+				mt.Fatal(err)
+			}
+			if len(published) != 1 {
+				mt.Fatalf("published %d changes, want 1", len(published))
+			}
+			if change := published[0]; change.Entity != test.entity || change.Action != test.action || change.CoupleID != coupleID {
+				mt.Fatalf("published %+v, want %s %s", change, test.entity, test.action)
+			}
+		})
+	}
+
+	// Linking picks the couple's ID itself
+	mt.Run("LinkUsers", func(mt *mtest.T) {
+		config.DB = mt.DB
+		published = nil
+		mt.AddMockResponses(written(1), written(1), written(1), written(1), couple())
+		linked, err := LinkUsers(primitive.NewObjectID(), primitive.NewObjectID())
+		if err != nil {
+			mt.Fatal(err)
+		}
+		if len(published) != 1 || published[0].Action != EntityCreated || published[0].CoupleID != linked {
+			mt.Fatalf("published %+v, want the new couple created", published)
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// MinMessageExpiry and MaxMessageExpiry bound a disappearing message's lifetime
+	MinMessageExpiry = 30 * time.Second
+	MaxMessageExpiry = 365 * 24 * time.Hour
+	// MessageExpiryGrace is how long after expiring Mongo's TTL monitor removes
+	// a message the sweeper missed. The sweeper normally gets there first and
+	// also removes the message's attachments and reactions.
+	MessageExpiryGrace = time.Hour
+)
+
+var ErrInvalidMessageExpiry = errors.New("expiry must be 0 or between 30 seconds and 365 days")
+
+// MessageExpiry is how long a message lives after it is sent and after it is
+// read, in seconds. Zero means no limit; when both are set the earlier wins.
+type MessageExpiry struct {
+	AfterSend int64 `bson:"after_send,omitempty" json:"after_send"`
+	AfterRead int64 `bson:"after_read,omitempty" json:"after_read"`
+}
+
+// IsZero reports whether messages never expire
+func (e MessageExpiry) IsZero() bool {
+	return e.AfterSend == 0 && e.AfterRead == 0
+}
+
+// Validate checks both lifetimes are within bounds
+func (e MessageExpiry) Validate() error {
+	// Compare seconds before converting, which would overflow for huge values
+	minSeconds, maxSeconds := int64(MinMessageExpiry/time.Second), int64(MaxMessageExpiry/time.Second)
+	for _, seconds := range []int64{e.AfterSend, e.AfterRead} {
+		if seconds != 0 && (seconds < minSeconds || seconds > maxSeconds) {
+			return ErrInvalidMessageExpiry
+		}
+	}
+	return nil
+}
+
+// Apply sets the expiry fields of a message about to be saved
+func (e MessageExpiry) Apply(message *Message, now time.Time) {
+	if e.AfterSend > 0 {
+		expiresAt := now.Add(time.Duration(e.AfterSend) * time.Second)
+		message.ExpiresAt = &expiresAt
+	}
+	message.ExpireAfterRead = e.AfterRead
+}
+
+// excludeExpired adds a condition to a message filter that leaves out
+// messages past their expiry, which may linger until the sweeper runs. Any
+// $nor already in the filter is kept.
+func excludeExpired(filter bson.M, now time.Time) bson.M {
+	expired := bson.M{"expires_at": bson.M{"$lte": now}}
+	switch nor := filter["$nor"].(type) {
+	case nil:
+		filter["$nor"] = []bson.M{expired}
+	case []bson.M:
+		filter["$nor"] = append(nor, expired)
+	default:
+		return bson.M{"$and": []bson.M{filter, {"$nor": []bson.M{expired}}}}
+	}
+	return filter
+}
+
+// SetCoupleMessageExpiry changes the default lifetime of the couple's new messages
+func SetCoupleMessageExpiry(coupleID primitive.ObjectID, expiry MessageExpiry) error {
+	collection := config.GetDB().Collection("couples")
+	result, err := collection.UpdateOne(context.TODO(), bson.M{"_id": coupleID}, bson.M{"$set": bson.M{"message_expiry": expiry}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrCoupleNotFound
+	}
+	publishCoupleUpdate(coupleID)
+	return nil
+}
+
+// GetExpiredMessages lists up to limit messages whose expiry has passed, oldest expiry first
+func GetExpiredMessages(now time.Time, limit int64) ([]Message, error) {
+	collection := config.GetDB().Collection("messages")
+	cursor, err := collection.Find(
+		context.TODO(),
+		bson.M{"expires_at": bson.M{"$lte": now}},
+		options.Find().SetSort(bson.M{"expires_at": 1}).SetLimit(limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var messages []Message
+	if err := cursor.All(context.TODO(), &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// DeleteExpiredMessage removes a message whose expiry has passed. deleted is
+// false when another instance's sweeper removed it first.
+func DeleteExpiredMessage(id primitive.ObjectID) (deleted bool, err error) {
+	collection := config.GetDB().Collection("messages")
+	result, err := collection.DeleteOne(context.TODO(), bson.M{"_id": id, "expires_at": bson.M{"$lte": time.Now()}})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
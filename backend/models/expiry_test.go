@@ -0,0 +1,51 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMessageExpiryValidate(t *testing.T) {
+	valid := []MessageExpiry{
+		{},
+		{AfterSend: 30},
+		{AfterRead: 365 * 24 * 60 * 60},
+		{AfterSend: 3600, AfterRead: 60},
+	}
+	for _, expiry := range valid {
+		if err := expiry.Validate(); err != nil {
+			t.Errorf("%+v: %v", expiry, err)
+		}
+	}
+
+	invalid := []MessageExpiry{
+		{AfterSend: -1},
+		{AfterSend: 29},
+		{AfterRead: 365*24*60*60 + 1},
+		// Wraps to about 100s once converted to a Duration
+		{AfterSend: 18446744174},
+		{AfterRead: 1<<63 - 1},
+	}
+	for _, expiry := range invalid {
+		if err := expiry.Validate(); !errors.Is(err, ErrInvalidMessageExpiry) {
+			t.Errorf("%+v: got %v, want ErrInvalidMessageExpiry", expiry, err)
+		}
+	}
+}
+
+func TestExcludeExpiredKeepsExistingNor(t *testing.T) {
+	now := time.Now()
+	filter := excludeExpired(bson.M{"$nor": []bson.M{{"deleted": true}}}, now)
+	if nor := filter["$nor"].([]bson.M); len(nor) != 2 {
+		t.Fatalf("got %v, want both conditions", nor)
+	}
+
+	filter = excludeExpired(bson.M{"$nor": bson.A{bson.M{"deleted": true}}}, now)
+	and, ok := filter["$and"].([]bson.M)
+	if !ok || len(and) != 2 || and[0]["$nor"] == nil {
+		t.Fatalf("got %v, want the original filter kept under $and", filter)
+	}
+}
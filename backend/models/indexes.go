@@ -0,0 +1,166 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// collectionIndexes lists the indexes of one collection
+type collectionIndexes struct {
+	collection string
+	indexes    []mongo.IndexModel
+}
+
+// EnsureIndexes creates the indexes the models rely on. Creating an index that
+// already exists is a no-op, so this is safe to run on every startup.
+func EnsureIndexes() error {
+	indexes := []collectionIndexes{
+		{"sessions", []mongo.IndexModel{
+			{Keys: bson.D{{Key: "refresh_token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "rotated_hashes", Value: 1}}},
+			{Keys: bson.D{{Key: "user_id", Value: 1}}},
+			// Expired sessions are removed by Mongo itself
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		}},
+		{"couples", []mongo.IndexModel{
+			// A user can only ever be a member of one couple
+			{
+				Keys: bson.D{{Key: "members", Value: 1}},
+				Options: options.Index().SetUnique(true).
+					SetPartialFilterExpression(bson.M{"members": bson.M{"$exists": true}}),
+			},
+		}},
+		{"users", []mongo.IndexModel{
+			{Keys: bson.D{{Key: "couple_id", Value: 1}}},
+		}},
+		{"messages", []mongo.IndexModel{
+			// Paging through a couple's conversation, by ID and by time
+			{Keys: bson.D{{Key: "couple_id", Value: 1}, {Key: "_id", Value: -1}}},
+			{Keys: bson.D{{Key: "couple_id", Value: 1}, {Key: "timestamp", Value: -1}}},
+			// Messages of users without a couple are matched by user ID
+			{Keys: bson.D{{Key: "sender_id", Value: 1}, {Key: "_id", Value: -1}}},
+			{Keys: bson.D{{Key: "receiver_id", Value: 1}, {Key: "_id", Value: -1}}},
+			// Unread counts and read receipts
+			{Keys: bson.D{{Key: "receiver_id", Value: 1}, {Key: "status", Value: 1}}},
+			// A sender's client message IDs are unique, so a retried send cannot store a duplicate
+			{
+				Keys: bson.D{{Key: "sender_id", Value: 1}, {Key: "client_msg_id", Value: 1}},
+				Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{
+					"sender_id":     bson.M{"$exists": true},
+					"client_msg_id": bson.M{"$type": "string"},
+				}),
+			},
+			// Disappearing messages; the sweeper removes them on time, the TTL is a backstop
+			{
+				Keys:    bson.D{{Key: "expires_at", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(int32(MessageExpiryGrace.Seconds())),
+			},
+		}},
+		{"attachments", []mongo.IndexModel{
+			{Keys: bson.D{{Key: "couple_id", Value: 1}}},
+			{Keys: bson.D{{Key: "message_id", Value: 1}}},
+			// Unsent uploads are swept by age
+			{Keys: bson.D{{Key: "created_at", Value: 1}}},
+		}},
+		{"message_reactions", []mongo.IndexModel{
+			// One reaction per emoji per user; the prefix also serves lookups by message
+			{
+				Keys:    bson.D{{Key: "message_id", Value: 1}, {Key: "user_id", Value: 1}, {Key: "emoji", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{Keys: bson.D{{Key: "couple_id", Value: 1}}},
+		}},
+		{"device_keys", []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "device_id", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+		}},
+		{"search_tokens", []mongo.IndexModel{
+			{Keys: bson.D{{Key: "couple_id", Value: 1}, {Key: "tokens", Value: 1}}},
+		}},
+		{"presence", []mongo.IndexModel{
+			{Keys: bson.D{{Key: "user_id", Value: 1}}},
+			// Entries of connections no instance refreshes any more lapse on their own
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		}},
+		{"scheduled_messages", []mongo.IndexModel{
+			// The scheduler looks for due messages, senders list their own
+			{Keys: bson.D{{Key: "status", Value: 1}, {Key: "send_at", Value: 1}}},
+			{Keys: bson.D{{Key: "sender_id", Value: 1}, {Key: "status", Value: 1}}},
+			{Keys: bson.D{{Key: "couple_id", Value: 1}}},
+		}},
+		{"chat_events", []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "couple_id", Value: 1}, {Key: "seq", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{Keys: bson.D{{Key: "message_id", Value: 1}}},
+			{
+				Keys:    bson.D{{Key: "created_at", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(int32(ChatEventTTL.Seconds())),
+			},
+		}},
+		{"backplane_events", []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "created_at", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(int32(BackplaneEventTTL.Seconds())),
+			},
+		}},
+		{"pairing_invites", []mongo.IndexModel{
+			{Keys: bson.D{{Key: "code", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "inviter_id", Value: 1}, {Key: "status", Value: 1}}},
+			{Keys: bson.D{{Key: "invitee_id", Value: 1}}},
+		}},
+		{"saved_suggestions", []mongo.IndexModel{
+			// A suggestion is saved once per couple
+			{
+				Keys:    bson.D{{Key: "couple_id", Value: 1}, {Key: "title", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+		}},
+		{"notifications", []mongo.IndexModel{
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		}},
+	}
+
+	// Every index is attempted even if another fails, so one bad index does
+	// not leave the others missing
+	var errs []error
+	for _, spec := range indexes {
+		collection := config.GetDB().Collection(spec.collection)
+		if _, err := collection.Indexes().CreateMany(context.TODO(), spec.indexes); err != nil {
+			errs = append(errs, fmt.Errorf("indexes on %s: %w", spec.collection, err))
+		}
+	}
+
+	// Message indexes keyed by username, replaced by the user ID ones above.
+	// The unique sender_1_client_msg_id_1 would clash once a username is given
+	// up and taken by someone else.
+	obsolete := []struct {
+		collection string
+		names      []string
+	}{
+		{"messages", []string{"sender_1__id_-1", "receiver_1__id_-1", "receiver_1_status_1", "sender_1_client_msg_id_1"}},
+	}
+	for _, spec := range obsolete {
+		collection := config.GetDB().Collection(spec.collection)
+		for _, indexName := range spec.names {
+			var commandErr mongo.CommandError
+			if _, err := collection.Indexes().DropOne(context.TODO(), indexName); err != nil &&
+				!(errors.As(err, &commandErr) && commandErr.Code == indexNotFoundCode) {
+				errs = append(errs, fmt.Errorf("dropping %s on %s: %w", indexName, spec.collection, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// indexNotFoundCode is the server error for dropping an index that does not exist
+const indexNotFoundCode = 27
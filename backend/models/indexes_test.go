@@ -0,0 +1,39 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestEnsureIndexesAttemptsEveryIndex(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("keeps going after a failure", func(mt *mtest.T) {
+		config.DB = mt.DB
+		responses := []bson.D{mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 85, Message: "conflict"})}
+		for i := 0; i < 40; i++ {
+			responses = append(responses, mtest.CreateSuccessResponse())
+		}
+		mt.AddMockResponses(responses...)
+
+		if err := EnsureIndexes(); err == nil {
+			mt.Fatal("expected the failed index to be reported")
+		}
+
+		created, dropped := 0, 0
+		for event := mt.GetStartedEvent(); event != nil; event = mt.GetStartedEvent() {
+			switch event.CommandName {
+			case "createIndexes":
+				created++
+			case "dropIndexes":
+				dropped++
+			}
+		}
+		if created < 2 || dropped == 0 {
+			mt.Fatalf("stopped early: %d collections indexed, %d drops", created, dropped)
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type JobStatus string
+
+const (
+	JobRunning   JobStatus = "running"
+	JobCompleted JobStatus = "completed"
+	JobFailed    JobStatus = "failed"
+	// JobPartial is a job that went through every document but could not
+	// migrate some of them; it is run again from the start later
+	JobPartial JobStatus = "partial"
+)
+
+var (
+	ErrJobCompleted = errors.New("maintenance job has already completed")
+	ErrJobLeased    = errors.New("maintenance job is running on another instance")
+	ErrJobWaiting   = errors.New("maintenance job is waiting to be retried")
+)
+
+// MaintenanceJob records the progress of a resumable background job. Jobs
+// walk a collection in _id order and save the last processed ID, so an
+// interrupted job picks up where it stopped.
+type MaintenanceJob struct {
+	ID          string             `bson:"_id" json:"id"`
+	Status      JobStatus          `bson:"status" json:"status"`
+	Target      string             `bson:"target" json:"target"` // What the job migrates to, e.g. a key ID
+	Cursor      primitive.ObjectID `bson:"cursor" json:"cursor"` // Last processed document
+	Processed   int64              `bson:"processed" json:"processed"`
+	Updated     int64              `bson:"updated" json:"updated"`
+	Failed      int64              `bson:"failed" json:"failed"`
+	Owner       string             `bson:"owner" json:"owner"`
+	LeaseUntil  time.Time          `bson:"lease_until" json:"lease_until"`
+	StartedAt   time.Time          `bson:"started_at" json:"started_at"`
+	UpdatedAt   time.Time          `bson:"updated_at" json:"updated_at"`
+	CompletedAt *time.Time         `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+	LastError   string             `bson:"last_error,omitempty" json:"last_error,omitempty"`
+}
+
+// GetMaintenanceJob retrieves a job by name
+func GetMaintenanceJob(id string) (MaintenanceJob, error) {
+	collection := config.GetDB().Collection("maintenance_jobs")
+	var job MaintenanceJob
+	err := collection.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&job)
+	return job, err
+}
+
+// ClaimMaintenanceJob takes the lease on a job for this instance. A job that
+// already completed for the same target is not run again; a new target starts
+// the job over, and so does a partial run once retryAfter has passed.
+func ClaimMaintenanceJob(id, target string, lease, retryAfter time.Duration) (MaintenanceJob, error) {
+	collection := config.GetDB().Collection("maintenance_jobs")
+	now := time.Now()
+
+	existing, err := GetMaintenanceJob(id)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return existing, err
+	}
+	found := err == nil
+	if found && existing.Target == target && existing.Status == JobCompleted {
+		return existing, ErrJobCompleted
+	}
+	rerun := found && existing.Target == target && existing.Status == JobPartial
+	if rerun && now.Sub(existing.UpdatedAt) < retryAfter {
+		return existing, ErrJobWaiting
+	}
+
+	set := bson.M{
+		"status":      JobRunning,
+		"owner":       config.InstanceID,
+		"lease_until": now.Add(lease),
+		"updated_at":  now,
+	}
+	if !found || existing.Target != target || rerun {
+		// Start over from the first document
+		set["target"] = target
+		set["cursor"] = primitive.NilObjectID
+		set["processed"] = 0
+		set["updated"] = 0
+		set["failed"] = 0
+		set["started_at"] = now
+	}
+
+	var job MaintenanceJob
+	err = collection.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"_id": id, "$or": []bson.M{
+			{"lease_until": bson.M{"$lt": now}},
+			{"owner": config.InstanceID},
+		}},
+		bson.M{"$set": set, "$unset": bson.M{"completed_at": "", "last_error": ""}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&job)
+	if mongo.IsDuplicateKeyError(err) {
+		// The job exists but another instance holds its lease
+		return job, ErrJobLeased
+	}
+	return job, err
+}
+
+// SaveJobProgress stores the job's cursor and counters and extends its lease
+func SaveJobProgress(job *MaintenanceJob, lease time.Duration) error {
+	collection := config.GetDB().Collection("maintenance_jobs")
+	now := time.Now()
+	set := bson.M{
+		"status":      job.Status,
+		"cursor":      job.Cursor,
+		"processed":   job.Processed,
+		"updated":     job.Updated,
+		"failed":      job.Failed,
+		"lease_until": now.Add(lease),
+		"updated_at":  now,
+		"last_error":  job.LastError,
+	}
+	if job.CompletedAt != nil {
+		set["completed_at"] = *job.CompletedAt
+	}
+
+	result, err := collection.UpdateOne(context.TODO(), bson.M{"_id": job.ID, "owner": config.InstanceID}, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrJobLeased
+	}
+	job.LeaseUntil = now.Add(lease)
+	return nil
+}
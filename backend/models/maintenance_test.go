@@ -0,0 +1,50 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestClaimPartialJob(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	partial := func(updatedAt time.Time) bson.D {
+		return mtest.CreateCursorResponse(0, "db.maintenance_jobs", mtest.FirstBatch, bson.D{
+			{Key: "_id", Value: "job"},
+			{Key: "status", Value: JobPartial},
+			{Key: "target", Value: "k2"},
+			{Key: "failed", Value: 3},
+			{Key: "updated_at", Value: updatedAt},
+		})
+	}
+
+	mt.Run("waits before a rerun", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(partial(time.Now()))
+		if _, err := ClaimMaintenanceJob("job", "k2", time.Minute, time.Hour); !errors.Is(err, ErrJobWaiting) {
+			mt.Fatalf("got %v, want ErrJobWaiting", err)
+		}
+	})
+
+	mt.Run("starts over once the wait passed", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(
+			partial(time.Now().Add(-2*time.Hour)),
+			mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{{Key: "_id", Value: "job"}, {Key: "status", Value: JobRunning}}}),
+		)
+		if _, err := ClaimMaintenanceJob("job", "k2", time.Minute, time.Hour); err != nil {
+			mt.Fatal(err)
+		}
+		mt.GetStartedEvent() // Looking up the existing job
+		update := mt.GetStartedEvent().Command.String()
+		if !strings.Contains(update, `"cursor": {"$oid":"000000000000000000000000"}`) {
+			mt.Fatalf("job did not start over: %s", update)
+		}
+	})
+}
@@ -3,54 +3,526 @@ package models
 import (
 	"context"
 	"log"
+	"time"
 
 	"github.com/KevinChaves65/Project_Boo/config"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Message struct {
-	Sender    string `json:"sender"`
-	Receiver  string `json:"receiver"`
-	Content   string `json:"content"`
-	Timestamp int64  `json:"timestamp"`
+	ID          primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	CoupleID    *primitive.ObjectID `bson:"couple_id,omitempty" json:"couple_id,omitempty"`
+	SenderID    primitive.ObjectID  `bson:"sender_id,omitempty" json:"sender_id"`
+	ReceiverID  primitive.ObjectID  `bson:"receiver_id,omitempty" json:"receiver_id"`
+	Sender      string              `bson:"sender" json:"sender"`     // Username when sent; loaded messages carry the current one
+	Receiver    string              `bson:"receiver" json:"receiver"` // Username when sent; loaded messages carry the current one
+	Content     string              `bson:"content" json:"content"`
+	Timestamp   int64               `bson:"timestamp" json:"timestamp"`
+	Status      MessageStatus       `bson:"status,omitempty" json:"status"`
+	DeliveredAt *time.Time          `bson:"delivered_at,omitempty" json:"delivered_at,omitempty"`
+	ReadAt      *time.Time          `bson:"read_at,omitempty" json:"read_at,omitempty"`
+	Edited      bool                `bson:"edited,omitempty" json:"edited"`
+	EditedAt    *time.Time          `bson:"edited_at,omitempty" json:"edited_at,omitempty"`
+	EditHistory []MessageEdit       `bson:"edit_history,omitempty" json:"-"`            // Earlier encrypted contents, oldest first
+	Deleted     bool                `bson:"deleted,omitempty" json:"deleted,omitempty"` // Unsent; only a tombstone is left
+	DeletedAt   *time.Time          `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	Reactions   []ReactionSummary   `bson:"-" json:"reactions,omitempty"` // Filled in when history is loaded
+
+	// Disappearing messages are removed once ExpiresAt passes. ExpireAfterRead
+	// starts the countdown when the receiver reads the message.
+	ExpiresAt       *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	ExpireAfterRead int64      `bson:"expire_after_read,omitempty" json:"expire_after_read,omitempty"` // Seconds
+
+	// ClientMsgID is the sender's own ID for the message; a retried send with
+	// the same ID returns the stored message instead of a duplicate
+	ClientMsgID string `bson:"client_msg_id,omitempty" json:"client_msg_id,omitempty"`
+	Seq         int64  `bson:"-" json:"seq,omitempty"` // Position of the message's event in the couple's log
+
+	AttachmentIDs []primitive.ObjectID `bson:"attachment_ids,omitempty" json:"attachment_ids,omitempty"`
+	Attachments   []Attachment         `bson:"-" json:"attachments,omitempty"` // Filled in when history is loaded
+
+	// End-to-end encrypted messages have no Content; each recipient device gets its own ciphertext
+	E2E          bool               `bson:"e2e,omitempty" json:"e2e,omitempty"`
+	SenderDevice string             `bson:"sender_device,omitempty" json:"sender_device,omitempty"`
+	Ciphertexts  []DeviceCiphertext `bson:"ciphertexts,omitempty" json:"ciphertexts,omitempty"`
 }
 
-// Save a message to the database
-func SaveMessage(message Message) error {
+// IsParticipant reports whether the user sent or received the message
+func (m Message) IsParticipant(userID primitive.ObjectID) bool {
+	return m.SenderID == userID || m.ReceiverID == userID
+}
+
+// Save a message to the database. The timestamp, and the ID unless the caller
+// reserved one, are assigned here so every chat path stores them the same way.
+func SaveMessage(message Message) (Message, error) {
 	collection := config.GetDB().Collection("messages")
+	if message.ID.IsZero() {
+		message.ID = primitive.NewObjectID()
+	}
+	message.Timestamp = time.Now().Unix()
+	message.Status = MessageSent
 	_, err := collection.InsertOne(context.TODO(), message)
-	return err
+	return message, err
+}
+
+// DeviceCiphertext is an end-to-end encrypted message sealed for one device.
+// The server stores and relays it but cannot read it.
+type DeviceCiphertext struct {
+	UserID     primitive.ObjectID `bson:"user_id" json:"user_id"`
+	DeviceID   string             `bson:"device_id" json:"device_id"`
+	Ciphertext string             `bson:"ciphertext" json:"ciphertext"`
 }
 
-// Get messages for a user
-func GetMessages(username string) ([]Message, error) {
+const (
+	// DefaultMessagePageSize is used when a query does not set a limit
+	DefaultMessagePageSize = 50
+	// MaxMessagePageSize caps how many messages one page can hold
+	MaxMessagePageSize = 200
+)
+
+// MessageQuery selects one page of a user's conversation. At most one of
+// Before, After and Since should be set.
+type MessageQuery struct {
+	CoupleID *primitive.ObjectID // the couple's conversation; when nil, messages are matched by UserID
+	UserID   primitive.ObjectID
+	Before   *primitive.ObjectID // messages older than this ID
+	After    *primitive.ObjectID // messages newer than this ID
+	Since    *int64              // messages with a timestamp after this unix time, for polling
+	Limit    int
+}
+
+// MessagePage is a page of messages ordered newest first
+type MessagePage struct {
+	Messages []Message `json:"messages"`
+	HasMore  bool      `json:"has_more"`
+}
+
+// GetMessages retrieves one page of messages, newest first. Before pages
+// backwards through history; After and Since page forwards from a point.
+func GetMessages(query MessageQuery) (MessagePage, error) {
 	collection := config.GetDB().Collection("messages")
-	var messages []Message
+	page := MessagePage{Messages: []Message{}}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultMessagePageSize
+	}
+	if limit > MaxMessagePageSize {
+		limit = MaxMessagePageSize
+	}
 
-	// Query for messages where the user is either the sender or receiver
-	filter := bson.M{
-		"$or": []bson.M{
-			{"receiver": username},
-			{"sender": username},
-		},
+	filter := excludeExpired(bson.M{}, time.Now())
+	if query.CoupleID != nil {
+		filter["couple_id"] = *query.CoupleID
+	} else {
+		// Query for messages where the user is either the sender or receiver
+		filter["$or"] = []bson.M{
+			{"receiver_id": query.UserID},
+			{"sender_id": query.UserID},
+		}
 	}
 
-	cursor, err := collection.Find(context.TODO(), filter)
+	// Forward pages are read oldest first so the limit keeps the messages right
+	// after the cursor, then reversed below
+	sort := -1
+	switch {
+	case query.Before != nil:
+		filter["_id"] = bson.M{"$lt": *query.Before}
+	case query.After != nil:
+		filter["_id"] = bson.M{"$gt": *query.After}
+		sort = 1
+	case query.Since != nil:
+		filter["timestamp"] = bson.M{"$gt": *query.Since}
+		sort = 1
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: sort}}).
+		SetLimit(int64(limit + 1))
+
+	cursor, err := collection.Find(context.TODO(), filter, opts)
 	if err != nil {
-		return messages, err
+		return page, err
 	}
-	for cursor.Next(context.Background()) {
+	defer cursor.Close(context.TODO())
+
+	for cursor.Next(context.TODO()) {
 		var message Message
 		if err := cursor.Decode(&message); err != nil {
 			log.Println("Error decoding message:", err)
 			continue
 		}
-		messages = append(messages, message)
+		// Messages stored before receipts existed count as read
+		if message.Status == "" {
+			message.Status = MessageRead
+		}
+		page.Messages = append(page.Messages, message)
 	}
-
 	if err := cursor.Err(); err != nil {
+		return page, err
+	}
+
+	if len(page.Messages) > limit {
+		page.HasMore = true
+		page.Messages = page.Messages[:limit]
+	}
+	if sort == 1 {
+		for i, j := 0, len(page.Messages)-1; i < j; i, j = i+1, j-1 {
+			page.Messages[i], page.Messages[j] = page.Messages[j], page.Messages[i]
+		}
+	}
+	fillParticipantNames(page.Messages)
+	return page, nil
+}
+
+// withParticipantNames returns the message with its participants' current usernames
+func withParticipantNames(message Message) Message {
+	messages := []Message{message}
+	fillParticipantNames(messages)
+	return messages[0]
+}
+
+// fillParticipantNames replaces the usernames stored with messages by the
+// users' current ones, so a rename shows up in older messages too. Names that
+// cannot be resolved are left as stored.
+func fillParticipantNames(messages []Message) {
+	names := make(map[primitive.ObjectID]string)
+	name := func(id primitive.ObjectID, stored string) string {
+		if id.IsZero() {
+			return stored
+		}
+		if _, ok := names[id]; !ok {
+			names[id] = stored
+			if user, err := GetUserByID(id); err == nil {
+				names[id] = user.Username
+			}
+		}
+		return names[id]
+	}
+	for i := range messages {
+		messages[i].Sender = name(messages[i].SenderID, messages[i].Sender)
+		messages[i].Receiver = name(messages[i].ReceiverID, messages[i].Receiver)
+	}
+}
+
+// BackfillMessageCoupleIDs sets couple_id on messages exchanged between
+// partners before messages were stored per couple
+func BackfillMessageCoupleIDs() error {
+	cursor, err := config.GetDB().Collection("couples").Find(context.TODO(), bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.TODO())
+
+	messages := config.GetDB().Collection("messages")
+	for cursor.Next(context.TODO()) {
+		var couple Couple
+		if err := cursor.Decode(&couple); err != nil {
+			return err
+		}
+		user1, err := GetUserByID(couple.User1ID)
+		if err != nil {
+			continue
+		}
+		user2, err := GetUserByID(couple.User2ID)
+		if err != nil {
+			continue
+		}
+
+		_, err = messages.UpdateMany(context.TODO(), bson.M{
+			"couple_id": bson.M{"$exists": false},
+			"$or": []bson.M{
+				{"sender_id": user1.ID, "receiver_id": user2.ID},
+				{"sender_id": user2.ID, "receiver_id": user1.ID},
+				{"sender": user1.Username, "receiver": user2.Username},
+				{"sender": user2.Username, "receiver": user1.Username},
+			},
+		}, bson.M{"$set": bson.M{"couple_id": couple.ID}})
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// BackfillMessageUserIDs sets sender_id and receiver_id on messages stored
+// before messages were keyed by user ID. A username may have changed or passed
+// to someone else since, so couple messages are resolved within their couple:
+// reactions, attachments and the partners' current names tie stored names to
+// users, and as every message is between the two partners, knowing one side
+// of it gives the other. Messages left without IDs are counted and logged.
+func BackfillMessageUserIDs() error {
+	messages := config.GetDB().Collection("messages")
+	missing := bson.M{"$exists": false}
+
+	coupleIDs, err := messages.Distinct(context.TODO(), "couple_id", bson.M{"sender_id": missing, "couple_id": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	for _, value := range coupleIDs {
+		coupleID, ok := value.(primitive.ObjectID)
+		if !ok {
+			continue
+		}
+		if err := backfillCoupleMessages(coupleID); err != nil {
+			return err
+		}
+	}
+
+	// Messages outside a couple, which could go to any user
+	for field, idField := range map[string]string{"sender": "sender_id", "receiver": "receiver_id"} {
+		filter := bson.M{idField: missing, "couple_id": missing}
+		names, err := messages.Distinct(context.TODO(), field, filter)
+		if err != nil {
+			return err
+		}
+		for _, value := range names {
+			username, ok := value.(string)
+			if !ok {
+				continue
+			}
+			user, err := GetUserByUsername(username)
+			if err != nil {
+				continue
+			}
+			_, err = messages.UpdateMany(
+				context.TODO(),
+				bson.M{field: username, idField: missing, "couple_id": missing},
+				bson.M{"$set": bson.M{idField: user.ID}},
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	unmigrated, err := messages.CountDocuments(context.TODO(), bson.M{"$or": []bson.M{{"sender_id": missing}, {"receiver_id": missing}}})
+	if err != nil {
+		return err
+	}
+	if unmigrated > 0 {
+		log.Printf("%d messages could not be matched to users and stay hidden until fixed by hand", unmigrated)
+	}
+	return nil
+}
+
+// backfillCoupleMessages sets user IDs on one couple's messages, which may
+// belong to a couple that no longer exists
+func backfillCoupleMessages(coupleID primitive.ObjectID) error {
+	messages := config.GetDB().Collection("messages")
+	filter := bson.M{"couple_id": coupleID, "sender_id": bson.M{"$exists": false}}
+
+	// Each distinct sender and receiver name pair is updated as a whole
+	cursor, err := messages.Aggregate(context.TODO(), mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{"_id": bson.M{"sender": "$sender", "receiver": "$receiver"}}}},
+	})
+	if err != nil {
+		return err
+	}
+	var groups []struct {
+		Names struct {
+			Sender   string `bson:"sender"`
+			Receiver string `bson:"receiver"`
+		} `bson:"_id"`
+	}
+	if err := cursor.All(context.TODO(), &groups); err != nil {
+		return err
+	}
+
+	names, err := coupleNameEvidence(coupleID)
+	if err != nil {
+		return err
+	}
+	partners := make(map[primitive.ObjectID]primitive.ObjectID)
+	if couple, err := GetCoupleByID(coupleID); err == nil {
+		partners[couple.User1ID] = couple.User2ID
+		partners[couple.User2ID] = couple.User1ID
+		for _, id := range []primitive.ObjectID{couple.User1ID, couple.User2ID} {
+			if user, err := GetUserByID(id); err == nil {
+				if _, known := names[user.Username]; !known {
+					names[user.Username] = user.ID
+				}
+			}
+		}
+	} else {
+		// Without the couple, fall back to the current holders of the names
+		// and take the partners from a message both of whose sides are known
+		for _, group := range groups {
+			for _, name := range []string{group.Names.Sender, group.Names.Receiver} {
+				if _, known := names[name]; known {
+					continue
+				}
+				if user, err := GetUserByUsername(name); err == nil {
+					names[name] = user.ID
+				}
+			}
+		}
+		for _, group := range groups {
+			sender, senderKnown := names[group.Names.Sender]
+			receiver, receiverKnown := names[group.Names.Receiver]
+			if senderKnown && receiverKnown && sender != receiver {
+				partners[sender] = receiver
+				partners[receiver] = sender
+				break
+			}
+		}
+	}
+
+	// Each resolved side of a message resolves the other, which can in turn
+	// resolve further messages
+	for changed := true; changed; {
+		changed = false
+		for _, group := range groups {
+			sender, senderKnown := names[group.Names.Sender]
+			receiver, receiverKnown := names[group.Names.Receiver]
+			if senderKnown && !receiverKnown {
+				if other, ok := partners[sender]; ok {
+					names[group.Names.Receiver] = other
+					changed = true
+				}
+			} else if receiverKnown && !senderKnown {
+				if other, ok := partners[receiver]; ok {
+					names[group.Names.Sender] = other
+					changed = true
+				}
+			}
+		}
+	}
+
+	for _, group := range groups {
+		sender, senderKnown := names[group.Names.Sender]
+		receiver, receiverKnown := names[group.Names.Receiver]
+		if !senderKnown || !receiverKnown || sender == receiver {
+			continue
+		}
+		_, err := messages.UpdateMany(context.TODO(), bson.M{
+			"couple_id": coupleID,
+			"sender_id": bson.M{"$exists": false},
+			"sender":    group.Names.Sender,
+			"receiver":  group.Names.Receiver,
+		}, bson.M{"$set": bson.M{"sender_id": sender, "receiver_id": receiver}})
+		if err != nil {
+			return err
+		}
+	}
+
+	left, err := messages.CountDocuments(context.TODO(), filter)
+	if err != nil {
+		return err
+	}
+	if left > 0 {
+		log.Printf("Could not match %d messages of couple %s to users", left, coupleID.Hex())
+	}
+	return nil
+}
+
+// coupleNameEvidence maps names stored on a couple's messages to the users who
+// held them at the time, from the reactions and attachments that carry both
+func coupleNameEvidence(coupleID primitive.ObjectID) (map[string]primitive.ObjectID, error) {
+	db := config.GetDB()
+	names := make(map[string]primitive.ObjectID)
+
+	cursor, err := db.Collection("message_reactions").Find(context.TODO(), bson.M{"couple_id": coupleID})
+	if err != nil {
 		return nil, err
 	}
+	var reactions []Reaction
+	if err := cursor.All(context.TODO(), &reactions); err != nil {
+		return nil, err
+	}
+	for _, reaction := range reactions {
+		if reaction.Username != "" {
+			names[reaction.Username] = reaction.UserID
+		}
+	}
 
+	// The uploader of an attachment sent the message it is attached to
+	cursor, err = db.Collection("attachments").Find(context.TODO(), bson.M{"couple_id": coupleID, "message_id": bson.M{"$exists": true}})
+	if err != nil {
+		return nil, err
+	}
+	var attachments []Attachment
+	if err := cursor.All(context.TODO(), &attachments); err != nil {
+		return nil, err
+	}
+	uploaders := make(map[primitive.ObjectID]primitive.ObjectID)
+	var messageIDs []primitive.ObjectID
+	for _, attachment := range attachments {
+		uploaders[*attachment.MessageID] = attachment.UploaderID
+		messageIDs = append(messageIDs, *attachment.MessageID)
+	}
+	if len(messageIDs) == 0 {
+		return names, nil
+	}
+	cursor, err = db.Collection("messages").Find(context.TODO(), bson.M{"_id": bson.M{"$in": messageIDs}})
+	if err != nil {
+		return nil, err
+	}
+	var sent []Message
+	if err := cursor.All(context.TODO(), &sent); err != nil {
+		return nil, err
+	}
+	for _, message := range sent {
+		names[message.Sender] = uploaders[message.ID]
+	}
+	return names, nil
+}
+
+// GetMessagesByIDs retrieves the given messages, keyed by ID, leaving out expired ones
+func GetMessagesByIDs(ids []primitive.ObjectID) (map[primitive.ObjectID]Message, error) {
+	messages := make(map[primitive.ObjectID]Message)
+	if len(ids) == 0 {
+		return messages, nil
+	}
+
+	collection := config.GetDB().Collection("messages")
+	cursor, err := collection.Find(context.TODO(), excludeExpired(bson.M{"_id": bson.M{"$in": ids}}, time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	var found []Message
+	if err := cursor.All(context.TODO(), &found); err != nil {
+		return nil, err
+	}
+	fillParticipantNames(found)
+	for _, message := range found {
+		messages[message.ID] = message
+	}
 	return messages, nil
 }
+
+// GetMessagesAfter returns up to limit messages after the given ID, oldest
+// first, for jobs that walk the whole collection
+func GetMessagesAfter(after primitive.ObjectID, limit int) ([]Message, error) {
+	collection := config.GetDB().Collection("messages")
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := collection.Find(context.TODO(), bson.M{"_id": bson.M{"$gt": after}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var messages []Message
+	if err := cursor.All(context.TODO(), &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// ReplaceMessageCiphertexts swaps in re-encrypted content and edit history.
+// It only applies if the content is still oldContent, so a concurrent edit is
+// never overwritten; replaced reports whether it applied.
+func ReplaceMessageCiphertexts(id primitive.ObjectID, oldContent, content string, history []MessageEdit) (replaced bool, err error) {
+	collection := config.GetDB().Collection("messages")
+	set := bson.M{"content": content}
+	if len(history) > 0 {
+		set["edit_history"] = history
+	}
+	result, err := collection.UpdateOne(context.TODO(), bson.M{"_id": id, "content": oldContent}, bson.M{"$set": set})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
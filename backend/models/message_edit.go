@@ -0,0 +1,130 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrMessageNotFound  = errors.New("message not found")
+	ErrNotMessageSender = errors.New("only the sender can change this message")
+	ErrEditWindowClosed = errors.New("the message can no longer be changed")
+	ErrMessageDeleted   = errors.New("the message was unsent")
+)
+
+// MessageEdit is an earlier version of an edited message
+type MessageEdit struct {
+	Content  string    `bson:"content" json:"content"`
+	EditedAt time.Time `bson:"edited_at" json:"edited_at"`
+}
+
+// GetMessageByID retrieves a single message
+func GetMessageByID(id primitive.ObjectID) (Message, error) {
+	collection := config.GetDB().Collection("messages")
+	var message Message
+	err := collection.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&message)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return message, ErrMessageNotFound
+	}
+	return message, err
+}
+
+// GetMessageByClientID retrieves the sender's message with the given client message ID
+func GetMessageByClientID(senderID primitive.ObjectID, clientMsgID string) (Message, error) {
+	collection := config.GetDB().Collection("messages")
+	var message Message
+	err := collection.FindOne(context.TODO(), bson.M{"sender_id": senderID, "client_msg_id": clientMsgID}).Decode(&message)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return message, ErrMessageNotFound
+	}
+	if err != nil {
+		return message, err
+	}
+	return withParticipantNames(message), nil
+}
+
+// changeableFilter matches the sender's message while it is still inside the edit window
+func changeableFilter(id, senderID primitive.ObjectID, window time.Duration) bson.M {
+	return bson.M{
+		"_id":       id,
+		"sender_id": senderID,
+		"deleted":   bson.M{"$ne": true},
+		"timestamp": bson.M{"$gte": time.Now().Add(-window).Unix()},
+	}
+}
+
+// changeError explains why a message did not match changeableFilter
+func changeError(id, senderID primitive.ObjectID) error {
+	message, err := GetMessageByID(id)
+	switch {
+	case err != nil:
+		return err
+	case message.SenderID != senderID:
+		return ErrNotMessageSender
+	case message.Deleted:
+		return ErrMessageDeleted
+	default:
+		return ErrEditWindowClosed
+	}
+}
+
+// EditMessage replaces the content of the sender's message, keeping the
+// previous content in its edit history. content is stored as given, so it
+// must already be encrypted.
+func EditMessage(id, senderID primitive.ObjectID, content string, window time.Duration) (Message, error) {
+	collection := config.GetDB().Collection("messages")
+	now := time.Now()
+
+	// A pipeline update reads the old content while replacing it
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"edit_history": bson.M{"$concatArrays": bson.A{
+				bson.M{"$ifNull": bson.A{"$edit_history", bson.A{}}},
+				bson.A{bson.M{"content": "$content", "edited_at": now}},
+			}},
+			"content":   content,
+			"edited":    true,
+			"edited_at": now,
+		}}},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var message Message
+	err := collection.FindOneAndUpdate(context.TODO(), changeableFilter(id, senderID, window), update, opts).Decode(&message)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return message, changeError(id, senderID)
+	}
+	if err != nil {
+		return message, err
+	}
+	return withParticipantNames(message), nil
+}
+
+// UnsendMessage replaces the sender's message with a tombstone. The content
+// and edit history are removed; the tombstone keeps the message's place in
+// the conversation.
+func UnsendMessage(id, senderID primitive.ObjectID, window time.Duration) (Message, error) {
+	collection := config.GetDB().Collection("messages")
+	update := bson.M{
+		"$set":   bson.M{"deleted": true, "deleted_at": time.Now(), "content": ""},
+		"$unset": bson.M{"edit_history": ""},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var message Message
+	err := collection.FindOneAndUpdate(context.TODO(), changeableFilter(id, senderID, window), update, opts).Decode(&message)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return message, changeError(id, senderID)
+	}
+	if err != nil {
+		return message, err
+	}
+	return withParticipantNames(message), nil
+}
@@ -7,6 +7,8 @@ import (
 	"github.com/KevinChaves65/Project_Boo/config"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Milestone struct {
@@ -23,10 +25,16 @@ type Milestone struct {
 // AddMilestone adds a new milestone to the database
 func AddMilestone(milestone Milestone) error {
 	collection := config.GetDB().Collection("milestones")
+	if milestone.ID.IsZero() {
+		milestone.ID = primitive.NewObjectID()
+	}
 	milestone.CreatedAt = time.Now()
 	milestone.UpdatedAt = time.Now()
-	_, err := collection.InsertOne(context.TODO(), milestone)
-	return err
+	if _, err := collection.InsertOne(context.TODO(), milestone); err != nil {
+		return err
+	}
+	publishChange(EntityMilestone, EntityCreated, milestone.CoupleID, milestone.ID.Hex(), milestone)
+	return nil
 }
 
 // GetMilestones retrieves milestones for a couple
@@ -48,17 +56,42 @@ func GetMilestones(coupleID primitive.ObjectID) ([]Milestone, error) {
 	return milestones, nil
 }
 
-// UpdateMilestone updates an existing milestone
-func UpdateMilestone(id primitive.ObjectID, updatedMilestone Milestone) error {
+// UpdateMilestone updates an existing milestone of the couple.
+// Returns mongo.ErrNoDocuments if the milestone does not belong to the couple.
+func UpdateMilestone(coupleID, id primitive.ObjectID, updatedMilestone Milestone) error {
 	collection := config.GetDB().Collection("milestones")
-	updatedMilestone.UpdatedAt = time.Now()
-	_, err := collection.UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{"$set": updatedMilestone})
-	return err
+	update := bson.M{
+		"title":       updatedMilestone.Title,
+		"description": updatedMilestone.Description,
+		"date":        updatedMilestone.Date,
+		"reminder":    updatedMilestone.Reminder,
+		"updated_at":  time.Now(),
+	}
+	var milestone Milestone
+	err := collection.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"_id": id, "couple_id": coupleID},
+		bson.M{"$set": update},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&milestone)
+	if err != nil {
+		return err
+	}
+	publishChange(EntityMilestone, EntityUpdated, coupleID, id.Hex(), milestone)
+	return nil
 }
 
-// DeleteMilestone deletes a milestone by ID
-func DeleteMilestone(id primitive.ObjectID) error {
+// DeleteMilestone deletes a milestone of the couple by ID.
+// Returns mongo.ErrNoDocuments if the milestone does not belong to the couple.
+func DeleteMilestone(coupleID, id primitive.ObjectID) error {
 	collection := config.GetDB().Collection("milestones")
-	_, err := collection.DeleteOne(context.TODO(), bson.M{"_id": id})
-	return err
+	result, err := collection.DeleteOne(context.TODO(), bson.M{"_id": id, "couple_id": coupleID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	publishChange(EntityMilestone, EntityDeleted, coupleID, id.Hex(), nil)
+	return nil
 }
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Notification is a message shown to a single user, e.g. about a pairing invite
+type Notification struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Type      string             `bson:"type" json:"type"`
+	Message   string             `bson:"message" json:"message"`
+	Data      bson.M             `bson:"data,omitempty" json:"data,omitempty"`
+	Read      bool               `bson:"read" json:"read"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// AddNotification stores a notification for a user
+func AddNotification(notification Notification) (Notification, error) {
+	collection := config.GetDB().Collection("notifications")
+	notification.ID = primitive.NewObjectID()
+	notification.CreatedAt = time.Now()
+	_, err := collection.InsertOne(context.TODO(), notification)
+	return notification, err
+}
+
+// GetNotifications retrieves the latest notifications of a user
+func GetNotifications(userID primitive.ObjectID, unreadOnly bool) ([]Notification, error) {
+	collection := config.GetDB().Collection("notifications")
+	filter := bson.M{"user_id": userID}
+	if unreadOnly {
+		filter["read"] = false
+	}
+
+	cursor, err := collection.Find(context.TODO(), filter, options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(50))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	var notifications []Notification
+	if err := cursor.All(context.TODO(), &notifications); err != nil {
+		return nil, err
+	}
+	return notifications, nil
+}
+
+// MarkNotificationRead marks one of the user's notifications as read.
+// Returns mongo.ErrNoDocuments if the notification does not belong to the user.
+func MarkNotificationRead(userID, notificationID primitive.ObjectID) error {
+	collection := config.GetDB().Collection("notifications")
+	result, err := collection.UpdateOne(
+		context.TODO(),
+		bson.M{"_id": notificationID, "user_id": userID},
+		bson.M{"$set": bson.M{"read": true}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type InviteStatus string
+
+const (
+	InvitePending   InviteStatus = "pending"
+	InviteAccepted  InviteStatus = "accepted"
+	InviteDeclined  InviteStatus = "declined"
+	InviteExpired   InviteStatus = "expired"
+	InviteCancelled InviteStatus = "cancelled"
+)
+
+const (
+	// InviteTTL is how long a pairing code can be redeemed
+	InviteTTL = 24 * time.Hour
+	// InviteCodeLength is the number of characters in a pairing code
+	InviteCodeLength = 8
+	// inviteCodeAlphabet leaves out characters that are easy to confuse (0/O, 1/I/L)
+	inviteCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+)
+
+var (
+	ErrInviteNotFound   = errors.New("invite not found")
+	ErrInviteExpired    = errors.New("invite has expired")
+	ErrInviteNotPending = errors.New("invite is no longer pending")
+	ErrOwnInvite        = errors.New("you cannot accept your own invite")
+	ErrAlreadyInCouple  = errors.New("user is already in a couple")
+)
+
+// PairingInvite is a short code one user shares with their partner. The couple
+// is only created once the partner accepts it.
+type PairingInvite struct {
+	ID          primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	Code        string              `bson:"code" json:"code"`
+	InviterID   primitive.ObjectID  `bson:"inviter_id" json:"inviter_id"`
+	InviteeID   *primitive.ObjectID `bson:"invitee_id,omitempty" json:"invitee_id,omitempty"`
+	Status      InviteStatus        `bson:"status" json:"status"`
+	CoupleID    *primitive.ObjectID `bson:"couple_id,omitempty" json:"couple_id,omitempty"`
+	CreatedAt   time.Time           `bson:"created_at" json:"created_at"`
+	ExpiresAt   time.Time           `bson:"expires_at" json:"expires_at"`
+	RespondedAt *time.Time          `bson:"responded_at,omitempty" json:"responded_at,omitempty"`
+}
+
+// QRPayload is the content encoded in the QR code shown for the invite
+func (i PairingInvite) QRPayload() string {
+	return "heyboo://pair?code=" + i.Code
+}
+
+// NormalizeInviteCode upper-cases a code and strips separators users may type
+func NormalizeInviteCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+func generateInviteCode() (string, error) {
+	code := make([]byte, InviteCodeLength)
+	max := big.NewInt(int64(len(inviteCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = inviteCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// CreatePairingInvite creates a new invite for the inviter and cancels any
+// invite they still had pending
+func CreatePairingInvite(inviterID primitive.ObjectID) (PairingInvite, error) {
+	collection := config.GetDB().Collection("pairing_invites")
+
+	_, err := collection.UpdateMany(
+		context.TODO(),
+		bson.M{"inviter_id": inviterID, "status": InvitePending},
+		bson.M{"$set": bson.M{"status": InviteCancelled}},
+	)
+	if err != nil {
+		return PairingInvite{}, err
+	}
+
+	now := time.Now()
+	invite := PairingInvite{
+		InviterID: inviterID,
+		Status:    InvitePending,
+		CreatedAt: now,
+		ExpiresAt: now.Add(InviteTTL),
+	}
+
+	// Codes are short, so retry on the rare collision with the unique index
+	for attempt := 0; attempt < 5; attempt++ {
+		code, err := generateInviteCode()
+		if err != nil {
+			return invite, err
+		}
+		invite.ID = primitive.NewObjectID()
+		invite.Code = code
+
+		_, err = collection.InsertOne(context.TODO(), invite)
+		if err == nil {
+			return invite, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return invite, err
+		}
+	}
+	return invite, errors.New("failed to generate a unique invite code")
+}
+
+// GetPairingInviteByCode retrieves an invite by its code, marking it expired if needed
+func GetPairingInviteByCode(code string) (PairingInvite, error) {
+	collection := config.GetDB().Collection("pairing_invites")
+	var invite PairingInvite
+	err := collection.FindOne(context.TODO(), bson.M{"code": NormalizeInviteCode(code)}).Decode(&invite)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return invite, ErrInviteNotFound
+		}
+		return invite, err
+	}
+
+	if invite.Status == InvitePending && time.Now().After(invite.ExpiresAt) {
+		_, err := collection.UpdateOne(
+			context.TODO(),
+			bson.M{"_id": invite.ID, "status": InvitePending},
+			bson.M{"$set": bson.M{"status": InviteExpired}},
+		)
+		if err != nil {
+			return invite, err
+		}
+		invite.Status = InviteExpired
+	}
+	return invite, nil
+}
+
+// GetPairingInvites lists the invites a user created or responded to, newest first
+func GetPairingInvites(userID primitive.ObjectID) ([]PairingInvite, error) {
+	collection := config.GetDB().Collection("pairing_invites")
+
+	// Expire stale invites so the listed statuses are accurate
+	_, err := collection.UpdateMany(
+		context.TODO(),
+		bson.M{"inviter_id": userID, "status": InvitePending, "expires_at": bson.M{"$lte": time.Now()}},
+		bson.M{"$set": bson.M{"status": InviteExpired}},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := collection.Find(context.TODO(), bson.M{"$or": []bson.M{
+		{"inviter_id": userID},
+		{"invitee_id": userID},
+	}}, options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(20))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	var invites []PairingInvite
+	if err := cursor.All(context.TODO(), &invites); err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+// RespondToPairingInvite records the invitee's answer. Accepting links both
+// users into a new couple in the same transaction.
+func RespondToPairingInvite(code string, inviteeID primitive.ObjectID, accept bool) (PairingInvite, error) {
+	collection := config.GetDB().Collection("pairing_invites")
+
+	invite, err := GetPairingInviteByCode(code)
+	if err != nil {
+		return invite, err
+	}
+	switch {
+	case invite.Status == InviteExpired:
+		return invite, ErrInviteExpired
+	case invite.Status != InvitePending:
+		return invite, ErrInviteNotPending
+	case invite.InviterID == inviteeID:
+		return invite, ErrOwnInvite
+	}
+
+	status := InviteDeclined
+	if accept {
+		status = InviteAccepted
+	}
+	now := time.Now()
+
+	// Recording the answer and creating the couple succeed or fail together
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		set := bson.M{"status": status, "invitee_id": inviteeID, "responded_at": now}
+		if accept {
+			coupleID, err := linkUsers(sc, invite.InviterID, inviteeID)
+			if err != nil {
+				return err
+			}
+			set["couple_id"] = coupleID
+			invite.CoupleID = &coupleID
+		}
+
+		result, err := collection.UpdateOne(
+			sc,
+			bson.M{"_id": invite.ID, "status": InvitePending, "expires_at": bson.M{"$gt": now}},
+			bson.M{"$set": set},
+		)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 0 {
+			return ErrInviteNotPending
+		}
+		return nil
+	})
+	if err != nil {
+		invite.CoupleID = nil
+		return invite, err
+	}
+
+	invite.Status = status
+	invite.InviteeID = &inviteeID
+	invite.RespondedAt = &now
+	if invite.CoupleID != nil {
+		publishCoupleChange(EntityCreated, *invite.CoupleID)
+	}
+	return invite, nil
+}
+
+// CancelPairingInvite cancels a pending invite created by the inviter
+func CancelPairingInvite(inviterID primitive.ObjectID, code string) error {
+	collection := config.GetDB().Collection("pairing_invites")
+	result, err := collection.UpdateOne(
+		context.TODO(),
+		bson.M{"code": NormalizeInviteCode(code), "inviter_id": inviterID, "status": InvitePending},
+		bson.M{"$set": bson.M{"status": InviteCancelled}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
@@ -6,6 +6,9 @@ import (
 
 	"github.com/KevinChaves65/Project_Boo/config"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // WordTheme represents different styling themes for words
@@ -43,8 +46,11 @@ func GetAllWordThemes() ([]WordTheme, error) {
 // SaveWordToBank saves a word with theme to couple's word bank
 func SaveWordToBank(wordBank WordBank) error {
 	collection := config.GetDB().Collection("word_bank")
-	_, err := collection.InsertOne(context.TODO(), wordBank)
-	return err
+	if _, err := collection.InsertOne(context.TODO(), wordBank); err != nil {
+		return err
+	}
+	publishWordBankChange(EntityCreated, wordBank.CoupleID, wordBank.ID, wordBank)
+	return nil
 }
 
 // GetWordBankByCoupleID retrieves all words for a couple
@@ -63,25 +69,50 @@ func GetWordBankByCoupleID(coupleID string) ([]WordBank, error) {
 	return wordBank, nil
 }
 
-// DeleteWordFromBank removes a word from couple's word bank
+// DeleteWordFromBank removes a word from couple's word bank.
+// Returns mongo.ErrNoDocuments if the word does not belong to the couple.
 func DeleteWordFromBank(coupleID string, wordID string) error {
 	collection := config.GetDB().Collection("word_bank")
-	_, err := collection.DeleteOne(context.TODO(), bson.M{
+	result, err := collection.DeleteOne(context.TODO(), bson.M{
 		"_id":       wordID,
 		"couple_id": coupleID,
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	publishWordBankChange(EntityDeleted, coupleID, wordID, nil)
+	return nil
 }
 
-// UpdateWordTheme updates the theme of a word in the word bank
+// UpdateWordTheme updates the theme of a word in the word bank.
+// Returns mongo.ErrNoDocuments if the word does not belong to the couple.
 func UpdateWordTheme(coupleID string, wordID string, newThemeID string) error {
 	collection := config.GetDB().Collection("word_bank")
-	_, err := collection.UpdateOne(
+	var word WordBank
+	err := collection.FindOneAndUpdate(
 		context.TODO(),
 		bson.M{"_id": wordID, "couple_id": coupleID},
 		bson.M{"$set": bson.M{"theme_id": newThemeID}},
-	)
-	return err
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&word)
+	if err != nil {
+		return err
+	}
+	publishWordBankChange(EntityUpdated, coupleID, wordID, word)
+	return nil
+}
+
+// publishWordBankChange publishes a word bank change; word bank entries keep
+// their couple ID as a hex string
+func publishWordBankChange(action EntityAction, coupleID, wordID string, word interface{}) {
+	id, err := primitive.ObjectIDFromHex(coupleID)
+	if err != nil {
+		return
+	}
+	publishChange(EntityWordBank, action, id, wordID, word)
 }
 
 // InitializeDefaultThemes creates default themes if they don't exist
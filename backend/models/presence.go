@@ -0,0 +1,133 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type PresenceState string
+
+const (
+	PresenceOnline  PresenceState = "online"
+	PresenceAway    PresenceState = "away"
+	PresenceOffline PresenceState = "offline"
+)
+
+// ConnectionPresence is the state one open connection reports for its user.
+// Each instance keeps refreshing ExpiresAt for its connections, so entries of
+// a crashed instance lapse on their own.
+type ConnectionPresence struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	Instance  string             `bson:"instance"`
+	State     PresenceState      `bson:"state"`
+	UpdatedAt time.Time          `bson:"updated_at"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+}
+
+// Presence is a user's state across all of their devices
+type Presence struct {
+	UserID     primitive.ObjectID `json:"user_id"`
+	State      PresenceState      `json:"state"`
+	LastSeenAt *time.Time         `json:"last_seen_at,omitempty"`
+	// LastSeenHidden is set when the user hides their last-seen time
+	LastSeenHidden bool `json:"-"`
+}
+
+// SetConnectionPresence records the state of one connection until ttl passes
+func SetConnectionPresence(connID, userID primitive.ObjectID, state PresenceState, ttl time.Duration) error {
+	collection := config.GetDB().Collection("presence")
+	now := time.Now()
+	_, err := collection.UpdateOne(
+		context.TODO(),
+		bson.M{"_id": connID},
+		bson.M{"$set": bson.M{
+			"user_id":    userID,
+			"instance":   config.InstanceID,
+			"state":      state,
+			"updated_at": now,
+			"expires_at": now.Add(ttl),
+		}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// RefreshConnectionPresence extends a connection's entry without changing its state
+func RefreshConnectionPresence(connID primitive.ObjectID, ttl time.Duration) error {
+	collection := config.GetDB().Collection("presence")
+	_, err := collection.UpdateOne(
+		context.TODO(),
+		bson.M{"_id": connID},
+		bson.M{"$set": bson.M{"expires_at": time.Now().Add(ttl)}},
+	)
+	return err
+}
+
+// DeleteConnectionPresence forgets a closed connection
+func DeleteConnectionPresence(connID primitive.ObjectID) error {
+	collection := config.GetDB().Collection("presence")
+	_, err := collection.DeleteOne(context.TODO(), bson.M{"_id": connID})
+	return err
+}
+
+// GetUserPresence combines the user's live connections: online on any device
+// wins over away, and no live connection means offline. The last-seen time is
+// left out when the user hides it.
+func GetUserPresence(userID primitive.ObjectID) (Presence, error) {
+	presence := Presence{UserID: userID, State: PresenceOffline}
+
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return presence, err
+	}
+	presence.LastSeenHidden = user.HideLastSeen
+	if !user.HideLastSeen {
+		presence.LastSeenAt = user.LastSeenAt
+	}
+
+	collection := config.GetDB().Collection("presence")
+	cursor, err := collection.Find(context.TODO(), bson.M{
+		"user_id":    userID,
+		"expires_at": bson.M{"$gt": time.Now()},
+	})
+	if err != nil {
+		return presence, err
+	}
+	var connections []ConnectionPresence
+	if err := cursor.All(context.TODO(), &connections); err != nil {
+		return presence, err
+	}
+
+	for _, connection := range connections {
+		if connection.State == PresenceOnline {
+			presence.State = PresenceOnline
+			break
+		}
+		presence.State = PresenceAway
+	}
+	return presence, nil
+}
+
+// UpdateLastSeen records when the user was last active
+func UpdateLastSeen(userID primitive.ObjectID, at time.Time) error {
+	collection := config.GetDB().Collection("users")
+	_, err := collection.UpdateOne(context.TODO(), bson.M{"_id": userID}, bson.M{"$set": bson.M{"last_seen_at": at}})
+	return err
+}
+
+// SetHideLastSeen turns the user's last-seen privacy setting on or off
+func SetHideLastSeen(userID primitive.ObjectID, hide bool) error {
+	collection := config.GetDB().Collection("users")
+	_, err := collection.UpdateOne(
+		context.TODO(),
+		bson.M{"_id": userID},
+		bson.M{"$set": bson.M{"hide_last_seen": hide, "updated_at": time.Now()}},
+	)
+	return err
+}
@@ -0,0 +1,123 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrReactionNotFound = errors.New("reaction not found")
+
+// Reaction is one user's emoji on a message. A user can react with several
+// emoji, but with each emoji only once.
+type Reaction struct {
+	ID        primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	MessageID primitive.ObjectID  `bson:"message_id" json:"message_id"`
+	CoupleID  *primitive.ObjectID `bson:"couple_id,omitempty" json:"couple_id,omitempty"`
+	UserID    primitive.ObjectID  `bson:"user_id" json:"user_id"`
+	Username  string              `bson:"username" json:"username"`
+	Emoji     string              `bson:"emoji" json:"emoji"`
+	CreatedAt time.Time           `bson:"created_at" json:"created_at"`
+}
+
+// ReactionSummary is the aggregated count of one emoji on a message
+type ReactionSummary struct {
+	Emoji string   `bson:"emoji" json:"emoji"`
+	Count int      `bson:"count" json:"count"`
+	Users []string `bson:"users" json:"users"`
+}
+
+// AddReaction records a reaction. Adding the same reaction again is a no-op,
+// reported by added being false.
+func AddReaction(reaction Reaction) (added bool, err error) {
+	collection := config.GetDB().Collection("message_reactions")
+	reaction.ID = primitive.NewObjectID()
+	reaction.CreatedAt = time.Now()
+
+	result, err := collection.UpdateOne(
+		context.TODO(),
+		bson.M{"message_id": reaction.MessageID, "user_id": reaction.UserID, "emoji": reaction.Emoji},
+		bson.M{"$setOnInsert": reaction},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		// Two concurrent upserts can race on the unique index; the reaction exists either way
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return result.UpsertedCount > 0, nil
+}
+
+// RemoveReaction removes a user's reaction with one emoji
+func RemoveReaction(messageID, userID primitive.ObjectID, emoji string) error {
+	collection := config.GetDB().Collection("message_reactions")
+	result, err := collection.DeleteOne(context.TODO(), bson.M{"message_id": messageID, "user_id": userID, "emoji": emoji})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrReactionNotFound
+	}
+	return nil
+}
+
+// DeleteMessageReactions removes every reaction on a message
+func DeleteMessageReactions(messageID primitive.ObjectID) error {
+	collection := config.GetDB().Collection("message_reactions")
+	_, err := collection.DeleteMany(context.TODO(), bson.M{"message_id": messageID})
+	return err
+}
+
+// GetReactionSummaries aggregates the reactions on the given messages, per emoji
+func GetReactionSummaries(messageIDs []primitive.ObjectID) (map[primitive.ObjectID][]ReactionSummary, error) {
+	summaries := make(map[primitive.ObjectID][]ReactionSummary)
+	if len(messageIDs) == 0 {
+		return summaries, nil
+	}
+
+	collection := config.GetDB().Collection("message_reactions")
+	cursor, err := collection.Aggregate(context.TODO(), mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"message_id": bson.M{"$in": messageIDs}}}},
+		{{Key: "$sort", Value: bson.M{"created_at": 1}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":        bson.M{"message_id": "$message_id", "emoji": "$emoji"},
+			"count":      bson.M{"$sum": 1},
+			"users":      bson.M{"$push": "$username"},
+			"first_used": bson.M{"$min": "$created_at"},
+		}}},
+		// Emoji keep the order they were first used in
+		{{Key: "$sort", Value: bson.M{"first_used": 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	for cursor.Next(context.TODO()) {
+		var row struct {
+			Key struct {
+				MessageID primitive.ObjectID `bson:"message_id"`
+				Emoji     string             `bson:"emoji"`
+			} `bson:"_id"`
+			Count int      `bson:"count"`
+			Users []string `bson:"users"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			return nil, err
+		}
+		summaries[row.Key.MessageID] = append(summaries[row.Key.MessageID], ReactionSummary{
+			Emoji: row.Key.Emoji,
+			Count: row.Count,
+			Users: row.Users,
+		})
+	}
+	return summaries, cursor.Err()
+}
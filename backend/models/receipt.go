@@ -0,0 +1,130 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type MessageStatus string
+
+const (
+	MessageSent      MessageStatus = "sent"
+	MessageDelivered MessageStatus = "delivered"
+	MessageRead      MessageStatus = "read"
+)
+
+// ReadReceipt describes the messages one read acknowledgement covered
+type ReadReceipt struct {
+	Senders  []primitive.ObjectID // senders whose messages changed state
+	Count    int64                // number of messages marked read
+	ReadAt   time.Time
+	Expiring []Message // messages whose expiry countdown started with this read
+}
+
+// MarkMessagesDelivered marks the receiver's messages among ids as delivered
+// and returns the messages that changed state
+func MarkMessagesDelivered(receiverID primitive.ObjectID, ids []primitive.ObjectID) ([]Message, error) {
+	collection := config.GetDB().Collection("messages")
+	filter := bson.M{"_id": bson.M{"$in": ids}, "receiver_id": receiverID, "status": MessageSent}
+
+	cursor, err := collection.Find(context.TODO(), filter)
+	if err != nil {
+		return nil, err
+	}
+	var messages []Message
+	if err := cursor.All(context.TODO(), &messages); err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	changed := make([]primitive.ObjectID, len(messages))
+	for i := range messages {
+		changed[i] = messages[i].ID
+		messages[i].Status = MessageDelivered
+		messages[i].DeliveredAt = &now
+	}
+	_, err = collection.UpdateMany(
+		context.TODO(),
+		bson.M{"_id": bson.M{"$in": changed}, "status": MessageSent},
+		bson.M{"$set": bson.M{"status": MessageDelivered, "delivered_at": now}},
+	)
+	fillParticipantNames(messages)
+	return messages, err
+}
+
+// MarkMessagesRead marks every message the receiver got up to and including
+// upTo as read. Messages skipped past without a delivery receipt get one too,
+// and messages that disappear after being read start their countdown.
+func MarkMessagesRead(receiverID, upTo primitive.ObjectID) (ReadReceipt, error) {
+	collection := config.GetDB().Collection("messages")
+	// Mongo stores milliseconds, so match what the expiring messages are found by below
+	receipt := ReadReceipt{ReadAt: time.Now().Truncate(time.Millisecond)}
+	filter := bson.M{
+		"receiver_id": receiverID,
+		"_id":         bson.M{"$lte": upTo},
+		"status":      bson.M{"$in": []MessageStatus{MessageSent, MessageDelivered}},
+	}
+
+	senders, err := collection.Distinct(context.TODO(), "sender_id", filter)
+	if err != nil {
+		return receipt, err
+	}
+	for _, sender := range senders {
+		if id, ok := sender.(primitive.ObjectID); ok {
+			receipt.Senders = append(receipt.Senders, id)
+		}
+	}
+	if len(receipt.Senders) == 0 {
+		return receipt, nil
+	}
+
+	result, err := collection.UpdateMany(context.TODO(), filter, mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"status":       MessageRead,
+			"read_at":      receipt.ReadAt,
+			"delivered_at": bson.M{"$ifNull": bson.A{"$delivered_at", receipt.ReadAt}},
+			// The earlier of the send expiry and read time plus expire_after_read
+			"expires_at": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{"$expire_after_read", 0}},
+				bson.M{"$min": bson.A{
+					"$expires_at",
+					bson.M{"$add": bson.A{receipt.ReadAt, bson.M{"$multiply": bson.A{"$expire_after_read", 1000}}}},
+				}},
+				"$expires_at",
+			}},
+		}}},
+	})
+	if err != nil {
+		return receipt, err
+	}
+	receipt.Count = result.ModifiedCount
+
+	cursor, err := collection.Find(context.TODO(), bson.M{
+		"receiver_id":       receiverID,
+		"_id":               bson.M{"$lte": upTo},
+		"read_at":           receipt.ReadAt,
+		"expire_after_read": bson.M{"$gt": 0},
+	})
+	if err != nil {
+		return receipt, err
+	}
+	err = cursor.All(context.TODO(), &receipt.Expiring)
+	return receipt, err
+}
+
+// CountUnreadMessages counts the messages a user has received but not read
+func CountUnreadMessages(receiverID primitive.ObjectID) (int64, error) {
+	collection := config.GetDB().Collection("messages")
+	return collection.CountDocuments(context.TODO(), bson.M{
+		"receiver_id": receiverID,
+		"status":      bson.M{"$in": []MessageStatus{MessageSent, MessageDelivered}},
+	})
+}
@@ -1,11 +1,19 @@
 package models
 
 import (
+	"context"
+	"errors"
+	"log"
 	"time"
 
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
+var ErrSuggestionAlreadySaved = errors.New("suggestion already saved")
+
 type SavedSuggestion struct {
 	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
 	CoupleID      primitive.ObjectID `json:"couple_id" bson:"couple_id"`
@@ -22,3 +30,99 @@ type SavedSuggestion struct {
 	CreatedAt     time.Time          `json:"created_at" bson:"created_at"`
 	UpdatedAt     time.Time          `json:"updated_at" bson:"updated_at"`
 }
+
+// SaveSuggestion stores a suggestion for the couple unless one with the same
+// title is already saved. The unique index on couple and title decides, so two
+// partners saving the same suggestion at once still store it only once.
+func SaveSuggestion(suggestion SavedSuggestion) (SavedSuggestion, error) {
+	collection := config.GetDB().Collection("saved_suggestions")
+	now := time.Now()
+	suggestion.ID = primitive.NewObjectID()
+	suggestion.SavedAt = now
+	suggestion.CreatedAt = now
+	suggestion.UpdatedAt = now
+	if _, err := collection.InsertOne(context.TODO(), suggestion); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return suggestion, ErrSuggestionAlreadySaved
+		}
+		return suggestion, err
+	}
+	publishChange(EntitySavedSuggestion, EntityCreated, suggestion.CoupleID, suggestion.ID.Hex(), suggestion)
+	return suggestion, nil
+}
+
+// GetSavedSuggestions retrieves all saved suggestions for a couple
+func GetSavedSuggestions(coupleID primitive.ObjectID) ([]SavedSuggestion, error) {
+	collection := config.GetDB().Collection("saved_suggestions")
+	cursor, err := collection.Find(context.TODO(), bson.M{"couple_id": coupleID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	var suggestions []SavedSuggestion
+	if err := cursor.All(context.TODO(), &suggestions); err != nil {
+		return nil, err
+	}
+	return suggestions, nil
+}
+
+// FindSavedSuggestion looks up the couple's saved suggestion with the given title
+func FindSavedSuggestion(coupleID primitive.ObjectID, title string) (SavedSuggestion, error) {
+	collection := config.GetDB().Collection("saved_suggestions")
+	var suggestion SavedSuggestion
+	err := collection.FindOne(context.TODO(), bson.M{"couple_id": coupleID, "title": title}).Decode(&suggestion)
+	return suggestion, err
+}
+
+// DeleteSavedSuggestion removes a saved suggestion of the couple.
+// Returns mongo.ErrNoDocuments if the suggestion does not belong to the couple.
+func DeleteSavedSuggestion(coupleID, id primitive.ObjectID) error {
+	collection := config.GetDB().Collection("saved_suggestions")
+	result, err := collection.DeleteOne(context.TODO(), bson.M{"_id": id, "couple_id": coupleID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	publishChange(EntitySavedSuggestion, EntityDeleted, coupleID, id.Hex(), nil)
+	return nil
+}
+
+// RemoveDuplicateSavedSuggestions keeps only the earliest of suggestions a
+// couple saved more than once, which the unique index on couple and title
+// does not allow. It runs before the indexes are created.
+func RemoveDuplicateSavedSuggestions() error {
+	collection := config.GetDB().Collection("saved_suggestions")
+	cursor, err := collection.Aggregate(context.TODO(), mongo.Pipeline{
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{"couple_id": "$couple_id", "title": "$title"},
+			"ids": bson.M{"$push": "$_id"},
+		}}},
+		{{Key: "$match", Value: bson.M{"ids.1": bson.M{"$exists": true}}}},
+	})
+	if err != nil {
+		return err
+	}
+	var duplicates []struct {
+		IDs []primitive.ObjectID `bson:"ids"`
+	}
+	if err := cursor.All(context.TODO(), &duplicates); err != nil {
+		return err
+	}
+
+	var removed int64
+	for _, duplicate := range duplicates {
+		result, err := collection.DeleteMany(context.TODO(), bson.M{"_id": bson.M{"$in": duplicate.IDs[1:]}})
+		if err != nil {
+			return err
+		}
+		removed += result.DeletedCount
+	}
+	if removed > 0 {
+		log.Printf("Removed %d duplicate saved suggestions", removed)
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestSaveSuggestionReportsDuplicate(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("saved by the partner meanwhile", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key"}))
+		_, err := SaveSuggestion(SavedSuggestion{CoupleID: primitive.NewObjectID(), Title: "Picnic"})
+		if !errors.Is(err, ErrSuggestionAlreadySaved) {
+			mt.Fatalf("got %v, want ErrSuggestionAlreadySaved", err)
+		}
+	})
+}
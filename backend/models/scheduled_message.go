@@ -0,0 +1,232 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type ScheduledStatus string
+
+const (
+	ScheduledPending   ScheduledStatus = "pending"
+	ScheduledSent      ScheduledStatus = "sent"
+	ScheduledCancelled ScheduledStatus = "cancelled"
+	ScheduledFailed    ScheduledStatus = "failed"
+)
+
+var (
+	ErrScheduledMessageNotFound   = errors.New("scheduled message not found")
+	ErrScheduledMessageSending    = errors.New("scheduled message is being sent")
+	ErrScheduledMessageNotPending = errors.New("scheduled message is no longer pending")
+)
+
+// ScheduledMessage is a chat message written now and sent at SendAt. Its
+// MessageID is assigned on the first delivery attempt, so the message sorts
+// by when it was sent, and kept for retries, so a delivery retried after a
+// crash can never store the message twice.
+type ScheduledMessage struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	CoupleID   primitive.ObjectID `bson:"couple_id" json:"couple_id"`
+	SenderID   primitive.ObjectID `bson:"sender_id" json:"sender_id"`
+	MessageID  primitive.ObjectID `bson:"message_id,omitempty" json:"message_id,omitempty"`
+	Content    string             `bson:"content" json:"content"` // Encrypted at rest
+	SendAt     time.Time          `bson:"send_at" json:"send_at"`
+	Timezone   string             `bson:"timezone" json:"timezone"` // IANA name the sender scheduled in
+	Status     ScheduledStatus    `bson:"status" json:"status"`
+	Attempts   int                `bson:"attempts" json:"attempts"`
+	Owner      string             `bson:"owner,omitempty" json:"-"`
+	LeaseUntil *time.Time         `bson:"lease_until,omitempty" json:"-"`
+	RetryAt    *time.Time         `bson:"retry_at,omitempty" json:"retry_at,omitempty"`
+	LastError  string             `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	SentAt     *time.Time         `bson:"sent_at,omitempty" json:"sent_at,omitempty"`
+
+	LocalSendAt string `bson:"-" json:"local_send_at,omitempty"` // SendAt in Timezone
+}
+
+// unleased matches scheduled messages no scheduler is working on
+func unleased(now time.Time) bson.M {
+	return bson.M{"$or": []bson.M{
+		{"lease_until": bson.M{"$exists": false}},
+		{"lease_until": bson.M{"$lte": now}},
+	}}
+}
+
+// CreateScheduledMessage queues a message for later delivery
+func CreateScheduledMessage(scheduled ScheduledMessage) (ScheduledMessage, error) {
+	collection := config.GetDB().Collection("scheduled_messages")
+	scheduled.ID = primitive.NewObjectID()
+	scheduled.MessageID = primitive.NilObjectID
+	scheduled.Status = ScheduledPending
+	scheduled.CreatedAt = time.Now()
+	_, err := collection.InsertOne(context.TODO(), scheduled)
+	return scheduled, err
+}
+
+// CountPendingScheduledMessages counts the sender's messages still waiting to be sent
+func CountPendingScheduledMessages(senderID primitive.ObjectID) (int64, error) {
+	collection := config.GetDB().Collection("scheduled_messages")
+	return collection.CountDocuments(context.TODO(), bson.M{"sender_id": senderID, "status": ScheduledPending})
+}
+
+// GetScheduledMessages lists the sender's pending and failed messages, soonest first
+func GetScheduledMessages(senderID primitive.ObjectID) ([]ScheduledMessage, error) {
+	collection := config.GetDB().Collection("scheduled_messages")
+	cursor, err := collection.Find(
+		context.TODO(),
+		bson.M{"sender_id": senderID, "status": bson.M{"$in": []ScheduledStatus{ScheduledPending, ScheduledFailed}}},
+		options.Find().SetSort(bson.M{"send_at": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	scheduled := []ScheduledMessage{}
+	if err := cursor.All(context.TODO(), &scheduled); err != nil {
+		return nil, err
+	}
+	return scheduled, nil
+}
+
+// CancelScheduledMessage cancels one of the sender's pending messages, or
+// clears one that failed to send. A message a scheduler is delivering right
+// now can no longer be cancelled.
+func CancelScheduledMessage(id, senderID primitive.ObjectID) error {
+	collection := config.GetDB().Collection("scheduled_messages")
+	now := time.Now()
+	filter := unleased(now)
+	filter["_id"] = id
+	filter["sender_id"] = senderID
+	filter["status"] = ScheduledPending
+
+	result, err := collection.UpdateOne(context.TODO(), filter, bson.M{"$set": bson.M{"status": ScheduledCancelled}})
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount > 0 {
+		return nil
+	}
+
+	deleted, err := collection.DeleteOne(context.TODO(), bson.M{"_id": id, "sender_id": senderID, "status": ScheduledFailed})
+	if err != nil {
+		return err
+	}
+	if deleted.DeletedCount > 0 {
+		return nil
+	}
+
+	var existing ScheduledMessage
+	err = collection.FindOne(context.TODO(), bson.M{"_id": id, "sender_id": senderID}).Decode(&existing)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrScheduledMessageNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if existing.Status == ScheduledPending {
+		return ErrScheduledMessageSending
+	}
+	return ErrScheduledMessageNotPending
+}
+
+// ClaimDueScheduledMessage leases the earliest due message to owner. The
+// first attempt allocates the ID the message is stored under; an ID from
+// before the first attempt, which older versions assigned when scheduling, is
+// replaced. It returns mongo.ErrNoDocuments when nothing is due.
+func ClaimDueScheduledMessage(owner string, lease time.Duration) (ScheduledMessage, error) {
+	collection := config.GetDB().Collection("scheduled_messages")
+	now := time.Now()
+	filter := bson.M{
+		"status":  ScheduledPending,
+		"send_at": bson.M{"$lte": now},
+		"$and": []bson.M{
+			unleased(now),
+			{"$or": []bson.M{
+				{"retry_at": bson.M{"$exists": false}},
+				{"retry_at": bson.M{"$lte": now}},
+			}},
+		},
+	}
+
+	// Every expression in the stage sees the document before the update
+	attempted := bson.M{"$gt": bson.A{bson.M{"$ifNull": bson.A{"$attempts", 0}}, 0}}
+	var scheduled ScheduledMessage
+	err := collection.FindOneAndUpdate(
+		context.TODO(),
+		filter,
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"owner":       owner,
+			"lease_until": now.Add(lease),
+			"message_id":  bson.M{"$cond": bson.A{attempted, "$message_id", primitive.NewObjectID()}},
+			"attempts":    bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$attempts", 0}}, 1}},
+		}}}},
+		options.FindOneAndUpdate().SetSort(bson.M{"send_at": 1}).SetReturnDocument(options.After),
+	).Decode(&scheduled)
+	return scheduled, err
+}
+
+// FinishScheduledMessage records the outcome of a delivery the owner leased
+func FinishScheduledMessage(id primitive.ObjectID, owner string, status ScheduledStatus, lastError string) error {
+	collection := config.GetDB().Collection("scheduled_messages")
+	set := bson.M{"status": status}
+	if status == ScheduledSent {
+		set["sent_at"] = time.Now()
+	}
+	if lastError != "" {
+		set["last_error"] = lastError
+	}
+	_, err := collection.UpdateOne(
+		context.TODO(),
+		bson.M{"_id": id, "owner": owner},
+		bson.M{"$set": set, "$unset": bson.M{"owner": "", "lease_until": "", "retry_at": ""}},
+	)
+	return err
+}
+
+// RetryScheduledMessage keeps a failed delivery pending; it becomes due again
+// once retryAt passes
+func RetryScheduledMessage(id primitive.ObjectID, owner string, retryAt time.Time, lastError string) error {
+	collection := config.GetDB().Collection("scheduled_messages")
+	_, err := collection.UpdateOne(
+		context.TODO(),
+		bson.M{"_id": id, "owner": owner},
+		bson.M{
+			"$set":   bson.M{"retry_at": retryAt, "last_error": lastError},
+			"$unset": bson.M{"owner": "", "lease_until": ""},
+		},
+	)
+	return err
+}
+
+// GetScheduledMessagesAfter returns up to limit scheduled messages after the
+// given ID, oldest first, for jobs that walk the whole collection
+func GetScheduledMessagesAfter(after primitive.ObjectID, limit int) ([]ScheduledMessage, error) {
+	collection := config.GetDB().Collection("scheduled_messages")
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := collection.Find(context.TODO(), bson.M{"_id": bson.M{"$gt": after}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var scheduled []ScheduledMessage
+	if err := cursor.All(context.TODO(), &scheduled); err != nil {
+		return nil, err
+	}
+	return scheduled, nil
+}
+
+// ReplaceScheduledMessageContent swaps in re-encrypted content if it is still
+// oldContent; replaced reports whether it applied
+func ReplaceScheduledMessageContent(id primitive.ObjectID, oldContent, content string) (replaced bool, err error) {
+	collection := config.GetDB().Collection("scheduled_messages")
+	result, err := collection.UpdateOne(context.TODO(), bson.M{"_id": id, "content": oldContent}, bson.M{"$set": bson.M{"content": content}})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
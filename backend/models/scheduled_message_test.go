@@ -0,0 +1,77 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestCancelScheduledMessage(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	id, senderID := primitive.NewObjectID(), primitive.NewObjectID()
+
+	mt.Run("clears a failed message", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+		if err := CancelScheduledMessage(id, senderID); err != nil {
+			mt.Fatal(err)
+		}
+	})
+
+	mt.Run("a sent message stays", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}),
+			mtest.CreateCursorResponse(0, "db.scheduled_messages", mtest.FirstBatch, bson.D{
+				{Key: "_id", Value: id},
+				{Key: "sender_id", Value: senderID},
+				{Key: "status", Value: ScheduledSent},
+			}),
+		)
+		if err := CancelScheduledMessage(id, senderID); !errors.Is(err, ErrScheduledMessageNotPending) {
+			mt.Fatalf("got %v, want ErrScheduledMessageNotPending", err)
+		}
+	})
+}
+
+func TestScheduledMessageIDIsAllocatedOnFirstAttempt(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("scheduling leaves the message ID unset", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		scheduled, err := CreateScheduledMessage(ScheduledMessage{MessageID: primitive.NewObjectID()})
+		if err != nil {
+			mt.Fatal(err)
+		}
+		inserted := mt.GetStartedEvent().Command.Lookup("documents").Array().Index(0).Value().Document()
+		if _, err := inserted.LookupErr("message_id"); err == nil || !scheduled.MessageID.IsZero() {
+			mt.Fatalf("message ID assigned when scheduling: %s", inserted)
+		}
+	})
+
+	mt.Run("claiming keeps the ID of an earlier attempt", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{{Key: "_id", Value: primitive.NewObjectID()}}}))
+		if _, err := ClaimDueScheduledMessage("instance", time.Minute); err != nil {
+			mt.Fatal(err)
+		}
+		update := mt.GetStartedEvent().Command.Lookup("update").Array().Index(0).Value().Document()
+		cond := update.Lookup("$set", "message_id", "$cond").Array()
+		if kept := cond.Index(1).Value().StringValue(); kept != "$message_id" {
+			mt.Fatalf("retries do not keep the message ID: %s", update)
+		}
+		if fresh := cond.Index(2).Value().ObjectID(); time.Since(fresh.Timestamp()) > time.Minute {
+			mt.Fatalf("first attempt uses a pre-dated ID %s", fresh.Hex())
+		}
+	})
+}
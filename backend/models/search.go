@@ -0,0 +1,152 @@
+package models
+
+import (
+	"context"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SearchTokenScheme is how the current blind tokens are derived. Entries built
+// with an older scheme count as unindexed, so the backfill rebuilds them.
+// 1 used one key for all couples, 2 derives a key per couple.
+const SearchTokenScheme = 2
+
+// SearchEntry holds the blind tokens of one message. It shares the message's
+// ID, so a message has at most one entry.
+type SearchEntry struct {
+	MessageID primitive.ObjectID `bson:"_id"`
+	CoupleID  primitive.ObjectID `bson:"couple_id"`
+	Timestamp int64              `bson:"timestamp"`
+	Tokens    []string           `bson:"tokens"`
+	Scheme    int                `bson:"scheme"`
+}
+
+// SearchFilter selects candidate messages for a search
+type SearchFilter struct {
+	CoupleID primitive.ObjectID
+	Tokens   []string            // every token must be present
+	From     *int64              // unix time, inclusive
+	To       *int64              // unix time, inclusive
+	Before   *primitive.ObjectID // only messages older than this ID
+	Limit    int
+}
+
+// IndexMessage stores or replaces the search entry of a message
+func IndexMessage(entry SearchEntry) error {
+	collection := config.GetDB().Collection("search_tokens")
+	entry.Scheme = SearchTokenScheme
+	_, err := collection.ReplaceOne(
+		context.TODO(),
+		bson.M{"_id": entry.MessageID},
+		entry,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+// RemoveMessageIndex drops the search entry of a message
+func RemoveMessageIndex(messageID primitive.ObjectID) error {
+	collection := config.GetDB().Collection("search_tokens")
+	_, err := collection.DeleteOne(context.TODO(), bson.M{"_id": messageID})
+	return err
+}
+
+// FindSearchCandidates returns the IDs of messages whose entries hold every
+// token, newest first. Candidates still have to be checked against the
+// decrypted content.
+func FindSearchCandidates(filter SearchFilter) ([]primitive.ObjectID, error) {
+	collection := config.GetDB().Collection("search_tokens")
+	query := bson.M{"couple_id": filter.CoupleID, "tokens": bson.M{"$all": filter.Tokens}}
+	if filter.From != nil || filter.To != nil {
+		timestamp := bson.M{}
+		if filter.From != nil {
+			timestamp["$gte"] = *filter.From
+		}
+		if filter.To != nil {
+			timestamp["$lte"] = *filter.To
+		}
+		query["timestamp"] = timestamp
+	}
+	if filter.Before != nil {
+		query["_id"] = bson.M{"$lt": *filter.Before}
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: -1}}).
+		SetLimit(int64(filter.Limit)).
+		SetProjection(bson.M{"_id": 1})
+	cursor, err := collection.Find(context.TODO(), query, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []SearchEntry
+	if err := cursor.All(context.TODO(), &entries); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.MessageID
+	}
+	return ids, nil
+}
+
+// GetUnindexedMessages returns up to limit couple messages after the given ID
+// that have no search entry of the current scheme yet, oldest first
+func GetUnindexedMessages(after primitive.ObjectID, limit int) ([]Message, primitive.ObjectID, error) {
+	collection := config.GetDB().Collection("messages")
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := collection.Find(context.TODO(), bson.M{
+		"_id":       bson.M{"$gt": after},
+		"couple_id": bson.M{"$exists": true},
+		"deleted":   bson.M{"$ne": true},
+	}, opts)
+	if err != nil {
+		return nil, after, err
+	}
+	var messages []Message
+	if err := cursor.All(context.TODO(), &messages); err != nil {
+		return nil, after, err
+	}
+	if len(messages) == 0 {
+		return nil, after, nil
+	}
+	last := messages[len(messages)-1].ID
+
+	ids := make([]primitive.ObjectID, len(messages))
+	for i, message := range messages {
+		ids[i] = message.ID
+	}
+	indexed, err := config.GetDB().Collection("search_tokens").Distinct(context.TODO(), "_id", bson.M{
+		"_id":    bson.M{"$in": ids},
+		"scheme": SearchTokenScheme,
+	})
+	if err != nil {
+		return nil, after, err
+	}
+	seen := make(map[primitive.ObjectID]bool, len(indexed))
+	for _, id := range indexed {
+		if oid, ok := id.(primitive.ObjectID); ok {
+			seen[oid] = true
+		}
+	}
+
+	var unindexed []Message
+	for _, message := range messages {
+		if !seen[message.ID] {
+			unindexed = append(unindexed, message)
+		}
+	}
+	return unindexed, last, nil
+}
+
+// RemoveCoupleSearchIndex drops a couple's search entries, e.g. when search is
+// turned off by end-to-end encryption
+func RemoveCoupleSearchIndex(coupleID primitive.ObjectID) error {
+	collection := config.GetDB().Collection("search_tokens")
+	_, err := collection.DeleteMany(context.TODO(), bson.M{"couple_id": coupleID})
+	return err
+}
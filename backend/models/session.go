@@ -0,0 +1,163 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"github.com/KevinChaves65/Project_Boo/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+// maxRotatedHashes bounds how many previous refresh token hashes are kept for reuse detection
+const maxRotatedHashes = 20
+
+// Session is a login on one device. Access tokens carry the session ID so the
+// session can be revoked server-side before the token itself expires.
+type Session struct {
+	ID               primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID           primitive.ObjectID `bson:"user_id" json:"user_id"`
+	RefreshTokenHash string             `bson:"refresh_token_hash" json:"-"`
+	RotatedHashes    []string           `bson:"rotated_hashes,omitempty" json:"-"`
+	UserAgent        string             `bson:"user_agent" json:"user_agent"`
+	IPAddress        string             `bson:"ip_address" json:"ip_address"`
+	CreatedAt        time.Time          `bson:"created_at" json:"created_at"`
+	LastUsedAt       time.Time          `bson:"last_used_at" json:"last_used_at"`
+	ExpiresAt        time.Time          `bson:"expires_at" json:"expires_at"`
+	RevokedAt        *time.Time         `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+// CreateSession stores a new session for the user with the given refresh token hash
+func CreateSession(userID primitive.ObjectID, refreshTokenHash, userAgent, ipAddress string) (Session, error) {
+	collection := config.GetDB().Collection("sessions")
+	now := time.Now()
+	session := Session{
+		ID:               primitive.NewObjectID(),
+		UserID:           userID,
+		RefreshTokenHash: refreshTokenHash,
+		UserAgent:        userAgent,
+		IPAddress:        ipAddress,
+		CreatedAt:        now,
+		LastUsedAt:       now,
+		ExpiresAt:        now.Add(utils.RefreshTokenTTL),
+	}
+	_, err := collection.InsertOne(context.TODO(), session)
+	return session, err
+}
+
+// GetActiveSession retrieves a session that is neither revoked nor expired
+func GetActiveSession(sessionID primitive.ObjectID) (Session, error) {
+	collection := config.GetDB().Collection("sessions")
+	var session Session
+	err := collection.FindOne(context.TODO(), bson.M{
+		"_id":        sessionID,
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&session)
+	return session, err
+}
+
+// GetUserSessions lists the active sessions of a user
+func GetUserSessions(userID primitive.ObjectID) ([]Session, error) {
+	collection := config.GetDB().Collection("sessions")
+	cursor, err := collection.Find(context.TODO(), bson.M{
+		"user_id":    userID,
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": time.Now()},
+	}, options.Find().SetSort(bson.M{"last_used_at": -1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	var sessions []Session
+	if err := cursor.All(context.TODO(), &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// RotateRefreshToken swaps the refresh token of a session for a new one.
+// Presenting a refresh token that was already rotated away revokes the whole
+// session, since it means the token has been copied.
+func RotateRefreshToken(oldHash, newHash string) (Session, error) {
+	collection := config.GetDB().Collection("sessions")
+	now := time.Now()
+
+	filter := bson.M{
+		"refresh_token_hash": oldHash,
+		"revoked_at":         bson.M{"$exists": false},
+		"expires_at":         bson.M{"$gt": now},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"refresh_token_hash": newHash,
+			"last_used_at":       now,
+			"expires_at":         now.Add(utils.RefreshTokenTTL),
+		},
+		"$push": bson.M{
+			"rotated_hashes": bson.M{"$each": []string{oldHash}, "$slice": -maxRotatedHashes},
+		},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var session Session
+	err := collection.FindOneAndUpdate(context.TODO(), filter, update, opts).Decode(&session)
+	if err == nil {
+		return session, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return session, err
+	}
+
+	// Check whether the token was already used once
+	var reused Session
+	if err := collection.FindOne(context.TODO(), bson.M{"rotated_hashes": oldHash}).Decode(&reused); err == nil {
+		if err := RevokeSession(reused.UserID, reused.ID); err != nil {
+			return session, err
+		}
+		return session, ErrRefreshTokenReused
+	}
+
+	return session, ErrInvalidRefreshToken
+}
+
+// RevokeSession revokes one session belonging to the user
+func RevokeSession(userID, sessionID primitive.ObjectID) error {
+	collection := config.GetDB().Collection("sessions")
+	_, err := collection.UpdateOne(
+		context.TODO(),
+		bson.M{"_id": sessionID, "user_id": userID, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+	return err
+}
+
+// RevokeAllSessions revokes every session of the user and returns how many were revoked
+func RevokeAllSessions(userID primitive.ObjectID) (int64, error) {
+	return revokeSessions(bson.M{"user_id": userID})
+}
+
+// RevokeOtherSessions revokes every session of the user except the given one
+func RevokeOtherSessions(userID, keepSessionID primitive.ObjectID) (int64, error) {
+	return revokeSessions(bson.M{"user_id": userID, "_id": bson.M{"$ne": keepSessionID}})
+}
+
+func revokeSessions(filter bson.M) (int64, error) {
+	collection := config.GetDB().Collection("sessions")
+	filter["revoked_at"] = bson.M{"$exists": false}
+	result, err := collection.UpdateMany(context.TODO(), filter, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"context"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// withTransaction runs fn in a multi-document transaction, retrying on
+// transient errors. Transactions need MongoDB running as a replica set.
+func withTransaction(fn func(sc mongo.SessionContext) error) error {
+	session, err := config.GetDB().Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.TODO())
+
+	_, err = session.WithTransaction(context.TODO(), func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
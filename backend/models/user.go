@@ -12,17 +12,19 @@ import (
 )
 
 type User struct {
-	ID          primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
-	Username    string              `bson:"username" json:"username"`
-	Password    string              `bson:"password,omitempty" json:"-"`
-	Email       string              `bson:"email" json:"email"`
-	PhoneNumber string              `bson:"phone_number" json:"phone_number"`
-	Gender      string              `bson:"gender" json:"gender"`
-	FullName    string              `bson:"full_name" json:"full_name"`
-	Birthday    string              `bson:"birthday" json:"birthday"` // Format: YYYY-MM-DD
-	CoupleID    *primitive.ObjectID `bson:"couple_id,omitempty" json:"couple_id"`
-	CreatedAt   time.Time           `bson:"created_at" json:"created_at"`
-	UpdatedAt   time.Time           `bson:"updated_at" json:"updated_at"`
+	ID           primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	Username     string              `bson:"username" json:"username"`
+	Password     string              `bson:"password,omitempty" json:"-"`
+	Email        string              `bson:"email" json:"email"`
+	PhoneNumber  string              `bson:"phone_number" json:"phone_number"`
+	Gender       string              `bson:"gender" json:"gender"`
+	FullName     string              `bson:"full_name" json:"full_name"`
+	Birthday     string              `bson:"birthday" json:"birthday"` // Format: YYYY-MM-DD
+	CoupleID     *primitive.ObjectID `bson:"couple_id,omitempty" json:"couple_id"`
+	LastSeenAt   *time.Time          `bson:"last_seen_at,omitempty" json:"last_seen_at,omitempty"`
+	HideLastSeen bool                `bson:"hide_last_seen,omitempty" json:"hide_last_seen"` // Keep last seen from the partner
+	CreatedAt    time.Time           `bson:"created_at" json:"created_at"`
+	UpdatedAt    time.Time           `bson:"updated_at" json:"updated_at"`
 }
 
 type Login struct {
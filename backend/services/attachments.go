@@ -0,0 +1,276 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/KevinChaves65/Project_Boo/storage"
+	"github.com/KevinChaves65/Project_Boo/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/image/draw"
+
+	// Decoders for the image formats accepted as attachments; JPEG comes with image/jpeg
+	_ "golang.org/x/image/webp"
+	_ "image/gif"
+	_ "image/png"
+)
+
+const (
+	// MaxAttachmentSize is the largest file accepted for upload
+	MaxAttachmentSize = 10 << 20
+	// MaxAttachmentsPerMessage caps how many attachments one message can carry
+	MaxAttachmentsPerMessage = 10
+	// thumbnailSize is the longest side of a generated thumbnail, in pixels
+	thumbnailSize = 320
+	// attachmentURLTTL is how long a signed download link stays valid
+	attachmentURLTTL = 15 * time.Minute
+	// maxImagePixels caps the decoded size of an image, since a small file can
+	// describe a huge one
+	maxImagePixels = 40_000_000
+	// unsentAttachmentTTL is how long an upload may wait to be sent before it is deleted
+	unsentAttachmentTTL = 24 * time.Hour
+)
+
+var (
+	ErrAttachmentTooLarge    = errors.New("attachment is too large")
+	ErrUnsupportedAttachment = errors.New("attachment type is not supported")
+	ErrTooManyAttachments    = errors.New("too many attachments")
+	ErrImageTooLarge         = errors.New("image dimensions are too large")
+)
+
+// attachmentType is how a sniffed content type is stored and served
+type attachmentType struct {
+	kind        models.AttachmentKind
+	contentType string
+}
+
+// attachmentTypes lists the accepted types, keyed by what http.DetectContentType
+// reports. Browsers record voice notes as WebM or MP4, which sniff as video.
+var attachmentTypes = map[string]attachmentType{
+	"image/jpeg":      {models.AttachmentImage, "image/jpeg"},
+	"image/png":       {models.AttachmentImage, "image/png"},
+	"image/gif":       {models.AttachmentImage, "image/gif"},
+	"image/webp":      {models.AttachmentImage, "image/webp"},
+	"audio/mpeg":      {models.AttachmentVoice, "audio/mpeg"},
+	"application/ogg": {models.AttachmentVoice, "audio/ogg"},
+	"audio/wave":      {models.AttachmentVoice, "audio/wav"},
+	"video/webm":      {models.AttachmentVoice, "audio/webm"},
+	"video/mp4":       {models.AttachmentVoice, "audio/mp4"},
+}
+
+// UploadAttachment checks, encrypts and stores an uploaded file for the
+// principal's couple. The type is sniffed from the content, never taken from
+// the client.
+func UploadAttachment(principal *middlewares.Principal, data []byte) (models.Attachment, error) {
+	if len(data) > MaxAttachmentSize {
+		return models.Attachment{}, ErrAttachmentTooLarge
+	}
+	// Sniffing and thumbnails need the plaintext, which an end-to-end couple never shares
+	e2e, err := coupleUsesE2E(principal.CoupleID)
+	if err != nil {
+		return models.Attachment{}, err
+	}
+	if e2e {
+		return models.Attachment{}, ErrE2EUnavailable
+	}
+	detected, ok := attachmentTypes[http.DetectContentType(data)]
+	if !ok {
+		return models.Attachment{}, ErrUnsupportedAttachment
+	}
+
+	attachment := models.Attachment{
+		ID:          primitive.NewObjectID(),
+		CoupleID:    *principal.CoupleID,
+		UploaderID:  principal.UserID,
+		Kind:        detected.kind,
+		ContentType: detected.contentType,
+		Size:        int64(len(data)),
+	}
+	attachment.StorageKey = fmt.Sprintf("attachments/%s/%s", attachment.CoupleID.Hex(), attachment.ID.Hex())
+
+	if attachment.Kind == models.AttachmentImage {
+		img, err := decodeImage(data)
+		if err != nil {
+			return attachment, err
+		}
+		attachment.Width = img.Bounds().Dx()
+		attachment.Height = img.Bounds().Dy()
+
+		thumbnail, err := makeThumbnail(img)
+		if err != nil {
+			return attachment, err
+		}
+		attachment.ThumbnailKey = attachment.StorageKey + "_thumb"
+		if err := putEncrypted(attachment.ThumbnailKey, thumbnail); err != nil {
+			return attachment, err
+		}
+	}
+
+	if err := putEncrypted(attachment.StorageKey, data); err != nil {
+		return attachment, err
+	}
+
+	attachment, err = models.CreateAttachment(attachment)
+	if err != nil {
+		return attachment, err
+	}
+	SignAttachment(&attachment)
+	return attachment, nil
+}
+
+// decodeImage decodes an uploaded image, checking its dimensions from the
+// header before any pixels are allocated
+func decodeImage(data []byte) (image.Image, error) {
+	header, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedAttachment
+	}
+	if header.Width <= 0 || header.Height <= 0 {
+		return nil, ErrUnsupportedAttachment
+	}
+	if int64(header.Width)*int64(header.Height) > maxImagePixels {
+		return nil, ErrImageTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedAttachment
+	}
+	return img, nil
+}
+
+// RunAttachmentCleanup deletes uploads that were never sent in a message once
+// they are older than unsentAttachmentTTL
+func RunAttachmentCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		deleted, err := models.DeleteUnclaimedAttachments(time.Now().Add(-unsentAttachmentTTL))
+		if err != nil {
+			log.Printf("Failed to delete unsent attachments: %v", err)
+		}
+		if deleted > 0 {
+			log.Printf("Deleted %d unsent attachments", deleted)
+		}
+	}
+}
+
+// makeThumbnail scales an image down to fit thumbnailSize and encodes it as JPEG
+func makeThumbnail(img image.Image) ([]byte, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > thumbnailSize || height > thumbnailSize {
+		if width >= height {
+			height = max(1, height*thumbnailSize/width)
+			width = thumbnailSize
+		} else {
+			width = max(1, width*thumbnailSize/height)
+			height = thumbnailSize
+		}
+	}
+
+	thumbnail := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(thumbnail, thumbnail.Bounds(), img, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func putEncrypted(key string, data []byte) error {
+	sealed, err := utils.EncryptBlob(data)
+	if err != nil {
+		return err
+	}
+	return storage.GetBlobs().Put(context.TODO(), key, bytes.NewReader(sealed), int64(len(sealed)), "application/octet-stream")
+}
+
+// OpenAttachment loads and decrypts an attachment or its thumbnail
+func OpenAttachment(attachment models.Attachment, thumbnail bool) ([]byte, string, error) {
+	key, contentType := attachment.StorageKey, attachment.ContentType
+	if thumbnail {
+		if attachment.ThumbnailKey == "" {
+			return nil, "", models.ErrAttachmentNotFound
+		}
+		key, contentType = attachment.ThumbnailKey, "image/jpeg"
+	}
+
+	blob, err := storage.GetBlobs().Get(context.TODO(), key)
+	if err != nil {
+		if errors.Is(err, storage.ErrBlobNotFound) {
+			return nil, "", models.ErrAttachmentNotFound
+		}
+		return nil, "", err
+	}
+	defer blob.Close()
+
+	sealed, err := io.ReadAll(blob)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := utils.DecryptBlob(sealed)
+	return data, contentType, err
+}
+
+// AttachmentPath is the download path of an attachment or its thumbnail
+func AttachmentPath(id primitive.ObjectID, thumbnail bool) string {
+	path := "/attachments/" + id.Hex()
+	if thumbnail {
+		path += "/thumbnail"
+	}
+	return path
+}
+
+// SignAttachment fills in short-lived signed download links. Only call it
+// for callers allowed to see the attachment.
+func SignAttachment(attachment *models.Attachment) {
+	expires := time.Now().Add(attachmentURLTTL)
+	attachment.URL = signedPath(AttachmentPath(attachment.ID, false), expires)
+	if attachment.ThumbnailKey != "" {
+		attachment.ThumbnailURL = signedPath(AttachmentPath(attachment.ID, true), expires)
+	}
+}
+
+func signedPath(path string, expires time.Time) string {
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", utils.SignResource(path, expires))
+	return path + "?" + query.Encode()
+}
+
+// LoadMessageAttachments fills in the attachments of the given messages with signed links
+func LoadMessageAttachments(messages []models.Message) error {
+	var ids []primitive.ObjectID
+	for _, message := range messages {
+		ids = append(ids, message.AttachmentIDs...)
+	}
+	attachments, err := models.GetAttachments(ids)
+	if err != nil {
+		return err
+	}
+
+	for i, message := range messages {
+		messages[i].Attachments = nil
+		for _, id := range message.AttachmentIDs {
+			if attachment, ok := attachments[id]; ok {
+				SignAttachment(&attachment)
+				messages[i].Attachments = append(messages[i].Attachments, attachment)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/KevinChaves65/Project_Boo/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// memoryStore is a BlobStore kept in memory
+type memoryStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{blobs: make(map[string][]byte)}
+}
+
+func (s *memoryStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[key] = data
+	return nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.blobs[key]
+	if !ok {
+		return nil, storage.ErrBlobNotFound
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, key)
+	return nil
+}
+
+func (s *memoryStore) has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.blobs[key]
+	return ok
+}
+
+// pngWithSize encodes a 1x1 PNG and rewrites its header to claim the given
+// dimensions, as a decompression bomb would
+func pngWithSize(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// Signature (8), IHDR length (4) and type (4), then width and height
+	binary.BigEndian.PutUint32(data[16:], width)
+	binary.BigEndian.PutUint32(data[20:], height)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestDecodeImageRejectsHugeDimensions(t *testing.T) {
+	if _, err := decodeImage(pngWithSize(t, 1, 1)); err != nil {
+		t.Fatalf("small image rejected: %v", err)
+	}
+	if _, err := decodeImage(pngWithSize(t, 100000, 100000)); !errors.Is(err, ErrImageTooLarge) {
+		t.Fatalf("got %v, want ErrImageTooLarge", err)
+	}
+	if _, err := decodeImage([]byte("not an image")); !errors.Is(err, ErrUnsupportedAttachment) {
+		t.Fatalf("got %v, want ErrUnsupportedAttachment", err)
+	}
+}
+
+func TestDeleteUnclaimedAttachments(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("deletes unsent uploads and their blobs", func(mt *mtest.T) {
+		config.DB = mt.DB
+		store := newMemoryStore()
+		storage.Blobs = store
+
+		unsent, claimed := primitive.NewObjectID(), primitive.NewObjectID()
+		for _, id := range []primitive.ObjectID{unsent, claimed} {
+			store.Put(context.TODO(), "attachments/"+id.Hex(), bytes.NewReader(nil), 0, "")
+			store.Put(context.TODO(), "attachments/"+id.Hex()+"_thumb", bytes.NewReader(nil), 0, "")
+		}
+		attachment := func(id primitive.ObjectID) bson.D {
+			return bson.D{
+				{Key: "_id", Value: id},
+				{Key: "storage_key", Value: "attachments/" + id.Hex()},
+				{Key: "thumbnail_key", Value: "attachments/" + id.Hex() + "_thumb"},
+			}
+		}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "db.attachments", mtest.FirstBatch, attachment(unsent), attachment(claimed)),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			// Sent in a message while the sweep ran
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}),
+		)
+
+		deleted, err := models.DeleteUnclaimedAttachments(time.Now().Add(-unsentAttachmentTTL))
+		if err != nil {
+			mt.Fatal(err)
+		}
+		if deleted != 1 {
+			mt.Fatalf("deleted %d attachments, want 1", deleted)
+		}
+		if store.has("attachments/"+unsent.Hex()) || store.has("attachments/"+unsent.Hex()+"_thumb") {
+			mt.Fatal("blobs of the unsent upload were kept")
+		}
+		if !store.has("attachments/"+claimed.Hex()) || !store.has("attachments/"+claimed.Hex()+"_thumb") {
+			mt.Fatal("blobs of a sent attachment were deleted")
+		}
+	})
+}
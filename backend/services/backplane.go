@@ -0,0 +1,101 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// backplaneRetryDelay is the first wait before reconnecting to the backplane
+	backplaneRetryDelay = 2 * time.Second
+	// maxBackplaneRetryDelay caps the wait as reconnects keep failing
+	maxBackplaneRetryDelay = time.Minute
+)
+
+// Backplane relays chat frames between API instances, so a frame reaches a
+// couple's sockets whichever instance they are connected to. Every instance
+// publishes the frames it broadcasts and delivers the frames published by the
+// others to its own clients.
+type Backplane interface {
+	// Publish sends a frame to the other instances
+	Publish(envelope BackplaneEnvelope) error
+	// Subscribe calls deliver for every frame published by any instance,
+	// including this one, until the backplane is closed
+	Subscribe(deliver func(BackplaneEnvelope))
+	Close() error
+}
+
+// BackplaneEnvelope is a frame on the wire between instances. RecipientID is
+// not part of the frame clients see, so it travels next to it.
+type BackplaneEnvelope struct {
+	Origin      string             `json:"origin"`
+	RecipientID primitive.ObjectID `json:"recipient_id"`
+	Message     Message            `json:"message"`
+}
+
+// nextRetryDelay doubles a reconnect delay up to maxBackplaneRetryDelay
+func nextRetryDelay(delay time.Duration) time.Duration {
+	return min(delay*2, maxBackplaneRetryDelay)
+}
+
+// sleepContext waits for d and reports false if ctx ended first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func encodeEnvelope(envelope BackplaneEnvelope) ([]byte, error) {
+	return json.Marshal(envelope)
+}
+
+func decodeEnvelope(data []byte) (BackplaneEnvelope, error) {
+	var envelope BackplaneEnvelope
+	err := json.Unmarshal(data, &envelope)
+	return envelope, err
+}
+
+// ConnectBackplane sets up the backplane selected by CHAT_BACKPLANE: "redis"
+// (using REDIS_URL), "mongo" (change streams, needs a replica set) or unset for
+// a single instance. Call it before HandleMessages.
+func ConnectBackplane() {
+	var backplane Backplane
+	var err error
+	switch os.Getenv("CHAT_BACKPLANE") {
+	case "redis":
+		backplane, err = NewRedisBackplane(os.Getenv("REDIS_URL"), os.Getenv("REDIS_CHANNEL"))
+	case "mongo":
+		backplane = NewMongoBackplane()
+	case "", "none":
+		return
+	default:
+		log.Fatalf("❌ Unknown CHAT_BACKPLANE %q", os.Getenv("CHAT_BACKPLANE"))
+	}
+	if err != nil {
+		log.Fatalf("❌ Chat backplane error: %v", err)
+	}
+
+	hub.backplane = backplane
+	go backplane.Subscribe(func(envelope BackplaneEnvelope) {
+		// Frames from this instance were already delivered locally
+		if envelope.Origin == config.InstanceID {
+			return
+		}
+		// Frames from other instances are only delivered to this instance's clients
+		msg := envelope.Message
+		msg.RecipientID = envelope.RecipientID
+		hub.broadcast <- msg
+	})
+	log.Printf("✅ Chat backplane %s connected as %s", os.Getenv("CHAT_BACKPLANE"), config.InstanceID)
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/KevinChaves65/Project_Boo/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// changeStreamHistoryLost is the server error for a resume point that has
+// already left the oplog
+const changeStreamHistoryLost = 286
+
+// MongoBackplane relays frames through a collection watched with a change
+// stream. It needs no extra infrastructure, only a replica set, and a
+// reconnecting instance resumes where its stream stopped.
+type MongoBackplane struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewMongoBackplane() *MongoBackplane {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &MongoBackplane{ctx: ctx, cancel: cancel}
+}
+
+func (b *MongoBackplane) Publish(envelope BackplaneEnvelope) error {
+	data, err := encodeEnvelope(envelope)
+	if err != nil {
+		return err
+	}
+	// Frames carry chat content and sit in the collection until they expire,
+	// so they are sealed like every other stored message
+	payload, err := utils.EncryptMessage(string(data))
+	if err != nil {
+		return err
+	}
+	return models.InsertBackplaneEvent(envelope.Origin, payload)
+}
+
+func (b *MongoBackplane) Subscribe(deliver func(BackplaneEnvelope)) {
+	var resumeToken bson.Raw
+	delay := backplaneRetryDelay
+	for b.ctx.Err() == nil {
+		stream, err := models.WatchBackplaneEvents(b.ctx, resumeToken)
+		if err != nil {
+			var serverErr mongo.ServerError
+			if resumeToken != nil && errors.As(err, &serverErr) && serverErr.HasErrorCode(changeStreamHistoryLost) {
+				// Only now are the frames in between really gone
+				log.Printf("Backplane resume point expired, frames published meanwhile are lost: %v", err)
+				resumeToken = nil
+				continue
+			}
+			log.Printf("Failed to watch backplane events, retrying in %s: %v", delay, err)
+			if !sleepContext(b.ctx, delay) {
+				return
+			}
+			delay = nextRetryDelay(delay)
+			continue
+		}
+
+		for stream.Next(b.ctx) {
+			delay = backplaneRetryDelay
+			var change struct {
+				FullDocument models.BackplaneEvent `bson:"fullDocument"`
+			}
+			if err := stream.Decode(&change); err != nil {
+				log.Printf("Dropping malformed backplane event: %v", err)
+				continue
+			}
+			resumeToken = stream.ResumeToken()
+
+			data, err := utils.DecryptMessage(change.FullDocument.Payload)
+			if err != nil {
+				log.Printf("Dropping unreadable backplane frame: %v", err)
+				continue
+			}
+			envelope, err := decodeEnvelope([]byte(data))
+			if err != nil {
+				log.Printf("Dropping malformed backplane frame: %v", err)
+				continue
+			}
+			deliver(envelope)
+		}
+		if err := stream.Err(); err != nil && b.ctx.Err() == nil {
+			log.Printf("Backplane change stream stopped, resuming in %s: %v", delay, err)
+			stream.Close(context.Background())
+			if !sleepContext(b.ctx, delay) {
+				return
+			}
+			delay = nextRetryDelay(delay)
+			continue
+		}
+		stream.Close(context.Background())
+	}
+}
+
+func (b *MongoBackplane) Close() error {
+	b.cancel()
+	return nil
+}
@@ -0,0 +1,47 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"github.com/KevinChaves65/Project_Boo/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestMongoBackplaneStoresSealedFrames(t *testing.T) {
+	useEncryptionKey(t)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("publish", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+		sent := BackplaneEnvelope{
+			Origin:      "instance-a",
+			RecipientID: primitive.NewObjectID(),
+			Message:     Message{Type: ChatMessage, Content: "meet me at eight"},
+		}
+		if err := NewMongoBackplane().Publish(sent); err != nil {
+			mt.Fatal(err)
+		}
+
+		inserted := mt.GetStartedEvent().Command.Lookup("documents").Array().Index(0).Value().Document()
+		payload := inserted.Lookup("payload").StringValue()
+		if strings.Contains(payload, "meet me at eight") {
+			mt.Fatalf("frame stored in plaintext: %s", payload)
+		}
+		data, err := utils.DecryptMessage(payload)
+		if err != nil {
+			mt.Fatal(err)
+		}
+		received, err := decodeEnvelope([]byte(data))
+		if err != nil {
+			mt.Fatal(err)
+		}
+		if received.RecipientID != sent.RecipientID || received.Message.Content != sent.Message.Content {
+			mt.Fatalf("got %+v, want %+v", received, sent)
+		}
+	})
+}
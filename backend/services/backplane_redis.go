@@ -0,0 +1,101 @@
+package services
+
+import (
+	"context"
+	"log"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultRedisChannel is the pub/sub channel frames are relayed on
+const defaultRedisChannel = "heyboo:chat"
+
+// RedisBackplane relays frames over Redis pub/sub. Frames published while an
+// instance is disconnected are lost to it, which matches a dropped socket.
+type RedisBackplane struct {
+	client  *redis.Client
+	channel string
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// NewRedisBackplane connects to the Redis server at url, e.g. redis://localhost:6379/0
+func NewRedisBackplane(url, channel string) (*RedisBackplane, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	if channel == "" {
+		channel = defaultRedisChannel
+	}
+
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := client.Ping(ctx).Err(); err != nil {
+		cancel()
+		client.Close()
+		return nil, err
+	}
+	return &RedisBackplane{client: client, channel: channel, ctx: ctx, cancel: cancel}, nil
+}
+
+func (b *RedisBackplane) Publish(envelope BackplaneEnvelope) error {
+	data, err := encodeEnvelope(envelope)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(b.ctx, b.channel, data).Err()
+}
+
+func (b *RedisBackplane) Subscribe(deliver func(BackplaneEnvelope)) {
+	delay := backplaneRetryDelay
+	for b.ctx.Err() == nil {
+		pubsub := b.client.Subscribe(b.ctx, b.channel)
+		// Wait for the subscription to be confirmed, so a server that is down
+		// is retried here rather than by a channel that never opens
+		if _, err := pubsub.Receive(b.ctx); err != nil {
+			pubsub.Close()
+			if b.ctx.Err() != nil {
+				return
+			}
+			log.Printf("Failed to subscribe to the backplane, retrying in %s: %v", delay, err)
+			if !sleepContext(b.ctx, delay) {
+				return
+			}
+			delay = nextRetryDelay(delay)
+			continue
+		}
+		delay = backplaneRetryDelay
+
+		// Closing the backplane ends the subscription
+		ended := make(chan struct{})
+		go func() {
+			select {
+			case <-b.ctx.Done():
+				pubsub.Close()
+			case <-ended:
+			}
+		}()
+
+		// The client resubscribes by itself after a connection drops; the
+		// channel only closes when the subscription ends for good
+		for message := range pubsub.Channel() {
+			envelope, err := decodeEnvelope([]byte(message.Payload))
+			if err != nil {
+				log.Printf("Dropping malformed backplane frame: %v", err)
+				continue
+			}
+			deliver(envelope)
+		}
+		close(ended)
+		pubsub.Close()
+		if b.ctx.Err() == nil {
+			log.Printf("Backplane subscription ended, subscribing again")
+		}
+	}
+}
+
+func (b *RedisBackplane) Close() error {
+	b.cancel()
+	return b.client.Close()
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestRedisBackplaneRelaysFrames needs a Redis server, e.g.
+// REDIS_URL=redis://localhost:6379/0 go test ./services/
+func TestRedisBackplaneRelaysFrames(t *testing.T) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		t.Skip("REDIS_URL is not set")
+	}
+	channel := "heyboo:test:" + primitive.NewObjectID().Hex()
+
+	receiver, err := NewRedisBackplane(url, channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := NewRedisBackplane(url, channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	received := make(chan BackplaneEnvelope, 1)
+	stopped := make(chan struct{})
+	go func() {
+		receiver.Subscribe(func(envelope BackplaneEnvelope) {
+			select {
+			case received <- envelope:
+			default:
+			}
+		})
+		close(stopped)
+	}()
+
+	recipient := primitive.NewObjectID()
+	sent := BackplaneEnvelope{
+		Origin:      "other-instance",
+		RecipientID: recipient,
+		Message:     Message{Type: Notification, Content: "hi"},
+	}
+	// The subscription may not be confirmed yet, so publish until it arrives
+	timeout := time.After(10 * time.Second)
+	for {
+		if err := sender.Publish(sent); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case envelope := <-received:
+			if envelope.Origin != sent.Origin || envelope.RecipientID != recipient || envelope.Message.Content != "hi" {
+				t.Fatalf("got %+v, want %+v", envelope, sent)
+			}
+			receiver.Close()
+			select {
+			case <-stopped:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Subscribe did not return after Close")
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("frame was not relayed")
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package services
+
+import (
+	"log"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RunUnlinkFinalizer periodically finalizes unlinks whose cooling-off period has ended
+func RunUnlinkFinalizer(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		couples, err := models.GetDueUnlinks()
+		if err != nil {
+			log.Printf("Failed to load due unlinks: %v", err)
+			continue
+		}
+
+		for _, couple := range couples {
+			if err := models.FinalizeUnlink(couple.ID); err != nil {
+				log.Printf("Failed to finalize unlink of couple %s: %v", couple.ID.Hex(), err)
+				continue
+			}
+			log.Printf("Finalized unlink of couple %s", couple.ID.Hex())
+
+			for _, userID := range []primitive.ObjectID{couple.User1ID, couple.User2ID} {
+				if user, err := models.GetUserByID(userID); err == nil {
+					Notify(user, "couple_unlinked", "Your couple has been unlinked", bson.M{"couple_id": couple.ID.Hex()})
+				}
+			}
+		}
+	}
+}
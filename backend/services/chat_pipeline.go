@@ -0,0 +1,404 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/KevinChaves65/Project_Boo/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// MaxMessageLength is the longest chat message accepted, in characters
+	MaxMessageLength = 4000
+	// defaultEditWindow is how long a sender may edit or unsend a message
+	defaultEditWindow = 15 * time.Minute
+)
+
+var (
+	ErrEmptyMessage   = errors.New("message content cannot be empty")
+	ErrMessageTooLong = errors.New("message content is too long")
+	// ErrMessageAlreadyStored means a message with the post's preset ID was saved before
+	ErrMessageAlreadyStored = errors.New("message was already stored")
+	ErrInvalidClientMsgID   = errors.New("client_msg_id must be 1-64 letters, digits, '-' or '_'")
+	ErrReceiverNotPartner   = errors.New("messages can only be sent to your partner")
+)
+
+// ValidateMessageContent checks a chat message before it is stored
+func ValidateMessageContent(content string) error {
+	if strings.TrimSpace(content) == "" {
+		return ErrEmptyMessage
+	}
+	if utf8.RuneCountInString(content) > MaxMessageLength {
+		return ErrMessageTooLong
+	}
+	return nil
+}
+
+// ChatPost is a chat message as submitted by its sender. Messages only go
+// between the two partners of a couple; Sender and Receiver are their current
+// usernames, for the live event.
+type ChatPost struct {
+	SenderID      primitive.ObjectID
+	ReceiverID    primitive.ObjectID
+	Sender        string
+	Receiver      string
+	CoupleID      primitive.ObjectID
+	Content       string
+	AttachmentIDs []primitive.ObjectID
+
+	// Expiry overrides the couple's default lifetime for this message
+	Expiry *models.MessageExpiry
+
+	// ClientMsgID is the sender's ID for the message. Posting it again returns
+	// the message stored the first time.
+	ClientMsgID string
+
+	// MessageID is preset by callers that may retry a post, such as the
+	// scheduler; a second attempt then fails with ErrMessageAlreadyStored
+	// instead of storing the message twice
+	MessageID primitive.ObjectID
+
+	// Set instead of Content when the couple uses end-to-end encryption
+	SenderDevice string
+	Ciphertexts  []models.DeviceCiphertext
+}
+
+// PostChatMessage is the single path every chat message goes through, whether
+// it arrives over REST or the WebSocket: it validates the content, encrypts
+// it, stores it with a server-assigned ID and timestamp and then fans it out
+// to the couple. The returned message carries the plaintext content.
+func PostChatMessage(post ChatPost) (models.Message, error) {
+	if post.CoupleID.IsZero() || post.SenderID == post.ReceiverID {
+		return models.Message{}, ErrReceiverNotPartner
+	}
+	if post.ClientMsgID != "" {
+		if !deviceIDPattern.MatchString(post.ClientMsgID) {
+			return models.Message{}, ErrInvalidClientMsgID
+		}
+		// A retry of a send that got through before the connection dropped
+		if existing, found, err := storedDuplicate(post); found || err != nil {
+			return existing, err
+		}
+	}
+
+	couple, err := models.GetCoupleByID(post.CoupleID)
+	if err != nil {
+		return models.Message{}, err
+	}
+	if !couple.IsMember(post.SenderID) || !couple.IsMember(post.ReceiverID) {
+		return models.Message{}, ErrReceiverNotPartner
+	}
+	expiry, err := messageExpiry(couple, post)
+	if err != nil {
+		return models.Message{}, err
+	}
+	if couple.E2EEnabled {
+		return postE2EMessage(couple, post, expiry)
+	}
+	if len(post.Ciphertexts) > 0 {
+		return models.Message{}, ErrE2EDisabled
+	}
+
+	// A message may be just attachments, such as a photo or a voice note
+	if len(post.AttachmentIDs) == 0 || post.Content != "" {
+		if err := ValidateMessageContent(post.Content); err != nil {
+			return models.Message{}, err
+		}
+	}
+	if len(post.AttachmentIDs) > MaxAttachmentsPerMessage {
+		return models.Message{}, ErrTooManyAttachments
+	}
+
+	encrypted, err := utils.EncryptMessage(post.Content)
+	if err != nil {
+		return models.Message{}, err
+	}
+	if post.MessageID.IsZero() {
+		post.MessageID = primitive.NewObjectID()
+	}
+
+	message := models.Message{
+		ID:            post.MessageID,
+		CoupleID:      &couple.ID,
+		SenderID:      post.SenderID,
+		ReceiverID:    post.ReceiverID,
+		Sender:        post.Sender,
+		Receiver:      post.Receiver,
+		Content:       encrypted,
+		AttachmentIDs: post.AttachmentIDs,
+		ClientMsgID:   post.ClientMsgID,
+	}
+	expiry.Apply(&message, time.Now())
+	if len(post.AttachmentIDs) > 0 {
+		if err := models.ClaimAttachments(post.AttachmentIDs, post.SenderID, couple.ID, message.ID); err != nil {
+			return models.Message{}, err
+		}
+	}
+
+	stored, err := models.SaveMessage(message)
+	if mongo.IsDuplicateKeyError(err) && post.ClientMsgID != "" {
+		// A concurrent retry stored it first
+		if len(post.AttachmentIDs) > 0 {
+			if err := models.ReleaseAttachments(message.ID); err != nil {
+				log.Printf("Failed to release attachments of duplicate message %s: %v", message.ID.Hex(), err)
+			}
+		}
+		return duplicateOrError(post)
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		// The attachments belong to the message stored the first time
+		return models.Message{}, ErrMessageAlreadyStored
+	}
+	if err != nil {
+		if len(post.AttachmentIDs) > 0 {
+			if err := models.ReleaseAttachments(message.ID); err != nil {
+				log.Printf("Failed to release attachments of unsaved message %s: %v", message.ID.Hex(), err)
+			}
+		}
+		return models.Message{}, err
+	}
+	stored.Content = post.Content
+	indexMessage(stored, post.Content)
+	if err := LoadMessageAttachments([]models.Message{stored}); err != nil {
+		log.Printf("Failed to load attachments of message %s: %v", stored.ID.Hex(), err)
+	}
+
+	stored.Seq = hub.BroadcastLogged(chatMessageFrame(stored))
+	return stored, nil
+}
+
+// postE2EMessage stores and relays an end-to-end encrypted message. The
+// server only checks where the ciphertexts go; it cannot read them, so there
+// is nothing to validate, encrypt or index.
+func postE2EMessage(couple models.Couple, post ChatPost, expiry models.MessageExpiry) (models.Message, error) {
+	if post.Content != "" {
+		return models.Message{}, ErrE2ERequired
+	}
+	if len(post.AttachmentIDs) > 0 {
+		return models.Message{}, ErrE2EUnavailable
+	}
+	if !deviceIDPattern.MatchString(post.SenderDevice) {
+		return models.Message{}, ErrInvalidDeviceID
+	}
+	if err := validateCiphertexts(couple, post.Ciphertexts); err != nil {
+		return models.Message{}, err
+	}
+
+	message := models.Message{
+		ID:           post.MessageID,
+		CoupleID:     &couple.ID,
+		SenderID:     post.SenderID,
+		ReceiverID:   post.ReceiverID,
+		Sender:       post.Sender,
+		Receiver:     post.Receiver,
+		E2E:          true,
+		SenderDevice: post.SenderDevice,
+		Ciphertexts:  post.Ciphertexts,
+		ClientMsgID:  post.ClientMsgID,
+	}
+	expiry.Apply(&message, time.Now())
+	stored, err := models.SaveMessage(message)
+	if mongo.IsDuplicateKeyError(err) && post.ClientMsgID != "" {
+		return duplicateOrError(post)
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return models.Message{}, ErrMessageAlreadyStored
+	}
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	stored.Seq = hub.BroadcastLogged(chatMessageFrame(stored))
+	return stored, nil
+}
+
+// chatMessageFrame is the live event announcing a stored message. Content
+// must already be decrypted and attachments loaded.
+func chatMessageFrame(stored models.Message) Message {
+	frame := Message{
+		Type:         ChatMessage,
+		ID:           stored.ID.Hex(),
+		Sender:       stored.Sender,
+		Receiver:     stored.Receiver,
+		SenderID:     stored.SenderID.Hex(),
+		ReceiverID:   stored.ReceiverID.Hex(),
+		Content:      stored.Content,
+		Timestamp:    stored.Timestamp,
+		SenderDevice: stored.SenderDevice,
+		Ciphertexts:  stored.Ciphertexts,
+		ExpiresAt:    stored.ExpiresAt,
+		ClientMsgID:  stored.ClientMsgID,
+	}
+	if stored.CoupleID != nil {
+		frame.CoupleID = stored.CoupleID.Hex()
+	}
+	if len(stored.Attachments) > 0 {
+		frame.Data = map[string]interface{}{"attachments": stored.Attachments}
+	}
+	return frame
+}
+
+// announceStoredMessage fans out a message stored by an earlier attempt that
+// never got to announce it, e.g. because its instance stopped in between. A
+// message whose event was logged has been announced and is left alone.
+func announceStoredMessage(id primitive.ObjectID) error {
+	seq, err := models.GetMessageEventSeq(id)
+	if err != nil || seq != 0 {
+		return err
+	}
+	stored, err := models.GetMessageByID(id)
+	if errors.Is(err, models.ErrMessageNotFound) {
+		// It expired or was unsent since; there is nothing left to announce
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !stored.E2E && !stored.Deleted {
+		content, err := utils.DecryptMessage(stored.Content)
+		if err != nil {
+			return err
+		}
+		stored.Content = content
+		indexMessage(stored, content)
+	}
+	if err := LoadMessageAttachments([]models.Message{stored}); err != nil {
+		log.Printf("Failed to load attachments of message %s: %v", stored.ID.Hex(), err)
+	}
+	hub.BroadcastLogged(chatMessageFrame(stored))
+	return nil
+}
+
+// storedDuplicate looks up the message a retried post already stored. The
+// returned message carries the plaintext content, like a fresh post.
+func storedDuplicate(post ChatPost) (models.Message, bool, error) {
+	existing, err := models.GetMessageByClientID(post.SenderID, post.ClientMsgID)
+	if errors.Is(err, models.ErrMessageNotFound) {
+		return models.Message{}, false, nil
+	}
+	if err != nil {
+		return models.Message{}, false, err
+	}
+
+	if !existing.E2E && !existing.Deleted {
+		if content, err := utils.DecryptMessage(existing.Content); err == nil {
+			existing.Content = content
+		}
+	}
+	existing.Seq, err = models.GetMessageEventSeq(existing.ID)
+	return existing, true, err
+}
+
+// duplicateOrError resolves a save that lost the race against its own retry
+func duplicateOrError(post ChatPost) (models.Message, error) {
+	existing, found, err := storedDuplicate(post)
+	if err == nil && !found {
+		err = ErrMessageAlreadyStored
+	}
+	return existing, err
+}
+
+// EditWindow reads CHAT_EDIT_WINDOW (a duration such as "15m"), defaulting to 15 minutes
+func EditWindow() time.Duration {
+	if value := os.Getenv("CHAT_EDIT_WINDOW"); value != "" {
+		window, err := time.ParseDuration(value)
+		if err == nil && window > 0 {
+			return window
+		}
+		log.Printf("Ignoring invalid CHAT_EDIT_WINDOW %q", value)
+	}
+	return defaultEditWindow
+}
+
+// EditChatMessage replaces the content of one of the sender's messages and
+// pushes the new content to the couple. The returned message carries the
+// plaintext content.
+func EditChatMessage(senderID, id primitive.ObjectID, content string) (models.Message, error) {
+	if err := ValidateMessageContent(content); err != nil {
+		return models.Message{}, err
+	}
+
+	// Edits are stored server-side encrypted, which an end-to-end couple must not fall back to
+	original, err := models.GetMessageByID(id)
+	if err != nil {
+		return models.Message{}, err
+	}
+	e2e, err := coupleUsesE2E(original.CoupleID)
+	if err != nil {
+		return models.Message{}, err
+	}
+	if e2e || original.E2E {
+		return models.Message{}, ErrE2EUnavailable
+	}
+
+	encrypted, err := utils.EncryptMessage(content)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	edited, err := models.EditMessage(id, senderID, encrypted, EditWindow())
+	if err != nil {
+		return models.Message{}, err
+	}
+	edited.Content = content
+	indexMessage(edited, content)
+
+	if edited.CoupleID != nil {
+		hub.Broadcast(Message{
+			Type:       MessageEdited,
+			ID:         edited.ID.Hex(),
+			Sender:     edited.Sender,
+			Receiver:   edited.Receiver,
+			SenderID:   edited.SenderID.Hex(),
+			ReceiverID: edited.ReceiverID.Hex(),
+			Content:    content,
+			CoupleID:   edited.CoupleID.Hex(),
+			Timestamp:  edited.EditedAt.Unix(),
+		})
+	}
+	return edited, nil
+}
+
+// UnsendChatMessage replaces one of the sender's messages with a tombstone and
+// tells the couple
+func UnsendChatMessage(senderID, id primitive.ObjectID) (models.Message, error) {
+	deleted, err := models.UnsendMessage(id, senderID, EditWindow())
+	if err != nil {
+		return models.Message{}, err
+	}
+	if err := models.DeleteMessageReactions(deleted.ID); err != nil {
+		log.Printf("Failed to delete reactions of unsent message %s: %v", deleted.ID.Hex(), err)
+	}
+	if err := models.RemoveMessageIndex(deleted.ID); err != nil {
+		log.Printf("Failed to remove unsent message %s from the search index: %v", deleted.ID.Hex(), err)
+	}
+	if err := models.DeleteAttachments(bson.M{"message_id": deleted.ID}); err != nil {
+		log.Printf("Failed to delete attachments of unsent message %s: %v", deleted.ID.Hex(), err)
+	}
+	// The logged frames still hold the content the message was sent and edited with
+	if err := models.DeleteMessageEvents(deleted.ID); err != nil {
+		log.Printf("Failed to delete events of unsent message %s: %v", deleted.ID.Hex(), err)
+	}
+
+	if deleted.CoupleID != nil {
+		hub.Broadcast(Message{
+			Type:       MessageDeleted,
+			ID:         deleted.ID.Hex(),
+			Sender:     deleted.Sender,
+			Receiver:   deleted.Receiver,
+			SenderID:   deleted.SenderID.Hex(),
+			ReceiverID: deleted.ReceiverID.Hex(),
+			CoupleID:   deleted.CoupleID.Hex(),
+			Timestamp:  deleted.DeletedAt.Unix(),
+		})
+	}
+	return deleted, nil
+}
@@ -0,0 +1,51 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"github.com/KevinChaves65/Project_Boo/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestUnsendChatMessageDeletesItsEvents(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("unsend", func(mt *mtest.T) {
+		config.DB = mt.DB
+		storage.Blobs = newMemoryStore()
+		senderID, messageID := primitive.NewObjectID(), primitive.NewObjectID()
+		deleted := mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1})
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{
+				{Key: "_id", Value: messageID},
+				{Key: "sender_id", Value: senderID},
+				{Key: "deleted", Value: true},
+			}}),
+			mtest.CreateCursorResponse(0, "db.users", mtest.FirstBatch),
+			deleted,
+			deleted,
+			mtest.CreateCursorResponse(0, "db.attachments", mtest.FirstBatch),
+			deleted,
+			deleted,
+		)
+
+		if _, err := UnsendChatMessage(senderID, messageID); err != nil {
+			mt.Fatal(err)
+		}
+
+		for event := mt.GetStartedEvent(); event != nil; event = mt.GetStartedEvent() {
+			if event.CommandName != "delete" || event.Command.Lookup("delete").StringValue() != "chat_events" {
+				continue
+			}
+			filter := event.Command.Lookup("deletes").Array().Index(0).Value().Document().Lookup("q")
+			if id, ok := filter.Document().Lookup("message_id").ObjectIDOK(); !ok || id != messageID {
+				mt.Fatalf("deleted events matching %v, want the unsent message's", filter)
+			}
+			return
+		}
+		mt.Fatal("the events of the unsent message were kept")
+	})
+}
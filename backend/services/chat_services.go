@@ -1,25 +1,24 @@
 package services
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"time"
 
+	"github.com/KevinChaves65/Project_Boo/config"
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"github.com/KevinChaves65/Project_Boo/models"
 	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// Client struct to store connection and user info
-type Client struct {
-	Conn     *websocket.Conn
-	Username string
-	CoupleID string
-}
-
-var clients = make(map[*websocket.Conn]*Client)
-var broadcast = make(chan Message)
-
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	// Browsers send an Origin header; only the same origins as the CORS config may connect
+	CheckOrigin: func(r *http.Request) bool {
+		return config.IsAllowedOrigin(r.Header.Get("Origin"))
+	},
+	Subprotocols: []string{tokenSubprotocol},
 }
 
 // Message types
@@ -31,19 +30,103 @@ const (
 	TypingStop  MessageType = "typing_stop"
 	UserJoined  MessageType = "user_joined"
 	UserLeft    MessageType = "user_left"
+	// Notification is delivered only to the user identified by RecipientID
+	Notification MessageType = "notification"
+	// AuthMessage carries an access token, as the first frame or to re-authenticate
+	AuthMessage MessageType = "auth"
+	// ErrorMessage reports a rejected frame back to the client that sent it
+	ErrorMessage MessageType = "error"
+	// ReadUpTo is sent by a client to mark everything up to ID as read
+	ReadUpTo MessageType = "read_up_to"
+	// MessageStatusChanged tells a sender that their messages were delivered or read
+	MessageStatusChanged MessageType = "message_status"
+	// MessageEdited carries the new content of an edited message
+	MessageEdited MessageType = "message_edited"
+	// MessageDeleted tells the couple a message was unsent
+	MessageDeleted MessageType = "message_deleted"
+	// ReactionAdded and ReactionRemoved carry the emoji in Content and the message in ID
+	ReactionAdded   MessageType = "reaction_added"
+	ReactionRemoved MessageType = "reaction_removed"
+	// KeyChanged tells the couple a partner's device keys changed, with the new safety number
+	KeyChanged MessageType = "key_changed"
+	// E2EChanged tells the couple end-to-end encryption was turned on or off
+	E2EChanged MessageType = "e2e_changed"
+	// PresenceChanged is sent by a client with "online" or "away" in Content; the
+	// server sends it to the couple with the user's combined presence in Data
+	PresenceChanged MessageType = "presence"
+	// StreamReset tells a resuming client that events it missed are no longer
+	// in the log, so it should reload its state over REST
+	StreamReset MessageType = "reset"
+	// MessageExpiring carries the countdowns of messages that started to disappear once read
+	MessageExpiring MessageType = "message_expiring"
+	// MessageExpired tells the couple a disappearing message is gone
+	MessageExpired MessageType = "message_expired"
+	// ExpiryChanged carries the couple's new default message lifetime
+	ExpiryChanged MessageType = "expiry_changed"
+	// Hello opts a connection into protocol Version and, with LastSeq, replays
+	// the couple's events after that seq; the server answers with Welcome
+	Hello   MessageType = "hello"
+	Welcome MessageType = "welcome"
+	// Ack confirms a chat message by its ClientMsgID with the stored ID and seq
+	Ack MessageType = "ack"
+	// EntityChanged carries a created, updated or deleted milestone, saved
+	// suggestion, word bank entry or couple in Data
+	EntityChanged MessageType = "entity_changed"
 )
 
+// ProtocolVersion is the newest WebSocket protocol the server speaks. Version
+// 1 is the original protocol, used until a client says hello. Version 2
+// requires client_msg_id on chat messages, acks them and resumes from last_seq.
+const ProtocolVersion = 2
+
 // Message struct
 type Message struct {
-	Type      MessageType `json:"type"`
-	Sender    string      `json:"sender"`
-	Content   string      `json:"content"`
-	CoupleID  string      `json:"couple_id"`
-	Timestamp int64       `json:"timestamp"`
+	Type       MessageType `json:"type"`
+	ID         string      `json:"id,omitempty"`
+	Sender     string      `json:"sender"`
+	Receiver   string      `json:"receiver,omitempty"`
+	SenderID   string      `json:"sender_id,omitempty"` // Chat message events also name the partners by user ID
+	ReceiverID string      `json:"receiver_id,omitempty"`
+	Content    string      `json:"content"`
+	CoupleID   string      `json:"couple_id"`
+	Timestamp  int64       `json:"timestamp"`
+	Data       interface{} `json:"data,omitempty"`
+	Token      string      `json:"token,omitempty"`
+	Seq        int64       `json:"seq,omitempty"` // Position in the couple's event log, for resuming
+
+	Version     int    `json:"version,omitempty"`
+	LastSeq     int64  `json:"last_seq,omitempty"`
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+
+	AttachmentIDs []string                  `json:"attachment_ids,omitempty"`
+	SenderDevice  string                    `json:"sender_device,omitempty"`
+	Ciphertexts   []models.DeviceCiphertext `json:"ciphertexts,omitempty"`
+	Expiry        *models.MessageExpiry     `json:"expiry,omitempty"`     // Lifetime a client asks for one message
+	ExpiresAt     *time.Time                `json:"expires_at,omitempty"` // When a disappearing message goes
+	RecipientID   primitive.ObjectID        `json:"-"`                    // set to deliver to one user's connections only
+
+	client *Client // set to deliver to one connection only
 }
 
-// Handle WebSocket connections
+// Handle WebSocket connections. The access token is taken from the
+// Authorization header, the access_token subprotocol or the first frame, and
+// the username and couple are derived from it.
 func HandleConnections(w http.ResponseWriter, r *http.Request) {
+	var principal *middlewares.Principal
+	if token := tokenFromRequest(r); token != "" {
+		p, err := middlewares.Authenticate(token)
+		if middlewares.IsUnauthenticated(err) {
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to authenticate WebSocket connection: %v", err)
+			http.Error(w, "Failed to authenticate", http.StatusInternalServerError)
+			return
+		}
+		principal = p
+	}
+
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("WebSocket Upgrade Error:", err)
@@ -51,35 +134,58 @@ func HandleConnections(w http.ResponseWriter, r *http.Request) {
 	}
 	defer ws.Close()
 
-	// Get user info from query parameters
-	username := r.URL.Query().Get("username")
-	coupleID := r.URL.Query().Get("couple_id")
+	if principal == nil {
+		principal, err = authenticateFirstFrame(ws)
+		if err != nil {
+			closeConnection(ws, CloseUnauthorized, "authentication required")
+			return
+		}
+	}
 
-	if username == "" || coupleID == "" {
-		log.Println("Missing username or couple_id")
+	if !principal.HasCouple() {
+		closeConnection(ws, CloseForbidden, "not linked with a partner")
 		return
 	}
+	username := principal.Username
+	coupleID := principal.CoupleID.Hex()
 
-	// Create client
-	client := &Client{
-		Conn:     ws,
-		Username: username,
-		CoupleID: coupleID,
+	partner, err := models.GetUserByID(*principal.PartnerID)
+	if err != nil {
+		closeConnection(ws, CloseForbidden, "partner not found")
+		return
 	}
-	clients[ws] = client
+
+	// Create client and start its writer
+	client := NewClient(ws)
+	client.Username = username
+	client.CoupleID = coupleID
+	client.UserID = principal.UserID
+	client.SessionID = principal.SessionID
+	hub.Register(client)
+	go client.writePump()
+
+	// Close the connection once the token expires or the session is revoked
+	done := make(chan struct{})
+	reauth := make(chan *middlewares.Principal, 1)
+	go watchSession(principal, reauth, done, func(code int, reason string) {
+		closeConnection(ws, code, reason)
+	})
+	defer close(done)
 
 	// Notify others that user joined
-	joinMessage := Message{
-		Type:      UserJoined,
-		Sender:    username,
-		CoupleID:  coupleID,
-		Timestamp: time.Now().Unix(),
+	hub.Broadcast(joinLeaveFrame(UserJoined, client))
+
+	// Record this device as online and keep the entry alive while connected
+	if err := setPresence(client, models.PresenceOnline); err != nil {
+		log.Printf("Failed to record presence of %s: %v", username, err)
 	}
-	broadcast <- joinMessage
+	go trackPresence(client, done)
 
 	log.Printf("User %s joined couple %s", username, coupleID)
 
-	// Listen for messages
+	// Listen for messages until the connection drops or misses its pongs
+	client.prepareRead()
+listen:
 	for {
 		var msg Message
 		err := ws.ReadJSON(&msg)
@@ -88,45 +194,146 @@ func HandleConnections(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 
-		// Add metadata
-		msg.Sender = username
-		msg.CoupleID = coupleID
-		msg.Timestamp = time.Now().Unix()
-
-		// Broadcast message
-		broadcast <- msg
+		switch msg.Type {
+		case AuthMessage:
+			// A fresh token extends the connection past the old token's expiry
+			refreshed, err := middlewares.Authenticate(msg.Token)
+			if err != nil || refreshed.UserID != principal.UserID {
+				closeConnection(ws, CloseUnauthorized, "invalid token")
+				break listen
+			}
+			select {
+			case <-reauth:
+			default:
+			}
+			reauth <- refreshed
+			continue
+		case Hello:
+			if msg.Version < 1 || msg.Version > ProtocolVersion {
+				client.sendError("unsupported protocol version")
+				continue
+			}
+			client.Version = msg.Version
+			if err := client.requestResume(msg); err != nil {
+				log.Printf("Failed to resume %s for couple %s: %v", principal.Username, client.CoupleID, err)
+				client.sendError("could not resume")
+			}
+		case ChatMessage:
+			if client.Version >= 2 && msg.ClientMsgID == "" {
+				client.sendError("client_msg_id is required")
+				continue
+			}
+			// Chat messages are stored before they are fanned out, like REST sends
+			attachmentIDs, err := parseObjectIDs(msg.AttachmentIDs)
+			if err != nil {
+				client.reply(Message{Type: ErrorMessage, Content: "invalid attachment id", ClientMsgID: msg.ClientMsgID})
+				continue
+			}
+			stored, err := PostChatMessage(ChatPost{
+				SenderID:      principal.UserID,
+				ReceiverID:    partner.ID,
+				Sender:        username,
+				Receiver:      partner.Username,
+				CoupleID:      *principal.CoupleID,
+				Content:       msg.Content,
+				AttachmentIDs: attachmentIDs,
+				SenderDevice:  msg.SenderDevice,
+				Ciphertexts:   msg.Ciphertexts,
+				Expiry:        msg.Expiry,
+				ClientMsgID:   msg.ClientMsgID,
+			})
+			switch {
+			case err != nil:
+				client.reply(Message{Type: ErrorMessage, Content: postErrorReason(principal.Username, err), ClientMsgID: msg.ClientMsgID})
+			case msg.ClientMsgID != "":
+				client.reply(Message{
+					Type:        Ack,
+					ID:          stored.ID.Hex(),
+					ClientMsgID: msg.ClientMsgID,
+					Seq:         stored.Seq,
+					Timestamp:   stored.Timestamp,
+				})
+			}
+		case ReadUpTo:
+			upTo, err := primitive.ObjectIDFromHex(msg.ID)
+			if err != nil {
+				client.sendError("invalid message id")
+				continue
+			}
+			if _, err := AcknowledgeRead(principal, upTo); err != nil {
+				client.sendError("failed to record read receipt")
+			}
+		case PresenceChanged:
+			if err := setPresence(client, models.PresenceState(msg.Content)); errors.Is(err, ErrInvalidPresence) {
+				client.sendError(err.Error())
+			} else if err != nil {
+				log.Printf("Failed to set presence of %s: %v", principal.Username, err)
+				client.sendError("failed to update presence")
+			}
+		case TypingStart, TypingStop:
+			hub.Broadcast(Message{
+				Type:      msg.Type,
+				Sender:    username,
+				CoupleID:  coupleID,
+				Timestamp: time.Now().Unix(),
+			})
+		default:
+			// Other event types are only ever sent by the server
+		}
 	}
 
 	// Clean up on disconnect
-	delete(clients, ws)
+	hub.Unregister(client)
 
 	// Notify others that user left
-	leftMessage := Message{
-		Type:      UserLeft,
-		Sender:    username,
-		CoupleID:  coupleID,
-		Timestamp: time.Now().Unix(),
-	}
-	broadcast <- leftMessage
+	hub.Broadcast(joinLeaveFrame(UserLeft, client))
+	clearPresence(client)
 
 	log.Printf("User %s left couple %s", username, coupleID)
 }
 
-// Broadcast messages to clients in the same couple
-func HandleMessages() {
-	for {
-		msg := <-broadcast
-
-		for client := range clients {
-			// Only send to clients in the same couple
-			if clients[client].CoupleID == msg.CoupleID {
-				err := client.WriteJSON(msg)
-				if err != nil {
-					log.Printf("WebSocket Write Error: %v", err)
-					client.Close()
-					delete(clients, client)
-				}
-			}
+// postErrorReason is what a sender is told about a message that was not
+// stored, the same reasons SendMessage answers with. Unexpected errors are
+// only logged.
+func postErrorReason(username string, err error) string {
+	switch {
+	case errors.Is(err, ErrEmptyMessage), errors.Is(err, ErrMessageTooLong),
+		errors.Is(err, ErrTooManyAttachments), errors.Is(err, ErrE2ERequired),
+		errors.Is(err, ErrE2EDisabled), errors.Is(err, ErrInvalidCiphertext),
+		errors.Is(err, ErrInvalidDeviceID), errors.Is(err, models.ErrInvalidMessageExpiry),
+		errors.Is(err, ErrInvalidClientMsgID), errors.Is(err, ErrE2EUnavailable),
+		errors.Is(err, ErrReceiverNotPartner):
+		return err.Error()
+	case errors.Is(err, models.ErrAttachmentNotFound), errors.Is(err, models.ErrAttachmentInUse):
+		return "Attachments must be your own unsent uploads"
+	default:
+		log.Printf("Failed to store message from %s: %v", username, err)
+		return "Failed to send message"
+	}
+}
+
+// NotifyUser pushes a notification to every open connection of a user. It
+// never waits on a busy hub, so request handlers can call it: the push is
+// dropped instead, and the stored notification is still listed for the user.
+func NotifyUser(userID primitive.ObjectID, content string, data interface{}) {
+	hub.Broadcast(Message{
+		Type:        Notification,
+		Content:     content,
+		Data:        data,
+		RecipientID: userID,
+		Timestamp:   time.Now().Unix(),
+	})
+}
+
+// parseObjectIDs parses hex IDs sent by a client
+func parseObjectIDs(hexIDs []string) ([]primitive.ObjectID, error) {
+	ids := make([]primitive.ObjectID, 0, len(hexIDs))
+	for _, hexID := range hexIDs {
+		id, err := primitive.ObjectIDFromHex(hexID)
+		if err != nil {
+			return nil, err
 		}
+		ids = append(ids, id)
 	}
+	return ids, nil
 }
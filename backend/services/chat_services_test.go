@@ -0,0 +1,25 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/KevinChaves65/Project_Boo/models"
+)
+
+func TestPostErrorReasonHidesUnexpectedErrors(t *testing.T) {
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{ErrMessageTooLong, ErrMessageTooLong.Error()},
+		{ErrE2ERequired, ErrE2ERequired.Error()},
+		{models.ErrAttachmentInUse, "Attachments must be your own unsent uploads"},
+		{errors.New("connection reset by mongo-0.internal:27017"), "Failed to send message"},
+	}
+	for _, c := range cases {
+		if got := postErrorReason("alice", c.err); got != c.want {
+			t.Errorf("postErrorReason(%v) = %q, want %q", c.err, got, c.want)
+		}
+	}
+}
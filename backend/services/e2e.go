@@ -0,0 +1,227 @@
+package services
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/base64"
+	"errors"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/KevinChaves65/Project_Boo/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// maxCiphertextLength bounds one device's ciphertext, in base64 characters
+	maxCiphertextLength = 64 * 1024
+	// maxMessageDevices bounds how many devices one message is sealed for
+	maxMessageDevices = 20
+)
+
+var (
+	ErrInvalidPublicKey  = errors.New("public key must be a base64 X25519 key")
+	ErrInvalidDeviceID   = errors.New("device id must be 1-64 letters, digits, '-' or '_'")
+	ErrPartnerHasNoKeys  = errors.New("both partners need a registered device key first")
+	ErrE2EOffPending     = errors.New("end-to-end encryption stays on until your partner agrees to turn it off")
+	ErrE2ERequired       = errors.New("this couple uses end-to-end encryption; send ciphertexts instead of content")
+	ErrE2EDisabled       = errors.New("end-to-end encryption is not enabled for this couple")
+	ErrE2EUnavailable    = errors.New("this feature is unavailable with end-to-end encryption")
+	ErrInvalidCiphertext = errors.New("invalid end-to-end ciphertexts")
+)
+
+var deviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// validatePublicKey checks that a key is a usable X25519 public key
+func validatePublicKey(publicKey string) error {
+	raw, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return ErrInvalidPublicKey
+	}
+	if _, err := ecdh.X25519().NewPublicKey(raw); err != nil {
+		return ErrInvalidPublicKey
+	}
+	// The all-zero point would make every shared secret zero
+	if bytes.Equal(raw, make([]byte, len(raw))) {
+		return ErrInvalidPublicKey
+	}
+	return nil
+}
+
+// PublishDeviceKey registers or replaces the identity key of one of the
+// principal's devices and announces the change to the couple
+func PublishDeviceKey(principal *middlewares.Principal, deviceID, publicKey string) (models.DeviceKey, error) {
+	if !deviceIDPattern.MatchString(deviceID) {
+		return models.DeviceKey{}, ErrInvalidDeviceID
+	}
+	if err := validatePublicKey(publicKey); err != nil {
+		return models.DeviceKey{}, err
+	}
+
+	key, changed, err := models.PublishDeviceKey(principal.UserID, deviceID, publicKey)
+	if err != nil {
+		return key, err
+	}
+	if changed {
+		announceKeyChange(principal)
+	}
+	return key, nil
+}
+
+// RemoveDeviceKey removes one of the principal's devices from the key directory
+func RemoveDeviceKey(principal *middlewares.Principal, deviceID string) error {
+	if err := models.DeleteDeviceKey(principal.UserID, deviceID); err != nil {
+		return err
+	}
+	announceKeyChange(principal)
+	return nil
+}
+
+// SafetyNumber computes the safety number of a user and their partner
+func SafetyNumber(userID, partnerID primitive.ObjectID) (string, error) {
+	userKeys, err := models.GetDeviceKeys(userID)
+	if err != nil {
+		return "", err
+	}
+	partnerKeys, err := models.GetDeviceKeys(partnerID)
+	if err != nil {
+		return "", err
+	}
+	return utils.SafetyNumber(userID.Hex(), publicKeys(userKeys), partnerID.Hex(), publicKeys(partnerKeys)), nil
+}
+
+func publicKeys(keys []models.DeviceKey) []string {
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = key.PublicKey
+	}
+	return values
+}
+
+// announceKeyChange tells the couple that the principal's keys changed, with
+// the new safety number, so clients can warn before trusting the new keys
+func announceKeyChange(principal *middlewares.Principal) {
+	if !principal.HasCouple() {
+		return
+	}
+	safetyNumber, err := SafetyNumber(principal.UserID, *principal.PartnerID)
+	if err != nil {
+		log.Printf("Failed to compute safety number for couple %s: %v", principal.CoupleID.Hex(), err)
+		return
+	}
+
+	hub.Broadcast(Message{
+		Type:      KeyChanged,
+		Sender:    principal.Username,
+		CoupleID:  principal.CoupleID.Hex(),
+		Data:      map[string]interface{}{"user_id": principal.UserID.Hex(), "safety_number": safetyNumber},
+		Timestamp: time.Now().Unix(),
+	})
+	if partner, err := models.GetUserByID(*principal.PartnerID); err == nil {
+		Notify(partner, "safety_number_changed", "Your partner's safety number changed",
+			bson.M{"user_id": principal.UserID.Hex(), "safety_number": safetyNumber})
+	}
+}
+
+// SetE2E turns end-to-end encryption on or off for the principal's couple.
+// One partner cannot turn it off alone: the first one asking records a
+// request, ErrE2EOffPending is returned and the partner is asked to agree by
+// turning it off too. Turning it on drops such a request. Turning it on drops
+// the couple's search index, since search needs plaintext; turning it off
+// lets the existing history be indexed again.
+func SetE2E(principal *middlewares.Principal, enabled bool) error {
+	if enabled {
+		for _, userID := range []primitive.ObjectID{principal.UserID, *principal.PartnerID} {
+			keys, err := models.GetDeviceKeys(userID)
+			if err != nil {
+				return err
+			}
+			if len(keys) == 0 {
+				return ErrPartnerHasNoKeys
+			}
+		}
+	}
+
+	changed, err := models.SetCoupleE2E(*principal.CoupleID, principal.UserID, enabled)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		if enabled {
+			cancelled, err := models.CancelCoupleE2EOff(*principal.CoupleID)
+			if err == nil && cancelled {
+				notifyPartner(principal, "e2e_off_declined", principal.Username+" kept end-to-end encryption on")
+			}
+			return err
+		}
+		requested, err := models.RequestCoupleE2EOff(*principal.CoupleID, principal.UserID)
+		if err != nil || !requested {
+			return err
+		}
+		notifyPartner(principal, "e2e_off_requested", principal.Username+" asked to turn off end-to-end encryption. It stays on until you agree.")
+		return ErrE2EOffPending
+	}
+
+	if enabled {
+		if err := models.RemoveCoupleSearchIndex(*principal.CoupleID); err != nil {
+			log.Printf("Failed to drop search index of couple %s: %v", principal.CoupleID.Hex(), err)
+		}
+		notifyPartner(principal, "e2e_enabled", principal.Username+" turned on end-to-end encryption")
+	} else {
+		go BackfillSearchIndex()
+		notifyPartner(principal, "e2e_disabled", principal.Username+" agreed to turn off end-to-end encryption")
+	}
+
+	hub.Broadcast(Message{
+		Type:      E2EChanged,
+		Sender:    principal.Username,
+		CoupleID:  principal.CoupleID.Hex(),
+		Data:      map[string]interface{}{"enabled": enabled, "changed_by": principal.UserID.Hex()},
+		Timestamp: time.Now().Unix(),
+	})
+	return nil
+}
+
+// notifyPartner tells the principal's partner about a change to the couple's
+// end-to-end encryption
+func notifyPartner(principal *middlewares.Principal, notificationType, message string) {
+	partner, err := models.GetUserByID(*principal.PartnerID)
+	if err != nil {
+		log.Printf("Failed to load partner of %s: %v", principal.Username, err)
+		return
+	}
+	Notify(partner, notificationType, message, bson.M{"couple_id": principal.CoupleID.Hex()})
+}
+
+// coupleUsesE2E reports whether a couple has end-to-end encryption turned on
+func coupleUsesE2E(coupleID *primitive.ObjectID) (bool, error) {
+	if coupleID == nil {
+		return false, nil
+	}
+	couple, err := models.GetCoupleByID(*coupleID)
+	if err != nil {
+		return false, err
+	}
+	return couple.E2EEnabled, nil
+}
+
+// validateCiphertexts checks the per-device ciphertexts of an end-to-end
+// message. Every ciphertext must be addressed to one of the couple's devices.
+func validateCiphertexts(couple models.Couple, ciphertexts []models.DeviceCiphertext) error {
+	if len(ciphertexts) == 0 || len(ciphertexts) > maxMessageDevices {
+		return ErrInvalidCiphertext
+	}
+	for _, ciphertext := range ciphertexts {
+		if !couple.IsMember(ciphertext.UserID) || !deviceIDPattern.MatchString(ciphertext.DeviceID) {
+			return ErrInvalidCiphertext
+		}
+		if ciphertext.Ciphertext == "" || len(ciphertext.Ciphertext) > maxCiphertextLength {
+			return ErrInvalidCiphertext
+		}
+	}
+	return nil
+}
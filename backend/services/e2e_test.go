@@ -0,0 +1,152 @@
+package services
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// newPublicKey returns a fresh X25519 public key, base64 encoded
+func newPublicKey(t *testing.T) string {
+	t.Helper()
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(private.PublicKey().Bytes())
+}
+
+// couplePrincipal is a caller linked with a partner
+func couplePrincipal() *middlewares.Principal {
+	coupleID := primitive.NewObjectID()
+	partnerID := primitive.NewObjectID()
+	return &middlewares.Principal{UserID: primitive.NewObjectID(), Username: "alice", CoupleID: &coupleID, PartnerID: &partnerID}
+}
+
+func TestPublishDeviceKey(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	principal := &middlewares.Principal{UserID: primitive.NewObjectID(), Username: "alice"}
+
+	mt.Run("rejects invalid input", func(mt *mtest.T) {
+		config.DB = mt.DB
+		if _, err := PublishDeviceKey(principal, "phone 1", newPublicKey(t)); !errors.Is(err, ErrInvalidDeviceID) {
+			mt.Fatalf("got %v, want ErrInvalidDeviceID", err)
+		}
+		zero := base64.StdEncoding.EncodeToString(make([]byte, 32))
+		for _, key := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short")), zero} {
+			if _, err := PublishDeviceKey(principal, "phone", key); !errors.Is(err, ErrInvalidPublicKey) {
+				mt.Fatalf("%q: got %v, want ErrInvalidPublicKey", key, err)
+			}
+		}
+	})
+
+	mt.Run("registers a new device", func(mt *mtest.T) {
+		config.DB = mt.DB
+		publicKey := newPublicKey(t)
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}),
+			mtest.CreateCursorResponse(0, "db.device_keys", mtest.FirstBatch, bson.D{
+				{Key: "_id", Value: primitive.NewObjectID()},
+				{Key: "user_id", Value: principal.UserID},
+				{Key: "device_id", Value: "phone"},
+				{Key: "public_key", Value: publicKey},
+			}),
+		)
+		key, err := PublishDeviceKey(principal, "phone", publicKey)
+		if err != nil {
+			mt.Fatal(err)
+		}
+		if key.DeviceID != "phone" || key.PublicKey != publicKey {
+			mt.Fatalf("got %+v", key)
+		}
+		if upsert, _ := mt.GetStartedEvent().Command.Lookup("upsert").BooleanOK(); !upsert {
+			mt.Fatal("device key was not upserted")
+		}
+	})
+}
+
+func TestSetE2E(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	partner := func(principal *middlewares.Principal) bson.D {
+		return mtest.CreateCursorResponse(0, "db.users", mtest.FirstBatch, bson.D{
+			{Key: "_id", Value: *principal.PartnerID},
+			{Key: "username", Value: "bob"},
+		})
+	}
+	deviceKey := func(userID primitive.ObjectID) bson.D {
+		return mtest.CreateCursorResponse(0, "db.device_keys", mtest.FirstBatch, bson.D{
+			{Key: "user_id", Value: userID},
+			{Key: "device_id", Value: "phone"},
+			{Key: "public_key", Value: newPublicKey(t)},
+		})
+	}
+	updated := func(n int) bson.D {
+		return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: n}, bson.E{Key: "nModified", Value: n})
+	}
+
+	mt.Run("turning on needs both partners' keys", func(mt *mtest.T) {
+		config.DB = mt.DB
+		principal := couplePrincipal()
+		mt.AddMockResponses(
+			deviceKey(principal.UserID),
+			mtest.CreateCursorResponse(0, "db.device_keys", mtest.FirstBatch),
+		)
+		if err := SetE2E(principal, true); !errors.Is(err, ErrPartnerHasNoKeys) {
+			mt.Fatalf("got %v, want ErrPartnerHasNoKeys", err)
+		}
+	})
+
+	mt.Run("one partner cannot turn it off alone", func(mt *mtest.T) {
+		config.DB = mt.DB
+		principal := couplePrincipal()
+		mt.AddMockResponses(updated(0), updated(1), partner(principal), mtest.CreateSuccessResponse())
+		if err := SetE2E(principal, false); !errors.Is(err, ErrE2EOffPending) {
+			mt.Fatalf("got %v, want ErrE2EOffPending", err)
+		}
+
+		// Turning it off only matches a request made by the other partner
+		turnOff := mt.GetStartedEvent().Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("q")
+		if requester := turnOff.Document().Lookup("e2e_off_requested_by", "$ne").ObjectID(); requester != principal.UserID {
+			mt.Fatalf("turning off does not exclude the caller's own request: %s", turnOff)
+		}
+		request := mt.GetStartedEvent().Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("u")
+		if requester := request.Document().Lookup("$set", "e2e_off_requested_by").ObjectID(); requester != principal.UserID {
+			mt.Fatalf("request not recorded for the caller: %s", request)
+		}
+		mt.GetStartedEvent() // Loading the partner
+		if kind := mt.GetStartedEvent().Command.Lookup("documents").Array().Index(0).Value().Document().Lookup("type").StringValue(); kind != "e2e_off_requested" {
+			mt.Fatalf("partner was notified with %q", kind)
+		}
+	})
+
+	mt.Run("turning it on drops a pending request", func(mt *mtest.T) {
+		config.DB = mt.DB
+		principal := couplePrincipal()
+		mt.AddMockResponses(
+			deviceKey(principal.UserID),
+			deviceKey(*principal.PartnerID),
+			updated(0),
+			updated(1),
+			partner(principal),
+			mtest.CreateSuccessResponse(),
+		)
+		if err := SetE2E(principal, true); err != nil {
+			mt.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			mt.GetStartedEvent()
+		}
+		if kind := mt.GetStartedEvent().Command.Lookup("documents").Array().Index(0).Value().Document().Lookup("type").StringValue(); kind != "e2e_off_declined" {
+			mt.Fatalf("partner was notified with %q", kind)
+		}
+	})
+}
@@ -0,0 +1,23 @@
+package services
+
+import (
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/models"
+)
+
+// ConnectEntityChanges sends every change the models store to couple data to
+// all connected devices of both partners, so each device stays in sync
+// without reloading
+func ConnectEntityChanges() {
+	models.OnEntityChange(publishEntityChange)
+}
+
+func publishEntityChange(change models.EntityChange) {
+	hub.Broadcast(Message{
+		Type:      EntityChanged,
+		CoupleID:  change.CoupleID.Hex(),
+		Data:      change,
+		Timestamp: time.Now().Unix(),
+	})
+}
@@ -0,0 +1,204 @@
+package services
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/KevinChaves65/Project_Boo/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// replayBatchSize is how many logged events are read at a time when resuming
+	replayBatchSize = 200
+	// maxEventsAhead bounds how many out-of-order events a stream waits on
+	// before giving up on the missing ones
+	maxEventsAhead = 256
+)
+
+// logged reports whether a frame goes into the couple's event log. Frames for
+// one user or one connection are not logged, and neither are typing and
+// join/leave frames, which mean nothing once they are old.
+func (m Message) logged() bool {
+	if m.client != nil || !m.RecipientID.IsZero() || m.CoupleID == "" {
+		return false
+	}
+	switch m.Type {
+	case TypingStart, TypingStop, UserJoined, UserLeft:
+		return false
+	case EntityChanged:
+		// A deleted couple's log went with it
+		change, ok := m.Data.(models.EntityChange)
+		return !ok || change.Entity != models.EntityCouple || change.Action != models.EntityDeleted
+	}
+	return true
+}
+
+// logEvent numbers the frame and stores it, encrypted, in the couple's event
+// log. A frame that cannot be logged is still delivered live, without a seq.
+func logEvent(msg *Message) {
+	coupleID, err := primitive.ObjectIDFromHex(msg.CoupleID)
+	if err != nil {
+		return
+	}
+	var messageID *primitive.ObjectID
+	if id, err := primitive.ObjectIDFromHex(msg.ID); err == nil {
+		messageID = &id
+	}
+	_, err = models.AppendChatEvent(coupleID, messageID, func(seq int64) (string, error) {
+		msg.Seq = seq
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return "", err
+		}
+		return utils.EncryptMessage(string(data))
+	})
+	if err != nil {
+		msg.Seq = 0
+		log.Printf("Failed to log %s event for couple %s: %v", msg.Type, msg.CoupleID, err)
+	}
+}
+
+// eventCursor tracks which of a couple's events a stream has sent. Frames can
+// arrive slightly out of order when several instances broadcast at once, so
+// last only moves past seqs once everything before them was sent too.
+type eventCursor struct {
+	last  int64
+	ahead map[int64]bool
+}
+
+func newEventCursor(last int64) *eventCursor {
+	return &eventCursor{last: last, ahead: make(map[int64]bool)}
+}
+
+// advance records seq as sent and reports whether it is new to the stream
+func (c *eventCursor) advance(seq int64) bool {
+	if seq <= c.last || c.ahead[seq] {
+		return false
+	}
+	c.ahead[seq] = true
+
+	// A seq that never shows up, e.g. when its frame failed to be logged,
+	// must not hold the cursor back forever
+	if len(c.ahead) > maxEventsAhead {
+		lowest := seq
+		for pending := range c.ahead {
+			if pending < lowest {
+				lowest = pending
+			}
+		}
+		c.last = lowest - 1
+	}
+
+	for c.ahead[c.last+1] {
+		delete(c.ahead, c.last+1)
+		c.last++
+	}
+	return true
+}
+
+// skipTo moves the cursor past events that are no longer in the log
+func (c *eventCursor) skipTo(seq int64) {
+	if seq <= c.last {
+		return
+	}
+	c.last = seq
+	for pending := range c.ahead {
+		if pending <= seq {
+			delete(c.ahead, pending)
+		}
+	}
+	for c.ahead[c.last+1] {
+		delete(c.ahead, c.last+1)
+		c.last++
+	}
+}
+
+// missedEvents loads the couple's logged events after the cursor, decrypted
+// and in order. skipped is non-zero when events the cursor has not seen were
+// already dropped from the log; everything up to skipped is gone.
+func missedEvents(coupleID primitive.ObjectID, cursor *eventCursor) (frames [][]byte, seqs []int64, skipped int64, err error) {
+	current, err := models.GetChatEventSeq(coupleID)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	// Never trust a cursor ahead of the log
+	if cursor.last > current {
+		cursor.last = current
+	}
+
+	after := cursor.last
+	for after < current {
+		events, err := models.GetChatEventsAfter(coupleID, after, replayBatchSize)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if len(events) == 0 {
+			if after == cursor.last {
+				// Everything the cursor missed has expired
+				skipped = current
+			}
+			break
+		}
+		if after == cursor.last && events[0].Seq > after+1 {
+			skipped = events[0].Seq - 1
+		}
+
+		for _, event := range events {
+			payload, err := utils.DecryptMessage(event.Payload)
+			if err != nil {
+				log.Printf("Failed to decrypt event %d of couple %s: %v", event.Seq, coupleID.Hex(), err)
+				continue
+			}
+			frames = append(frames, []byte(payload))
+			seqs = append(seqs, event.Seq)
+		}
+		after = events[len(events)-1].Seq
+	}
+	return frames, seqs, skipped, nil
+}
+
+// replayMissed writes the logged events the cursor has not seen, in order,
+// preceded by a reset frame when some of them are no longer in the log
+func replayMissed(coupleID primitive.ObjectID, cursor *eventCursor, write func(data []byte) error) error {
+	frames, seqs, skipped, err := missedEvents(coupleID, cursor)
+	if err != nil {
+		return err
+	}
+	return writeMissed(coupleID, cursor, frames, seqs, skipped, write)
+}
+
+// writeMissed writes events loaded by missedEvents, skipping any the cursor
+// has seen since they were loaded
+func writeMissed(coupleID primitive.ObjectID, cursor *eventCursor, frames [][]byte, seqs []int64, skipped int64, write func(data []byte) error) error {
+	if skipped > 0 {
+		cursor.skipTo(skipped)
+		reset, err := json.Marshal(Message{Type: StreamReset, CoupleID: coupleID.Hex(), Seq: skipped, Timestamp: time.Now().Unix()})
+		if err != nil {
+			return err
+		}
+		if err := write(reset); err != nil {
+			return err
+		}
+	}
+	for i, frame := range frames {
+		if !cursor.advance(seqs[i]) {
+			continue
+		}
+		if err := write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// frameSeq reads the seq of an encoded frame, 0 if it has none
+func frameSeq(data []byte) int64 {
+	var header struct {
+		Seq int64 `json:"seq"`
+	}
+	json.Unmarshal(data, &header)
+	return header.Seq
+}
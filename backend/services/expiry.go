@@ -0,0 +1,138 @@
+package services
+
+import (
+	"log"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"github.com/KevinChaves65/Project_Boo/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// expirySweepBatchSize is how many expired messages one sweep pass removes
+const expirySweepBatchSize = 200
+
+// ExpiryCountdown tells clients when a message will disappear
+type ExpiryCountdown struct {
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// messageExpiry picks the lifetime of a new message: the sender's choice for
+// this message if they made one, otherwise the couple's default
+func messageExpiry(couple models.Couple, post ChatPost) (models.MessageExpiry, error) {
+	if post.Expiry == nil {
+		return couple.MessageExpiry, nil
+	}
+	if err := post.Expiry.Validate(); err != nil {
+		return models.MessageExpiry{}, err
+	}
+	return *post.Expiry, nil
+}
+
+// SetMessageExpiry changes how long the couple's new messages live and tells the couple
+func SetMessageExpiry(principal *middlewares.Principal, expiry models.MessageExpiry) error {
+	if err := expiry.Validate(); err != nil {
+		return err
+	}
+	if err := models.SetCoupleMessageExpiry(*principal.CoupleID, expiry); err != nil {
+		return err
+	}
+
+	hub.Broadcast(Message{
+		Type:      ExpiryChanged,
+		Sender:    principal.Username,
+		CoupleID:  principal.CoupleID.Hex(),
+		Data:      expiry,
+		Timestamp: time.Now().Unix(),
+	})
+	return nil
+}
+
+// publishCountdowns tells each couple which of its messages started
+// disappearing after being read
+func publishCountdowns(messages []models.Message) {
+	countdowns := make(map[primitive.ObjectID][]ExpiryCountdown)
+	for _, message := range messages {
+		if message.CoupleID == nil || message.ExpiresAt == nil {
+			continue
+		}
+		countdowns[*message.CoupleID] = append(countdowns[*message.CoupleID], ExpiryCountdown{
+			ID:        message.ID.Hex(),
+			ExpiresAt: *message.ExpiresAt,
+		})
+	}
+	for coupleID, couple := range countdowns {
+		hub.Broadcast(Message{
+			Type:      MessageExpiring,
+			CoupleID:  coupleID.Hex(),
+			Data:      couple,
+			Timestamp: time.Now().Unix(),
+		})
+	}
+}
+
+// RunMessageExpiry removes disappearing messages as they expire, together
+// with their reactions, search entries, attachments and logged events, and
+// tells the couple. Every instance may run it; a message is only announced by
+// the sweeper that actually deleted it.
+func RunMessageExpiry(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for {
+			messages, err := models.GetExpiredMessages(time.Now(), expirySweepBatchSize)
+			if err != nil {
+				log.Printf("Failed to load expired messages: %v", err)
+				break
+			}
+			for _, message := range messages {
+				expireMessage(message)
+			}
+			if len(messages) < expirySweepBatchSize {
+				break
+			}
+		}
+	}
+}
+
+func expireMessage(message models.Message) {
+	// Remove what hangs off the message first, so a sweep interrupted half-way
+	// is finished by the next one
+	if err := models.DeleteMessageReactions(message.ID); err != nil {
+		log.Printf("Failed to delete reactions of expired message %s: %v", message.ID.Hex(), err)
+		return
+	}
+	if err := models.RemoveMessageIndex(message.ID); err != nil {
+		log.Printf("Failed to remove expired message %s from the search index: %v", message.ID.Hex(), err)
+		return
+	}
+	if err := models.DeleteAttachments(bson.M{"message_id": message.ID}); err != nil {
+		log.Printf("Failed to delete attachments of expired message %s: %v", message.ID.Hex(), err)
+		return
+	}
+	if err := models.DeleteMessageEvents(message.ID); err != nil {
+		log.Printf("Failed to delete events of expired message %s: %v", message.ID.Hex(), err)
+		return
+	}
+
+	deleted, err := models.DeleteExpiredMessage(message.ID)
+	if err != nil {
+		log.Printf("Failed to delete expired message %s: %v", message.ID.Hex(), err)
+		return
+	}
+	if deleted && message.CoupleID != nil {
+		hub.Broadcast(Message{
+			Type:       MessageExpired,
+			ID:         message.ID.Hex(),
+			Sender:     message.Sender,
+			Receiver:   message.Receiver,
+			SenderID:   message.SenderID.Hex(),
+			ReceiverID: message.ReceiverID.Hex(),
+			CoupleID:   message.CoupleID.Hex(),
+			Timestamp:  time.Now().Unix(),
+		})
+	}
+}
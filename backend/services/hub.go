@@ -0,0 +1,387 @@
+package services
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// writeWait is the time allowed to write a frame to the peer
+	writeWait = 10 * time.Second
+	// pongWait is the time allowed to read the next pong from the peer
+	pongWait = 60 * time.Second
+	// pingPeriod must be shorter than pongWait so pings arrive before the deadline
+	pingPeriod = (pongWait * 9) / 10
+	// maxFrameSize is the largest frame accepted from a client
+	maxFrameSize = 64 * 1024
+	// sendBufferSize is how many frames may queue for a client before it is evicted
+	sendBufferSize = 256
+	// outboundQueueSize is how many broadcast frames may wait to be logged
+	outboundQueueSize = 4096
+	// relayQueueSize is how many frames may wait to be published to the backplane
+	relayQueueSize = 4096
+)
+
+// Client is one WebSocket connection or event stream registered with the hub.
+// Only the hub goroutine touches the client set, and only writePump writes to
+// Conn. Event streams have no Conn and drain send themselves.
+type Client struct {
+	Conn      *websocket.Conn
+	Username  string
+	CoupleID  string
+	UserID    primitive.ObjectID
+	SessionID primitive.ObjectID
+	ConnID    primitive.ObjectID // Identifies this connection among the user's devices
+	Version   int                // Protocol version the client said hello with; 0 until then
+
+	send   chan []byte
+	resume chan resumePlan // answered hello frames handed from the reader to writePump
+}
+
+// NewClient creates a client with an empty send queue
+func NewClient(conn *websocket.Conn) *Client {
+	return &Client{
+		Conn:   conn,
+		ConnID: primitive.NewObjectID(),
+		send:   make(chan []byte, sendBufferSize),
+		resume: make(chan resumePlan, 1),
+	}
+}
+
+// outboundFrame is a broadcast frame waiting to be logged. seq, when set,
+// receives the frame's seq once it is logged.
+type outboundFrame struct {
+	msg Message
+	seq chan int64
+}
+
+// Hub keeps the set of connected clients and fans messages out to them
+type Hub struct {
+	clients    map[*Client]bool
+	register   chan *Client
+	unregister chan *Client
+	broadcast  chan Message
+	// outbound holds frames to log before fan-out, relay those to publish to the backplane
+	outbound chan outboundFrame
+	relay    chan BackplaneEnvelope
+	// backplane relays frames to the other API instances; nil when running alone
+	backplane Backplane
+}
+
+// NewHub creates a hub; call Run to start it
+func NewHub() *Hub {
+	return &Hub{
+		clients:    make(map[*Client]bool),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		broadcast:  make(chan Message, 1024),
+		outbound:   make(chan outboundFrame, outboundQueueSize),
+		relay:      make(chan BackplaneEnvelope, relayQueueSize),
+	}
+}
+
+var hub = NewHub()
+
+// HandleMessages runs the chat hub until the process exits
+func HandleMessages() {
+	hub.Run()
+}
+
+// Broadcast queues a message for delivery by the hub
+func Broadcast(msg Message) {
+	hub.Broadcast(msg)
+}
+
+// Register adds a client to the hub
+func (h *Hub) Register(client *Client) {
+	h.register <- client
+}
+
+// Unregister removes a client from the hub and closes its send queue
+func (h *Hub) Unregister(client *Client) {
+	h.unregister <- client
+}
+
+// Broadcast queues a message for delivery to the clients it targets, on this
+// instance and, through the backplane, on every other one. Couple events are
+// numbered and logged first so streams can resume after a reconnect. Logging
+// and publishing happen on the hub's own goroutines, so a slow database or
+// backplane never holds up the caller.
+func (h *Hub) Broadcast(msg Message) {
+	if msg.logged() {
+		h.outbound <- outboundFrame{msg: msg}
+		return
+	}
+	// Frames that are not logged mean little once late, so they are dropped
+	// rather than wait for room
+	select {
+	case h.outbound <- outboundFrame{msg: msg}:
+	default:
+		log.Printf("Dropping %s message: the hub is backed up", msg.Type)
+	}
+}
+
+// BroadcastLogged is Broadcast for callers that need the frame's seq. It waits
+// until the frame is logged and returns 0 for frames that are not logged.
+func (h *Hub) BroadcastLogged(msg Message) int64 {
+	seq := make(chan int64, 1)
+	h.outbound <- outboundFrame{msg: msg, seq: seq}
+	return <-seq
+}
+
+// runOutbound logs queued frames in order and hands them to Run for fan-out
+// and to runRelay for the other instances
+func (h *Hub) runOutbound() {
+	for frame := range h.outbound {
+		msg := frame.msg
+		if msg.logged() {
+			logEvent(&msg)
+		}
+		if frame.seq != nil {
+			frame.seq <- msg.Seq
+		}
+		h.broadcast <- msg
+
+		// Replies to one connection never leave the instance holding it
+		if h.backplane == nil || msg.client != nil {
+			continue
+		}
+		select {
+		case h.relay <- BackplaneEnvelope{Origin: config.InstanceID, RecipientID: msg.RecipientID, Message: msg}:
+		default:
+			log.Printf("Dropping %s message for the backplane: it is backed up", msg.Type)
+		}
+	}
+}
+
+// runRelay publishes frames to the backplane
+func (h *Hub) runRelay() {
+	for envelope := range h.relay {
+		if err := h.backplane.Publish(envelope); err != nil {
+			log.Printf("Failed to publish %s message to the backplane: %v", envelope.Message.Type, err)
+		}
+	}
+}
+
+// Run owns the client set. Registration, removal and fan-out all happen on
+// this goroutine, so the set needs no lock.
+func (h *Hub) Run() {
+	go h.runOutbound()
+	go h.runRelay()
+	for {
+		select {
+		case client := <-h.register:
+			h.clients[client] = true
+
+		case client := <-h.unregister:
+			h.remove(client)
+
+		case msg := <-h.broadcast:
+			data, err := json.Marshal(msg)
+			if err != nil {
+				log.Printf("Failed to encode %s message: %v", msg.Type, err)
+				continue
+			}
+
+			delivered := false
+			for client := range h.clients {
+				if !msg.targets(client) {
+					continue
+				}
+				select {
+				case client.send <- data:
+					if msg.Type == ChatMessage && client.UserID.Hex() == msg.ReceiverID {
+						delivered = true
+					}
+				default:
+					// The client is not keeping up; drop it rather than stall everyone else
+					log.Printf("Evicting slow client %s", client.Username)
+					h.remove(client)
+				}
+			}
+
+			// Recording the receipt touches the database, so keep it off the hub goroutine
+			if delivered {
+				go markDelivered(msg)
+			}
+		}
+	}
+}
+
+func (h *Hub) remove(client *Client) {
+	if _, ok := h.clients[client]; ok {
+		delete(h.clients, client)
+		close(client.send)
+	}
+}
+
+// targets reports whether the message should be delivered to the client
+func (m Message) targets(client *Client) bool {
+	// Replies to a single connection
+	if m.client != nil {
+		return client == m.client
+	}
+	// Messages for one user go to all of that user's connections. They are
+	// matched by user ID, since a socket keeps the username it connected with.
+	if !m.RecipientID.IsZero() {
+		return client.UserID == m.RecipientID
+	}
+	// Only send to clients in the same couple
+	return client.CoupleID == m.CoupleID
+}
+
+// resumePlan is the answer to a hello: the welcome frame and the events after
+// the client's LastSeq. The reader loads it, so writePump never waits on the
+// database while frames queue up.
+type resumePlan struct {
+	welcome  []byte
+	coupleID primitive.ObjectID
+	cursor   *eventCursor
+	frames   [][]byte
+	seqs     []int64
+	skipped  int64
+}
+
+// requestResume answers a hello frame: it loads the events after its LastSeq
+// and hands them to writePump, which replays them before any newer frame
+func (c *Client) requestResume(hello Message) error {
+	plan, err := c.planResume(hello)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-c.resume:
+	default:
+	}
+	c.resume <- plan
+	return nil
+}
+
+// writePump writes queued frames and periodic pings to the connection. It is
+// the only goroutine that writes data frames to Conn. Once the client said
+// hello it also tracks which logged events were sent, so replayed and live
+// frames never reach the client twice. Events sent before the hello count as
+// sent too.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.Conn.Close()
+	}()
+
+	var cursor *eventCursor
+	// Seqs written before the client said hello, so the replay skips them
+	var early []int64
+	for {
+		select {
+		case data, ok := <-c.send:
+			if !ok {
+				// The hub closed the queue
+				c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if seq := frameSeq(data); seq > 0 {
+				if cursor != nil && !cursor.advance(seq) {
+					continue
+				}
+				if cursor == nil {
+					if len(early) == maxEventsAhead {
+						early = early[1:]
+					}
+					early = append(early, seq)
+				}
+			}
+			if err := c.writeFrame(data); err != nil {
+				log.Printf("WebSocket Write Error: %v", err)
+				return
+			}
+
+		case plan := <-c.resume:
+			cursor = plan.cursor
+			for _, seq := range early {
+				cursor.advance(seq)
+			}
+			early = nil
+			if err := c.writeResume(plan); err != nil {
+				log.Printf("WebSocket Write Error: %v", err)
+				return
+			}
+
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) writeFrame(data []byte) error {
+	c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.Conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// planResume loads the answer to a hello: it confirms the protocol version
+// and the head of the couple's event log, then replays the events after the
+// client's LastSeq. A hello without LastSeq starts from the head.
+func (c *Client) planResume(hello Message) (resumePlan, error) {
+	coupleID, err := primitive.ObjectIDFromHex(c.CoupleID)
+	if err != nil {
+		return resumePlan{}, err
+	}
+	head, err := models.GetChatEventSeq(coupleID)
+	if err != nil {
+		return resumePlan{}, err
+	}
+	last := hello.LastSeq
+	if last <= 0 || last > head {
+		last = head
+	}
+	plan := resumePlan{coupleID: coupleID, cursor: newEventCursor(last)}
+
+	plan.welcome, err = json.Marshal(Message{Type: Welcome, Version: hello.Version, Seq: head, CoupleID: c.CoupleID, Timestamp: time.Now().Unix()})
+	if err != nil {
+		return resumePlan{}, err
+	}
+	plan.frames, plan.seqs, plan.skipped, err = missedEvents(coupleID, plan.cursor)
+	return plan, err
+}
+
+// writeResume writes a loaded hello answer
+func (c *Client) writeResume(plan resumePlan) error {
+	if err := c.writeFrame(plan.welcome); err != nil {
+		return err
+	}
+	return writeMissed(plan.coupleID, plan.cursor, plan.frames, plan.seqs, plan.skipped, c.writeFrame)
+}
+
+// reply sends a frame to this connection only
+func (c *Client) reply(msg Message) {
+	msg.client = c
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().Unix()
+	}
+	hub.Broadcast(msg)
+}
+
+// sendError reports a rejected frame to this connection only
+func (c *Client) sendError(reason string) {
+	c.reply(Message{Type: ErrorMessage, Content: reason})
+}
+
+// prepareRead sets the read limit and keeps extending the read deadline while pongs arrive
+func (c *Client) prepareRead() {
+	c.Conn.SetReadLimit(maxFrameSize)
+	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+}
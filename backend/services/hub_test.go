@@ -0,0 +1,256 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testClient registers a client of the given couple with the hub. It has no
+// connection; tests read its send queue directly.
+func testClient(h *Hub, coupleID string) *Client {
+	client := NewClient(nil)
+	client.Username = "user-" + primitive.NewObjectID().Hex()
+	client.UserID = primitive.NewObjectID()
+	client.CoupleID = coupleID
+	h.Register(client)
+	return client
+}
+
+// typing is a frame that is fanned out to the couple but never logged, so the
+// hub can run without a database
+func typing(coupleID string) Message {
+	return Message{Type: TypingStart, CoupleID: coupleID, Timestamp: time.Now().Unix()}
+}
+
+// waitClosed drains the client's queue until the hub closes it
+func waitClosed(t *testing.T, client *Client) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-client.send:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("send queue was not closed")
+		}
+	}
+}
+
+func TestHubConcurrentRegisterBroadcastUnregister(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+
+	coupleID := primitive.NewObjectID().Hex()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := testClient(h, coupleID)
+			// Drain like a writePump would, until the hub closes the queue
+			drained := make(chan struct{})
+			go func() {
+				for range client.send {
+				}
+				close(drained)
+			}()
+			for j := 0; j < 20; j++ {
+				h.Broadcast(typing(coupleID))
+			}
+			h.Unregister(client)
+			<-drained
+		}()
+	}
+	wg.Wait()
+}
+
+func TestHubDeliversOnlyToTargets(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+
+	coupleID := primitive.NewObjectID().Hex()
+	member := testClient(h, coupleID)
+	stranger := testClient(h, primitive.NewObjectID().Hex())
+
+	h.Broadcast(typing(coupleID))
+	select {
+	case <-member.send:
+	case <-time.After(5 * time.Second):
+		t.Fatal("couple member did not receive the frame")
+	}
+
+	// Registration goes through the hub goroutine, so once it returns the
+	// broadcast above has been fanned out
+	testClient(h, coupleID)
+	select {
+	case data := <-stranger.send:
+		t.Fatalf("client of another couple received %s", data)
+	default:
+	}
+}
+
+func TestHubEvictsSlowClient(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+
+	coupleID := primitive.NewObjectID().Hex()
+	slow := testClient(h, coupleID)
+	fast := testClient(h, coupleID)
+
+	// Fill the slow client's queue as if its connection had stalled
+	for i := 0; i < sendBufferSize; i++ {
+		slow.send <- []byte("{}")
+	}
+	h.Broadcast(typing(coupleID))
+
+	select {
+	case <-fast.send:
+	case <-time.After(5 * time.Second):
+		t.Fatal("other clients should still receive the frame")
+	}
+	// A registration round trip guarantees the fan-out has finished before
+	// the slow client's queue is drained
+	testClient(h, primitive.NewObjectID().Hex())
+	waitClosed(t, slow)
+
+	// The evicted client unregistering later must not close its queue again
+	h.Unregister(slow)
+	h.Broadcast(typing(coupleID))
+	select {
+	case <-fast.send:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hub stopped after the slow client unregistered")
+	}
+}
+
+func TestHubRemoveIsIdempotent(t *testing.T) {
+	h := NewHub()
+	client := NewClient(nil)
+	h.clients[client] = true
+
+	h.remove(client)
+	h.remove(client)
+	if _, ok := <-client.send; ok {
+		t.Fatal("send queue should be closed")
+	}
+
+	// Unregistering twice through the hub is just as safe
+	h2 := NewHub()
+	go h2.Run()
+	other := testClient(h2, primitive.NewObjectID().Hex())
+	h2.Unregister(other)
+	h2.Unregister(other)
+	waitClosed(t, other)
+}
+
+func TestHubRoutesUserFramesByID(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+
+	// A socket opened before a rename keeps the old name, which someone else
+	// may have taken since
+	coupleID := primitive.NewObjectID().Hex()
+	renamed, newcomer := NewClient(nil), NewClient(nil)
+	for _, client := range []*Client{renamed, newcomer} {
+		client.Username = "taken"
+		client.UserID = primitive.NewObjectID()
+		client.CoupleID = primitive.NewObjectID().Hex()
+		h.Register(client)
+	}
+
+	h.Broadcast(Message{Type: Notification, Content: "hi", RecipientID: renamed.UserID})
+	select {
+	case <-renamed.send:
+	case <-time.After(5 * time.Second):
+		t.Fatal("recipient did not receive the frame")
+	}
+	testClient(h, coupleID)
+	select {
+	case data := <-newcomer.send:
+		t.Fatalf("user with the same name received %s", data)
+	default:
+	}
+}
+
+func TestWritePumpSkipsReplayOfFramesSentBeforeHello(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		client := NewClient(conn)
+		client.send <- []byte(`{"type":"chat","seq":5}`)
+		client.send <- []byte(`{"type":"typing_start"}`)
+		go client.writePump()
+
+		// Give writePump time to send the early frames first
+		time.Sleep(50 * time.Millisecond)
+		client.resume <- resumePlan{
+			welcome:  []byte(`{"type":"welcome","seq":5}`),
+			coupleID: primitive.NewObjectID(),
+			cursor:   newEventCursor(3),
+			frames:   [][]byte{[]byte(`{"type":"chat","seq":4}`), []byte(`{"type":"chat","seq":5}`)},
+			seqs:     []int64{4, 5},
+		}
+		client.send <- []byte(`{"type":"chat","seq":5}`)
+		client.send <- []byte(`{"type":"chat","seq":6}`)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	want := []string{
+		`{"type":"chat","seq":5}`,
+		`{"type":"typing_start"}`,
+		`{"type":"welcome","seq":5}`,
+		`{"type":"chat","seq":4}`,
+		`{"type":"chat","seq":6}`,
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i, frame := range want {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if string(data) != frame {
+			t.Fatalf("frame %d is %s, want %s", i, data, frame)
+		}
+	}
+}
+
+func TestNotifyUserDoesNotWaitOnBusyHub(t *testing.T) {
+	previous := hub
+	hub = NewHub()
+	defer func() { hub = previous }()
+
+	// Nothing drains the hub, so its queue fills up
+	for i := 0; i < cap(hub.outbound); i++ {
+		hub.outbound <- outboundFrame{msg: typing("couple")}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		NotifyUser(primitive.NewObjectID(), "hello", nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("NotifyUser blocked on a full hub")
+	}
+}
@@ -0,0 +1,23 @@
+package services
+
+import (
+	"log"
+
+	"github.com/KevinChaves65/Project_Boo/models"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Notify stores a notification for a user and pushes it to their open connections
+func Notify(user models.User, notificationType, message string, data bson.M) {
+	notification, err := models.AddNotification(models.Notification{
+		UserID:  user.ID,
+		Type:    notificationType,
+		Message: message,
+		Data:    data,
+	})
+	if err != nil {
+		log.Printf("Failed to store notification for %s: %v", user.Username, err)
+		return
+	}
+	NotifyUser(user.ID, message, notification)
+}
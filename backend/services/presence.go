@@ -0,0 +1,119 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"github.com/KevinChaves65/Project_Boo/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// presenceTTL is how long a connection counts as live without a refresh
+	presenceTTL = 90 * time.Second
+	// presenceRefresh must be well under presenceTTL so live connections never lapse
+	presenceRefresh = 30 * time.Second
+)
+
+var ErrInvalidPresence = errors.New("presence must be online or away")
+
+// setPresence records the state a connection reports and tells the couple
+func setPresence(client *Client, state models.PresenceState) error {
+	if state != models.PresenceOnline && state != models.PresenceAway {
+		return ErrInvalidPresence
+	}
+	if err := models.SetConnectionPresence(client.ConnID, client.UserID, state, presenceTTL); err != nil {
+		return err
+	}
+	publishPresence(client.UserID, client.Username, client.CoupleID)
+	return nil
+}
+
+// clearPresence forgets a closed connection and tells the couple, who see the
+// user go offline once their last device disconnects. Disconnecting is what
+// moves the user's last-seen time.
+func clearPresence(client *Client) {
+	if err := models.DeleteConnectionPresence(client.ConnID); err != nil {
+		log.Printf("Failed to clear presence of %s: %v", client.Username, err)
+	}
+	if err := models.UpdateLastSeen(client.UserID, time.Now()); err != nil {
+		log.Printf("Failed to update last seen of %s: %v", client.Username, err)
+	}
+	publishPresence(client.UserID, client.Username, client.CoupleID)
+}
+
+// trackPresence keeps the connection's entry alive until done is closed
+func trackPresence(client *Client, done <-chan struct{}) {
+	ticker := time.NewTicker(presenceRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := models.RefreshConnectionPresence(client.ConnID, presenceTTL); err != nil {
+				log.Printf("Failed to refresh presence of %s: %v", client.Username, err)
+			}
+		}
+	}
+}
+
+// publishPresence broadcasts the user's combined presence to the couple
+func publishPresence(userID primitive.ObjectID, username, coupleID string) {
+	presence, err := models.GetUserPresence(userID)
+	if err != nil {
+		log.Printf("Failed to load presence of %s: %v", username, err)
+		return
+	}
+	hub.Broadcast(Message{
+		Type:      PresenceChanged,
+		Sender:    username,
+		Content:   string(presence.State),
+		CoupleID:  coupleID,
+		Timestamp: presenceTimestamp(presence.LastSeenHidden),
+		Data:      presence,
+	})
+}
+
+// presenceTimestamp is the time of a presence frame, which tells the partner
+// when the user was last around. It is left out for users who hide that.
+func presenceTimestamp(hidden bool) int64 {
+	if hidden {
+		return 0
+	}
+	return time.Now().Unix()
+}
+
+// joinLeaveFrame announces a connection opening or closing to the couple
+func joinLeaveFrame(msgType MessageType, client *Client) Message {
+	hidden := true
+	if user, err := models.GetUserByID(client.UserID); err == nil {
+		hidden = user.HideLastSeen
+	}
+	return Message{
+		Type:      msgType,
+		Sender:    client.Username,
+		CoupleID:  client.CoupleID,
+		Timestamp: presenceTimestamp(hidden),
+	}
+}
+
+// PartnerPresence returns the presence of the principal's partner
+func PartnerPresence(principal *middlewares.Principal) (models.Presence, error) {
+	return models.GetUserPresence(*principal.PartnerID)
+}
+
+// SetHideLastSeen changes the principal's last-seen privacy setting and
+// re-announces their presence so the partner drops or regains the timestamp
+func SetHideLastSeen(principal *middlewares.Principal, hide bool) error {
+	if err := models.SetHideLastSeen(principal.UserID, hide); err != nil {
+		return err
+	}
+	if principal.HasCouple() {
+		publishPresence(principal.UserID, principal.Username, principal.CoupleID.Hex())
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"github.com/KevinChaves65/Project_Boo/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxEmojiLength allows for multi-codepoint emoji such as skin tones and families
+const maxEmojiLength = 32
+
+var ErrInvalidEmoji = errors.New("reaction must be a single emoji")
+
+// ValidateEmoji does a cheap sanity check that a reaction looks like an emoji
+// rather than arbitrary text
+func ValidateEmoji(emoji string) error {
+	if emoji == "" || len(emoji) > maxEmojiLength || strings.ContainsAny(emoji, " \t\r\n") {
+		return ErrInvalidEmoji
+	}
+	for _, r := range emoji {
+		if r >= utf8.RuneSelf {
+			return nil
+		}
+	}
+	return ErrInvalidEmoji
+}
+
+// reactableMessage loads a message the principal took part in and that was not unsent
+func reactableMessage(principal *middlewares.Principal, messageID primitive.ObjectID) (models.Message, error) {
+	message, err := models.GetMessageByID(messageID)
+	if err != nil {
+		return message, err
+	}
+	if !message.IsParticipant(principal.UserID) {
+		return message, models.ErrMessageNotFound
+	}
+	if message.Deleted {
+		return message, models.ErrMessageDeleted
+	}
+	return message, nil
+}
+
+// AddReaction adds the principal's emoji to a message and tells the couple
+func AddReaction(principal *middlewares.Principal, messageID primitive.ObjectID, emoji string) error {
+	if err := ValidateEmoji(emoji); err != nil {
+		return err
+	}
+	message, err := reactableMessage(principal, messageID)
+	if err != nil {
+		return err
+	}
+
+	added, err := models.AddReaction(models.Reaction{
+		MessageID: message.ID,
+		CoupleID:  message.CoupleID,
+		UserID:    principal.UserID,
+		Username:  principal.Username,
+		Emoji:     emoji,
+	})
+	if err != nil {
+		return err
+	}
+	if added {
+		publishReaction(ReactionAdded, principal.Username, message, emoji)
+	}
+	return nil
+}
+
+// RemoveReaction removes the principal's emoji from a message and tells the couple
+func RemoveReaction(principal *middlewares.Principal, messageID primitive.ObjectID, emoji string) error {
+	message, err := reactableMessage(principal, messageID)
+	if err != nil {
+		return err
+	}
+	if err := models.RemoveReaction(message.ID, principal.UserID, emoji); err != nil {
+		return err
+	}
+	publishReaction(ReactionRemoved, principal.Username, message, emoji)
+	return nil
+}
+
+func publishReaction(eventType MessageType, username string, message models.Message, emoji string) {
+	if message.CoupleID == nil {
+		return
+	}
+	hub.Broadcast(Message{
+		Type:      eventType,
+		ID:        message.ID.Hex(),
+		Sender:    username,
+		Content:   emoji,
+		CoupleID:  message.CoupleID.Hex(),
+		Timestamp: time.Now().Unix(),
+	})
+}
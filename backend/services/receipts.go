@@ -0,0 +1,81 @@
+package services
+
+import (
+	"log"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"github.com/KevinChaves65/Project_Boo/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// StatusUpdate is the payload of a message_status event sent to the sender
+type StatusUpdate struct {
+	Status     models.MessageStatus `json:"status"`
+	MessageIDs []string             `json:"message_ids,omitempty"`
+	ReadUpTo   string               `json:"read_up_to,omitempty"`
+	At         time.Time            `json:"at"`
+}
+
+// AcknowledgeDelivered marks messages the receiver has been handed as
+// delivered and tells their senders. It returns the messages that changed.
+func AcknowledgeDelivered(receiverID primitive.ObjectID, ids []primitive.ObjectID) []models.Message {
+	if len(ids) == 0 {
+		return nil
+	}
+	messages, err := models.MarkMessagesDelivered(receiverID, ids)
+	if err != nil {
+		log.Printf("Failed to mark messages delivered for %s: %v", receiverID.Hex(), err)
+		return nil
+	}
+
+	bySender := make(map[primitive.ObjectID][]string)
+	receiver := ""
+	for _, message := range messages {
+		bySender[message.SenderID] = append(bySender[message.SenderID], message.ID.Hex())
+		receiver = message.Receiver
+	}
+	now := time.Now()
+	for senderID, messageIDs := range bySender {
+		publishStatus(receiver, senderID, StatusUpdate{Status: models.MessageDelivered, MessageIDs: messageIDs, At: now})
+	}
+	return messages
+}
+
+// AcknowledgeRead marks everything the reader received up to upTo as read and
+// tells the senders
+func AcknowledgeRead(reader *middlewares.Principal, upTo primitive.ObjectID) (models.ReadReceipt, error) {
+	receipt, err := models.MarkMessagesRead(reader.UserID, upTo)
+	if err != nil {
+		return receipt, err
+	}
+	for _, senderID := range receipt.Senders {
+		publishStatus(reader.Username, senderID, StatusUpdate{Status: models.MessageRead, ReadUpTo: upTo.Hex(), At: receipt.ReadAt})
+	}
+	publishCountdowns(receipt.Expiring)
+	return receipt, nil
+}
+
+// markDelivered is called by the hub once a chat message was queued on one of
+// the receiver's connections
+func markDelivered(msg Message) {
+	id, err := primitive.ObjectIDFromHex(msg.ID)
+	if err != nil {
+		return
+	}
+	receiverID, err := primitive.ObjectIDFromHex(msg.ReceiverID)
+	if err != nil {
+		return
+	}
+	AcknowledgeDelivered(receiverID, []primitive.ObjectID{id})
+}
+
+func publishStatus(from string, to primitive.ObjectID, update StatusUpdate) {
+	hub.Broadcast(Message{
+		Type:        MessageStatusChanged,
+		Sender:      from,
+		Data:        update,
+		RecipientID: to,
+		Timestamp:   update.At.Unix(),
+	})
+}
@@ -0,0 +1,306 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/KevinChaves65/Project_Boo/storage"
+	"github.com/KevinChaves65/Project_Boo/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// reencryptBatchSize is how many documents are migrated between progress saves
+	reencryptBatchSize = 200
+	// reencryptLease is how long a job is reserved for this instance without a progress save
+	reencryptLease = 2 * time.Minute
+	// reencryptPause spaces batches out so the job does not starve regular traffic
+	reencryptPause = 100 * time.Millisecond
+	// reencryptRetryAfter is how long after a run with failures a job starts over
+	reencryptRetryAfter = 6 * time.Hour
+)
+
+// reencryptStore is a collection whose ciphertexts the re-encryption moves to
+// the active key. Each store is its own job in maintenance_jobs.
+type reencryptStore struct {
+	jobID string
+	name  string
+	// batch loads the documents after the cursor, oldest first
+	batch func(after primitive.ObjectID) ([]reencryptItem, error)
+}
+
+// reencryptItem is one document of a batch; migrate reports whether it was
+// re-encrypted
+type reencryptItem struct {
+	id      primitive.ObjectID
+	migrate func() (bool, error)
+}
+
+// reencryptStores lists everything sealed with a keyring key that is kept
+// for good. Chat events and backplane frames expire on their own.
+var reencryptStores = []reencryptStore{
+	{jobID: "reencrypt_messages", name: "messages", batch: messageBatch},
+	{jobID: "reencrypt_scheduled_messages", name: "scheduled messages", batch: scheduledMessageBatch},
+	{jobID: "reencrypt_attachments", name: "attachments", batch: attachmentBatch},
+}
+
+// RunMessageReencryption moves every stored message, including its edit
+// history, every scheduled message and every attachment to the active
+// encryption key. Progress is saved after each batch, so a restart resumes
+// the job; rotating the active key starts it over. The job is tried again
+// every interval, which picks up a lease left behind by a crashed instance
+// once it expires.
+func RunMessageReencryption(interval time.Duration) {
+	ring, err := utils.CurrentKeyring()
+	if err != nil {
+		log.Printf("Skipping message re-encryption: %v", err)
+		return
+	}
+	if ring.LegacyKeyActive() {
+		log.Printf("Data is still sealed with ENCRYPTION_KEY; set ENCRYPTION_KEYS to rotate to a new key")
+	}
+
+	reencryptAll(ring)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		reencryptAll(ring)
+	}
+}
+
+func reencryptAll(ring *utils.Keyring) {
+	for _, store := range reencryptStores {
+		reencryptStoreData(ring, store)
+	}
+}
+
+// reencryptStoreData runs a store's job if no other instance holds it and it
+// has not completed for the active key
+func reencryptStoreData(ring *utils.Keyring, store reencryptStore) {
+	job, err := models.ClaimMaintenanceJob(store.jobID, ring.ActiveKeyID(), reencryptLease, reencryptRetryAfter)
+	if err != nil {
+		if !errors.Is(err, models.ErrJobCompleted) && !errors.Is(err, models.ErrJobLeased) && !errors.Is(err, models.ErrJobWaiting) {
+			log.Printf("Failed to start re-encryption of %s: %v", store.name, err)
+		}
+		return
+	}
+	log.Printf("Re-encrypting %s with key %s from %s", store.name, job.Target, job.Cursor.Hex())
+
+	for {
+		items, err := store.batch(job.Cursor)
+		if err != nil {
+			job.Status = models.JobFailed
+			job.LastError = err.Error()
+			models.SaveJobProgress(&job, reencryptLease)
+			log.Printf("Re-encryption of %s failed: %v", store.name, err)
+			return
+		}
+		if len(items) == 0 {
+			break
+		}
+
+		for _, item := range items {
+			job.Processed++
+			updated, err := item.migrate()
+			switch {
+			case err != nil:
+				job.Failed++
+				job.LastError = err.Error()
+				log.Printf("Failed to re-encrypt %s %s: %v", store.name, item.id.Hex(), err)
+			case updated:
+				job.Updated++
+			}
+			job.Cursor = item.id
+		}
+
+		if err := models.SaveJobProgress(&job, reencryptLease); err != nil {
+			log.Printf("Stopping re-encryption of %s: %v", store.name, err)
+			return
+		}
+		time.Sleep(reencryptPause)
+	}
+
+	now := time.Now()
+	job.Status = models.JobCompleted
+	if job.Failed > 0 {
+		// Those documents stay on their old key until a later run
+		job.Status = models.JobPartial
+	}
+	job.CompletedAt = &now
+	if err := models.SaveJobProgress(&job, reencryptLease); err != nil {
+		log.Printf("Failed to record re-encryption of %s as completed: %v", store.name, err)
+		return
+	}
+	log.Printf("Re-encrypted %d of %d %s (%d failed)", job.Updated, job.Processed, store.name, job.Failed)
+}
+
+func messageBatch(after primitive.ObjectID) ([]reencryptItem, error) {
+	messages, err := models.GetMessagesAfter(after, reencryptBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]reencryptItem, len(messages))
+	for i, message := range messages {
+		items[i] = reencryptItem{id: message.ID, migrate: func() (bool, error) { return reencryptMessage(message) }}
+	}
+	return items, nil
+}
+
+func scheduledMessageBatch(after primitive.ObjectID) ([]reencryptItem, error) {
+	scheduled, err := models.GetScheduledMessagesAfter(after, reencryptBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]reencryptItem, len(scheduled))
+	for i, message := range scheduled {
+		items[i] = reencryptItem{id: message.ID, migrate: func() (bool, error) { return reencryptScheduledMessage(message) }}
+	}
+	return items, nil
+}
+
+func attachmentBatch(after primitive.ObjectID) ([]reencryptItem, error) {
+	attachments, err := models.GetAttachmentsAfter(after, reencryptBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]reencryptItem, len(attachments))
+	for i, attachment := range attachments {
+		items[i] = reencryptItem{id: attachment.ID, migrate: func() (bool, error) { return reencryptAttachment(attachment) }}
+	}
+	return items, nil
+}
+
+// reencryptMessage re-seals a message's content and edit history with the
+// active key if any of them use another key or the legacy format
+func reencryptMessage(message models.Message) (bool, error) {
+	// End-to-end messages were never encrypted by the server
+	if message.E2E {
+		return false, nil
+	}
+	stale, err := ciphertextStale(message.Content)
+	if err != nil {
+		return false, err
+	}
+	for _, edit := range message.EditHistory {
+		historyStale, err := ciphertextStale(edit.Content)
+		if err != nil {
+			return false, err
+		}
+		stale = stale || historyStale
+	}
+	if !stale {
+		return false, nil
+	}
+
+	content, err := reseal(message.Content)
+	if err != nil {
+		return false, err
+	}
+	history := make([]models.MessageEdit, len(message.EditHistory))
+	for i, edit := range message.EditHistory {
+		history[i].EditedAt = edit.EditedAt
+		if history[i].Content, err = reseal(edit.Content); err != nil {
+			return false, err
+		}
+	}
+
+	return models.ReplaceMessageCiphertexts(message.ID, message.Content, content, history)
+}
+
+// reencryptScheduledMessage re-seals a scheduled message's content, whether
+// or not it was sent yet
+func reencryptScheduledMessage(scheduled models.ScheduledMessage) (bool, error) {
+	stale, err := ciphertextStale(scheduled.Content)
+	if err != nil || !stale {
+		return false, err
+	}
+	content, err := reseal(scheduled.Content)
+	if err != nil {
+		return false, err
+	}
+	return models.ReplaceScheduledMessageContent(scheduled.ID, scheduled.Content, content)
+}
+
+// reencryptAttachment re-seals an attachment's blob and thumbnail in place
+func reencryptAttachment(attachment models.Attachment) (bool, error) {
+	updated := false
+	for _, key := range []string{attachment.StorageKey, attachment.ThumbnailKey} {
+		if key == "" {
+			continue
+		}
+		resealed, err := resealBlob(key)
+		if err != nil {
+			return updated, err
+		}
+		updated = updated || resealed
+	}
+	if !updated {
+		return false, nil
+	}
+
+	// An attachment deleted meanwhile must not leave the rewritten blobs behind
+	if _, err := models.GetAttachment(attachment.ID); errors.Is(err, models.ErrAttachmentNotFound) {
+		for _, key := range []string{attachment.StorageKey, attachment.ThumbnailKey} {
+			if key != "" {
+				storage.GetBlobs().Delete(context.TODO(), key)
+			}
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// resealBlob rewrites a blob with the active key if it uses another key or
+// the legacy format. A blob that is already gone is left alone.
+func resealBlob(key string) (bool, error) {
+	blob, err := storage.GetBlobs().Get(context.TODO(), key)
+	if errors.Is(err, storage.ErrBlobNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	sealed, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		return false, err
+	}
+
+	stale, err := utils.BlobNeedsReencryption(sealed)
+	if err != nil || !stale {
+		return false, err
+	}
+	data, err := utils.DecryptBlob(sealed)
+	if err != nil {
+		return false, err
+	}
+	if err := putEncrypted(key, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ciphertextStale reports whether stored content is sealed with another key
+// than the active one. Empty content, such as an unsent message's, has
+// nothing to re-encrypt.
+func ciphertextStale(ciphertext string) (bool, error) {
+	if ciphertext == "" {
+		return false, nil
+	}
+	return utils.NeedsReencryption(ciphertext)
+}
+
+func reseal(ciphertext string) (string, error) {
+	if ciphertext == "" {
+		return "", nil
+	}
+	plaintext, err := utils.DecryptMessage(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return utils.EncryptMessage(plaintext)
+}
@@ -0,0 +1,156 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"testing"
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/KevinChaves65/Project_Boo/storage"
+	"github.com/KevinChaves65/Project_Boo/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// testEncryptionKey is the ENCRYPTION_KEY of every test in the package; the
+// keyring is loaded once, by whichever test encrypts first
+const testEncryptionKey = "0123456789abcdef0123456789abcdef"
+
+func useEncryptionKey(t *testing.T) {
+	t.Helper()
+	t.Setenv("ENCRYPTION_KEY", testEncryptionKey)
+	t.Setenv("ENCRYPTION_KEYS", "")
+	t.Setenv("ENCRYPTION_ACTIVE_KEY", "")
+}
+
+// legacyCiphertext seals text the way messages were stored before the keyring
+func legacyCiphertext(t *testing.T, text string) string {
+	t.Helper()
+	block, err := aes.NewCipher([]byte(testEncryptionKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]byte, aes.BlockSize+len(text))
+	copy(out, "fixed-test-iv-16")
+	cipher.NewCTR(block, out[:aes.BlockSize]).XORKeyStream(out[aes.BlockSize:], []byte(text))
+	return hex.EncodeToString(out)
+}
+
+// legacyBlob seals data the way attachments were stored before the keyring
+func legacyBlob(t *testing.T, data []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher([]byte(testEncryptionKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	return gcm.Seal(nonce, nonce, data, nil)
+}
+
+func TestReencryptSkipsTombstones(t *testing.T) {
+	useEncryptionKey(t)
+	// No database is set up: a tombstone must not need one
+	updated, err := reencryptMessage(models.Message{ID: primitive.NewObjectID(), Deleted: true})
+	if err != nil || updated {
+		t.Fatalf("got %v, %v for a tombstone; want it left alone", updated, err)
+	}
+}
+
+func TestReencryptScheduledMessage(t *testing.T) {
+	useEncryptionKey(t)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("reseals legacy content", func(mt *mtest.T) {
+		config.DB = mt.DB
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}))
+
+		scheduled := models.ScheduledMessage{ID: primitive.NewObjectID(), Content: legacyCiphertext(mt.T, "see you soon")}
+		updated, err := reencryptScheduledMessage(scheduled)
+		if err != nil || !updated {
+			mt.Fatalf("got %v, %v; want the content re-encrypted", updated, err)
+		}
+
+		update := mt.GetStartedEvent().Command.Lookup("updates").Array().Index(0).Value().Document()
+		if old := update.Lookup("q", "content").StringValue(); old != scheduled.Content {
+			mt.Fatalf("update is not conditional on the old content: %s", old)
+		}
+		content := update.Lookup("u", "$set", "content").StringValue()
+		if stale, err := utils.NeedsReencryption(content); err != nil || stale {
+			mt.Fatalf("content %s is not sealed with the active key", content)
+		}
+		if plaintext, err := utils.DecryptMessage(content); err != nil || plaintext != "see you soon" {
+			mt.Fatalf("got %q, %v", plaintext, err)
+		}
+	})
+}
+
+func TestReencryptAttachment(t *testing.T) {
+	useEncryptionKey(t)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("reseals legacy blobs", func(mt *mtest.T) {
+		config.DB = mt.DB
+		store := newMemoryStore()
+		storage.Blobs = store
+
+		attachment := models.Attachment{ID: primitive.NewObjectID(), StorageKey: "attachments/photo", ThumbnailKey: "attachments/photo_thumb"}
+		store.Put(context.TODO(), attachment.StorageKey, bytes.NewReader(legacyBlob(mt.T, []byte("photo"))), 0, "")
+		store.Put(context.TODO(), attachment.ThumbnailKey, bytes.NewReader(legacyBlob(mt.T, []byte("thumb"))), 0, "")
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.attachments", mtest.FirstBatch, bson.D{{Key: "_id", Value: attachment.ID}}))
+
+		updated, err := reencryptAttachment(attachment)
+		if err != nil || !updated {
+			mt.Fatalf("got %v, %v; want the blobs re-encrypted", updated, err)
+		}
+		for key, want := range map[string]string{attachment.StorageKey: "photo", attachment.ThumbnailKey: "thumb"} {
+			sealed := store.blobs[key]
+			if stale, err := utils.BlobNeedsReencryption(sealed); err != nil || stale {
+				mt.Fatalf("blob %s is not sealed with the active key", key)
+			}
+			if data, err := utils.DecryptBlob(sealed); err != nil || string(data) != want {
+				mt.Fatalf("blob %s: got %q, %v", key, data, err)
+			}
+		}
+
+		// A second run has nothing left to do
+		if updated, err := reencryptAttachment(attachment); err != nil || updated {
+			mt.Fatalf("got %v, %v on the second run", updated, err)
+		}
+	})
+
+	mt.Run("drops blobs of an attachment deleted meanwhile", func(mt *mtest.T) {
+		config.DB = mt.DB
+		store := newMemoryStore()
+		storage.Blobs = store
+
+		attachment := models.Attachment{ID: primitive.NewObjectID(), StorageKey: "attachments/gone"}
+		store.Put(context.TODO(), attachment.StorageKey, bytes.NewReader(legacyBlob(mt.T, []byte("gone"))), 0, "")
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.attachments", mtest.FirstBatch))
+
+		if _, err := reencryptAttachment(attachment); err != nil {
+			mt.Fatal(err)
+		}
+		if store.has(attachment.StorageKey) {
+			mt.Fatal("the rewritten blob of a deleted attachment was kept")
+		}
+	})
+}
+
+func TestCiphertextStaleIgnoresEmptyContent(t *testing.T) {
+	useEncryptionKey(t)
+	if stale, err := ciphertextStale(""); err != nil || stale {
+		t.Fatalf("got %v, %v for empty content", stale, err)
+	}
+	if stale, err := ciphertextStale(legacyCiphertext(t, "hi")); err != nil || !stale {
+		t.Fatalf("got %v, %v for legacy content", stale, err)
+	}
+}
@@ -0,0 +1,256 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"time"
+	_ "time/tzdata" // Time zones must resolve even on images without zoneinfo
+
+	"github.com/KevinChaves65/Project_Boo/config"
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/KevinChaves65/Project_Boo/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// MaxPendingScheduledMessages caps how many messages one user may have queued
+	MaxPendingScheduledMessages = 50
+	// maxScheduleAhead is how far in the future a message may be scheduled
+	maxScheduleAhead = 366 * 24 * time.Hour
+	// scheduledPollInterval is how often the scheduler looks for due messages
+	scheduledPollInterval = 15 * time.Second
+	// scheduledLease is how long one instance owns a delivery before another may retry it
+	scheduledLease = 2 * time.Minute
+	// maxScheduledAttempts is how often a delivery is tried before it is marked failed
+	maxScheduledAttempts = 5
+)
+
+var (
+	ErrInvalidTimezone       = errors.New("timezone must be an IANA name such as Europe/Paris")
+	ErrInvalidSendAt         = errors.New("send_at must be RFC 3339, or a local time such as 2025-02-14T07:30 with a timezone")
+	ErrSendAtInPast          = errors.New("send_at must be in the future")
+	ErrSendAtTooFar          = errors.New("send_at must be within a year")
+	ErrTooManyScheduled      = errors.New("too many scheduled messages")
+	errScheduledCoupleChange = errors.New("the sender is no longer in this couple")
+)
+
+// localTimeLayouts are the forms accepted for a wall-clock time in the sender's timezone
+var localTimeLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04"}
+
+// parseSendAt resolves the requested delivery time. An RFC 3339 time is an
+// exact instant; a local time is read in the given timezone, so "07:30" means
+// 07:30 wherever the sender said, daylight saving included.
+func parseSendAt(sendAt, timezone string) (time.Time, *time.Location, error) {
+	location := time.UTC
+	if timezone != "" {
+		loaded, err := time.LoadLocation(timezone)
+		if err != nil {
+			return time.Time{}, nil, ErrInvalidTimezone
+		}
+		location = loaded
+	}
+
+	if instant, err := time.Parse(time.RFC3339, sendAt); err == nil {
+		return instant, location, nil
+	}
+	for _, layout := range localTimeLayouts {
+		if local, err := time.ParseInLocation(layout, sendAt, location); err == nil {
+			return local, location, nil
+		}
+	}
+	return time.Time{}, nil, ErrInvalidSendAt
+}
+
+// ScheduleMessage queues a message from the principal to their partner for
+// delivery at sendAt
+func ScheduleMessage(principal *middlewares.Principal, content, sendAt, timezone string) (models.ScheduledMessage, error) {
+	if err := ValidateMessageContent(content); err != nil {
+		return models.ScheduledMessage{}, err
+	}
+	at, location, err := parseSendAt(sendAt, timezone)
+	if err != nil {
+		return models.ScheduledMessage{}, err
+	}
+	now := time.Now()
+	if !at.After(now) {
+		return models.ScheduledMessage{}, ErrSendAtInPast
+	}
+	if at.After(now.Add(maxScheduleAhead)) {
+		return models.ScheduledMessage{}, ErrSendAtTooFar
+	}
+
+	// The server cannot seal a message for the partner's devices later on
+	e2e, err := coupleUsesE2E(principal.CoupleID)
+	if err != nil {
+		return models.ScheduledMessage{}, err
+	}
+	if e2e {
+		return models.ScheduledMessage{}, ErrE2EUnavailable
+	}
+
+	pending, err := models.CountPendingScheduledMessages(principal.UserID)
+	if err != nil {
+		return models.ScheduledMessage{}, err
+	}
+	if pending >= MaxPendingScheduledMessages {
+		return models.ScheduledMessage{}, ErrTooManyScheduled
+	}
+
+	encrypted, err := utils.EncryptMessage(content)
+	if err != nil {
+		return models.ScheduledMessage{}, err
+	}
+	scheduled, err := models.CreateScheduledMessage(models.ScheduledMessage{
+		CoupleID: *principal.CoupleID,
+		SenderID: principal.UserID,
+		Content:  encrypted,
+		SendAt:   at.UTC(),
+		Timezone: location.String(),
+	})
+	if err != nil {
+		return scheduled, err
+	}
+	scheduled.Content = content
+	scheduled.LocalSendAt = at.In(location).Format(time.RFC3339)
+	return scheduled, nil
+}
+
+// ListScheduledMessages returns the principal's queued and failed messages
+// with their content decrypted
+func ListScheduledMessages(principal *middlewares.Principal) ([]models.ScheduledMessage, error) {
+	scheduled, err := models.GetScheduledMessages(principal.UserID)
+	if err != nil {
+		return nil, err
+	}
+	for i, message := range scheduled {
+		content, err := utils.DecryptMessage(message.Content)
+		if err != nil {
+			content = "[Failed to decrypt message]"
+		}
+		scheduled[i].Content = content
+		if location, err := time.LoadLocation(message.Timezone); err == nil {
+			scheduled[i].LocalSendAt = message.SendAt.In(location).Format(time.RFC3339)
+		}
+	}
+	return scheduled, nil
+}
+
+// RunScheduledMessages delivers due scheduled messages until the process
+// exits. Every instance may run it: each delivery is leased to one instance,
+// and the message ID fixed at scheduling time keeps a retried delivery from
+// storing the message twice.
+func RunScheduledMessages() {
+	ticker := time.NewTicker(scheduledPollInterval)
+	defer ticker.Stop()
+
+	for {
+		deliverDueMessages()
+		<-ticker.C
+	}
+}
+
+func deliverDueMessages() {
+	for {
+		scheduled, err := models.ClaimDueScheduledMessage(config.InstanceID, scheduledLease)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to claim scheduled messages: %v", err)
+			return
+		}
+		deliverScheduled(scheduled)
+	}
+}
+
+// deliverScheduled sends one leased message and records the outcome
+func deliverScheduled(scheduled models.ScheduledMessage) {
+	err := sendScheduled(scheduled)
+	if errors.Is(err, ErrMessageAlreadyStored) {
+		// A previous attempt stored the message but did not get to record it,
+		// and maybe not to announce it either
+		err = announceStoredMessage(scheduled.MessageID)
+	}
+	switch {
+	case err == nil:
+		err = models.FinishScheduledMessage(scheduled.ID, config.InstanceID, models.ScheduledSent, "")
+
+	case scheduledErrorIsFinal(err) || scheduled.Attempts >= maxScheduledAttempts:
+		log.Printf("Scheduled message %s failed: %v", scheduled.ID.Hex(), err)
+		err = models.FinishScheduledMessage(scheduled.ID, config.InstanceID, models.ScheduledFailed, err.Error())
+		if sender, userErr := models.GetUserByID(scheduled.SenderID); err == nil && userErr == nil {
+			Notify(sender, "scheduled_message_failed", "A scheduled message could not be sent", bson.M{
+				"scheduled_message_id": scheduled.ID.Hex(),
+			})
+		}
+
+	default:
+		// Back off a little more after every attempt
+		backoff := time.Duration(scheduled.Attempts*scheduled.Attempts) * 30 * time.Second
+		log.Printf("Scheduled message %s will be retried in %s: %v", scheduled.ID.Hex(), backoff, err)
+		err = models.RetryScheduledMessage(scheduled.ID, config.InstanceID, time.Now().Add(backoff), err.Error())
+	}
+	if err != nil {
+		log.Printf("Failed to record delivery of scheduled message %s: %v", scheduled.ID.Hex(), err)
+	}
+}
+
+// sendScheduled posts the message through the same path as live messages,
+// addressed by the couple's current usernames
+func sendScheduled(scheduled models.ScheduledMessage) error {
+	couple, err := models.GetCoupleByID(scheduled.CoupleID)
+	if err != nil {
+		return err
+	}
+	partnerID := couple.User1ID
+	switch scheduled.SenderID {
+	case couple.User1ID:
+		partnerID = couple.User2ID
+	case couple.User2ID:
+	default:
+		return errScheduledCoupleChange
+	}
+
+	sender, err := models.GetUserByID(scheduled.SenderID)
+	if err != nil {
+		return err
+	}
+	receiver, err := models.GetUserByID(partnerID)
+	if err != nil {
+		return err
+	}
+	content, err := utils.DecryptMessage(scheduled.Content)
+	if err != nil {
+		return err
+	}
+
+	_, err = PostChatMessage(ChatPost{
+		SenderID:   sender.ID,
+		ReceiverID: receiver.ID,
+		Sender:     sender.Username,
+		Receiver:   receiver.Username,
+		CoupleID:   couple.ID,
+		Content:    content,
+		MessageID:  scheduled.MessageID,
+	})
+	return err
+}
+
+// scheduledErrorIsFinal reports whether retrying a delivery cannot help
+func scheduledErrorIsFinal(err error) bool {
+	for _, final := range []error{
+		mongo.ErrNoDocuments,
+		errScheduledCoupleChange,
+		ErrReceiverNotPartner,
+		ErrEmptyMessage,
+		ErrMessageTooLong,
+		ErrE2ERequired,
+	} {
+		if errors.Is(err, final) {
+			return true
+		}
+	}
+	return false
+}
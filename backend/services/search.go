@@ -0,0 +1,410 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/KevinChaves65/Project_Boo/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// minPrefixLength and maxPrefixLength bound the prefixes indexed per word
+	minPrefixLength = 2
+	maxPrefixLength = 12
+	// snippetRadius is how many characters of context a snippet keeps around a hit
+	snippetRadius = 40
+	// searchBatchSize is how many candidates are decrypted and checked at a time
+	searchBatchSize = 100
+	// maxSearchScan caps the candidates checked per request, so one broad
+	// query cannot decrypt the whole history
+	maxSearchScan = 1000
+)
+
+var (
+	ErrEmptySearch       = errors.New("search query cannot be empty")
+	ErrSearchPrefixShort = errors.New("prefix searches need at least 2 characters")
+)
+
+// searchToken is a normalized word with its position in the text, in runes
+type searchToken struct {
+	text       string
+	start, end int
+}
+
+// tokenize splits text into lower-cased words of letters and digits
+func tokenize(text string) []searchToken {
+	var tokens []searchToken
+	var word []rune
+	start := 0
+	position := 0
+	flush := func() {
+		if len(word) > 0 {
+			tokens = append(tokens, searchToken{text: string(word), start: start, end: position})
+			word = word[:0]
+		}
+	}
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) {
+			if len(word) == 0 {
+				start = position
+			}
+			word = append(word, unicode.ToLower(r))
+		} else {
+			flush()
+		}
+		position++
+	}
+	flush()
+	return tokens
+}
+
+// blindTokens returns the index tokens of a couple's message: every word,
+// plus its prefixes for prefix queries
+func blindTokens(coupleID primitive.ObjectID, content string) []string {
+	seen := make(map[string]bool)
+	var tokens []string
+	add := func(kind, term string) {
+		token := utils.BlindToken(coupleID.Hex(), kind, term)
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+	for _, token := range tokenize(content) {
+		add("w", token.text)
+		runes := []rune(token.text)
+		for n := minPrefixLength; n <= len(runes) && n <= maxPrefixLength; n++ {
+			add("p", string(runes[:n]))
+		}
+	}
+	return tokens
+}
+
+// indexMessage updates the search index for a message's plaintext content.
+// Only couple messages are searchable.
+func indexMessage(message models.Message, content string) {
+	if message.CoupleID == nil {
+		return
+	}
+	err := models.IndexMessage(models.SearchEntry{
+		MessageID: message.ID,
+		CoupleID:  *message.CoupleID,
+		Timestamp: message.Timestamp,
+		Tokens:    blindTokens(*message.CoupleID, content),
+	})
+	if err != nil {
+		log.Printf("Failed to index message %s: %v", message.ID.Hex(), err)
+	}
+}
+
+// SearchQuery is a parsed search. Quoted text is a phrase, a trailing * makes
+// a word a prefix, and everything else must appear as a whole word.
+type SearchQuery struct {
+	Words    []string
+	Prefixes []string
+	Phrases  [][]string
+}
+
+// ParseSearchQuery parses the text typed into the search box
+func ParseSearchQuery(text string) (SearchQuery, error) {
+	var query SearchQuery
+	parts := strings.Split(text, `"`)
+	for i, part := range parts {
+		// Odd parts were between quotes
+		if i%2 == 1 {
+			var phrase []string
+			for _, token := range tokenize(part) {
+				phrase = append(phrase, token.text)
+			}
+			switch len(phrase) {
+			case 0:
+			case 1:
+				query.Words = append(query.Words, phrase[0])
+			default:
+				query.Phrases = append(query.Phrases, phrase)
+			}
+			continue
+		}
+
+		for _, field := range strings.Fields(part) {
+			tokens := tokenize(field)
+			if len(tokens) == 0 {
+				continue
+			}
+			last := len(tokens) - 1
+			if strings.HasSuffix(field, "*") {
+				if len([]rune(tokens[last].text)) < minPrefixLength {
+					return query, ErrSearchPrefixShort
+				}
+				query.Prefixes = append(query.Prefixes, tokens[last].text)
+				tokens = tokens[:last]
+			}
+			for _, token := range tokens {
+				query.Words = append(query.Words, token.text)
+			}
+		}
+	}
+
+	if len(query.Words) == 0 && len(query.Prefixes) == 0 && len(query.Phrases) == 0 {
+		return query, ErrEmptySearch
+	}
+	return query, nil
+}
+
+// blindTokens returns the index tokens every match in the couple must have
+func (q SearchQuery) blindTokens(coupleID primitive.ObjectID) []string {
+	var tokens []string
+	for _, word := range q.Words {
+		tokens = append(tokens, utils.BlindToken(coupleID.Hex(), "w", word))
+	}
+	for _, phrase := range q.Phrases {
+		for _, word := range phrase {
+			tokens = append(tokens, utils.BlindToken(coupleID.Hex(), "w", word))
+		}
+	}
+	for _, prefix := range q.Prefixes {
+		runes := []rune(prefix)
+		if len(runes) > maxPrefixLength {
+			runes = runes[:maxPrefixLength]
+		}
+		tokens = append(tokens, utils.BlindToken(coupleID.Hex(), "p", string(runes)))
+	}
+	return tokens
+}
+
+// matches checks the decrypted content against the query and returns the
+// rune ranges that matched. Blind tokens only say that the words occur
+// somewhere; phrases, full prefixes and hash collisions are settled here.
+func (q SearchQuery) matches(content string) ([][2]int, bool) {
+	tokens := tokenize(content)
+	var ranges [][2]int
+
+	for _, word := range q.Words {
+		found := false
+		for _, token := range tokens {
+			if token.text == word {
+				ranges = append(ranges, [2]int{token.start, token.end})
+				found = true
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	for _, prefix := range q.Prefixes {
+		found := false
+		for _, token := range tokens {
+			if strings.HasPrefix(token.text, prefix) {
+				ranges = append(ranges, [2]int{token.start, token.end})
+				found = true
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	for _, phrase := range q.Phrases {
+		found := false
+		for i := 0; i+len(phrase) <= len(tokens); i++ {
+			match := true
+			for j, word := range phrase {
+				if tokens[i+j].text != word {
+					match = false
+					break
+				}
+			}
+			if match {
+				ranges = append(ranges, [2]int{tokens[i].start, tokens[i+len(phrase)-1].end})
+				found = true
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return ranges, true
+}
+
+// Highlight is a matched range within a snippet, in characters
+type Highlight struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// SearchHit is a message that matched a search
+type SearchHit struct {
+	Message    models.Message `json:"message"`
+	Snippet    string         `json:"snippet"`
+	Highlights []Highlight    `json:"highlights"`
+}
+
+// SearchResults is one page of search hits, newest first
+type SearchResults struct {
+	Hits    []SearchHit `json:"hits"`
+	HasMore bool        `json:"has_more"`
+	// NextBefore continues the search past the last message checked
+	NextBefore string `json:"next_before,omitempty"`
+}
+
+// mergeRanges sorts ranges and joins the ones that overlap, so highlights never nest
+func mergeRanges(ranges [][2]int) [][2]int {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	var merged [][2]int
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r[0] <= merged[n-1][1] {
+			merged[n-1][1] = max(merged[n-1][1], r[1])
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// snippet cuts the content around the first match and shifts the ranges into it
+func snippet(content string, ranges [][2]int) (string, []Highlight) {
+	ranges = mergeRanges(ranges)
+	runes := []rune(content)
+	first := len(runes)
+	for _, r := range ranges {
+		first = min(first, r[0])
+	}
+	start := max(0, first-snippetRadius)
+	end := min(len(runes), first+snippetRadius*2)
+
+	text := string(runes[start:end])
+	prefix := 0
+	if start > 0 {
+		text = "…" + text
+		prefix = 1
+	}
+	if end < len(runes) {
+		text += "…"
+	}
+
+	var highlights []Highlight
+	for _, r := range ranges {
+		if r[0] >= start && r[1] <= end {
+			highlights = append(highlights, Highlight{Start: r[0] - start + prefix, End: r[1] - start + prefix})
+		}
+	}
+	return text, highlights
+}
+
+// SearchMessages searches a couple's messages. Candidates are found through
+// the blind index and then decrypted and checked in batches until limit hits
+// are found.
+func SearchMessages(coupleID primitive.ObjectID, query SearchQuery, filter models.SearchFilter) (SearchResults, error) {
+	results := SearchResults{Hits: []SearchHit{}}
+	limit := filter.Limit
+
+	e2e, err := coupleUsesE2E(&coupleID)
+	if err != nil {
+		return results, err
+	}
+	if e2e {
+		return results, ErrE2EUnavailable
+	}
+
+	filter.CoupleID = coupleID
+	filter.Tokens = query.blindTokens(coupleID)
+	filter.Limit = searchBatchSize
+
+	scanned := 0
+	for scanned < maxSearchScan {
+		ids, err := models.FindSearchCandidates(filter)
+		if err != nil {
+			return results, err
+		}
+		if len(ids) == 0 {
+			return results, nil
+		}
+		messages, err := models.GetMessagesByIDs(ids)
+		if err != nil {
+			return results, err
+		}
+
+		for _, id := range ids {
+			scanned++
+			lastID := id
+			filter.Before = &lastID
+
+			message, ok := messages[id]
+			if !ok || message.Deleted {
+				continue
+			}
+			content, err := utils.DecryptMessage(message.Content)
+			if err != nil {
+				continue
+			}
+			ranges, ok := query.matches(content)
+			if !ok {
+				continue
+			}
+
+			message.Content = content
+			text, highlights := snippet(content, ranges)
+			results.Hits = append(results.Hits, SearchHit{Message: message, Snippet: text, Highlights: highlights})
+			if len(results.Hits) == limit {
+				results.HasMore = true
+				results.NextBefore = id.Hex()
+				return results, nil
+			}
+		}
+		if len(ids) < searchBatchSize {
+			return results, nil
+		}
+	}
+
+	// Scan budget used up; let the client continue from here
+	results.HasMore = true
+	results.NextBefore = filter.Before.Hex()
+	return results, nil
+}
+
+// BackfillSearchIndex indexes couple messages stored before search existed,
+// and reindexes those whose entry was built with an older token scheme. It is
+// safe to run on every startup; indexed messages are skipped.
+func BackfillSearchIndex() {
+	after := primitive.NilObjectID
+	indexed := 0
+	// Couples with end-to-end encryption keep no search index, not even for older messages
+	e2eCouples := make(map[primitive.ObjectID]bool)
+	for {
+		messages, last, err := models.GetUnindexedMessages(after, 500)
+		if err != nil {
+			log.Printf("Failed to backfill search index: %v", err)
+			return
+		}
+		if last == after {
+			break
+		}
+		after = last
+
+		for _, message := range messages {
+			e2e, checked := e2eCouples[*message.CoupleID]
+			if !checked {
+				if e2e, err = coupleUsesE2E(message.CoupleID); err != nil {
+					continue
+				}
+				e2eCouples[*message.CoupleID] = e2e
+			}
+			if e2e || message.E2E {
+				continue
+			}
+			content, err := utils.DecryptMessage(message.Content)
+			if err != nil {
+				continue
+			}
+			indexMessage(message, content)
+			indexed++
+		}
+	}
+	if indexed > 0 {
+		log.Printf("Indexed %d messages for search", indexed)
+	}
+}
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"github.com/KevinChaves65/Project_Boo/models"
+)
+
+// sseRetry is the reconnect delay, in milliseconds, suggested to EventSource clients
+const sseRetry = 3000
+
+// eventStream writes hub frames to one Server-Sent Events response
+type eventStream struct {
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	cursor *eventCursor
+}
+
+// write sends one frame. Frames from the event log carry the stream's
+// position as their id, which the browser sends back as Last-Event-ID.
+func (s *eventStream) write(data []byte, logged bool) error {
+	s.rc.SetWriteDeadline(time.Now().Add(writeWait))
+	if logged {
+		if _, err := fmt.Fprintf(s.w, "id: %d\n", s.cursor.last); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(s.w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// comment sends a line clients ignore, to keep proxies from closing an idle stream
+func (s *eventStream) comment(text string) error {
+	s.rc.SetWriteDeadline(time.Now().Add(writeWait))
+	if _, err := fmt.Fprintf(s.w, ": %s\n\n", text); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// send writes a hub frame unless the stream already sent it
+func (s *eventStream) send(data []byte) error {
+	seq := frameSeq(data)
+	if seq == 0 {
+		return s.write(data, false)
+	}
+	if !s.cursor.advance(seq) {
+		return nil
+	}
+	return s.write(data, true)
+}
+
+// HandleEventStream serves the same events as the WebSocket as Server-Sent
+// Events, for networks that block WebSockets. A client reconnecting with
+// Last-Event-ID (or last_event_id in the query) first receives every logged
+// event it missed. Frames for one user, such as notifications and read
+// receipts, are not logged and so not replayed; they are kept in the
+// notifications and the message statuses, which a resuming client reloads.
+func HandleEventStream(w http.ResponseWriter, r *http.Request, principal *middlewares.Principal) {
+	coupleID := *principal.CoupleID
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var last int64
+	if lastEventID != "" {
+		parsed, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		last = parsed
+	} else {
+		// A fresh stream starts at the end of the log
+		current, err := models.GetChatEventSeq(coupleID)
+		if err != nil {
+			http.Error(w, "Failed to open event stream", http.StatusInternalServerError)
+			return
+		}
+		last = current
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	stream := &eventStream{w: w, rc: http.NewResponseController(w), cursor: newEventCursor(last)}
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", sseRetry); err != nil {
+		return
+	}
+
+	// Register before replaying so nothing broadcast in between is lost;
+	// the cursor drops frames that arrive both ways
+	client := NewClient(nil)
+	client.Username = principal.Username
+	client.CoupleID = coupleID.Hex()
+	client.UserID = principal.UserID
+	client.SessionID = principal.SessionID
+	hub.Register(client)
+
+	// End the stream once the token expires or the session is revoked; the
+	// client reconnects with a fresh token
+	done := make(chan struct{})
+	ended := make(chan struct{})
+	var endOnce sync.Once
+	go watchSession(principal, nil, done, func(code int, reason string) {
+		endOnce.Do(func() { close(ended) })
+	})
+
+	defer func() {
+		close(done)
+		hub.Unregister(client)
+		hub.Broadcast(joinLeaveFrame(UserLeft, client))
+		clearPresence(client)
+		log.Printf("User %s left couple %s (event stream)", client.Username, client.CoupleID)
+	}()
+
+	hub.Broadcast(joinLeaveFrame(UserJoined, client))
+	if err := setPresence(client, models.PresenceOnline); err != nil {
+		log.Printf("Failed to record presence of %s: %v", client.Username, err)
+	}
+	go trackPresence(client, done)
+	log.Printf("User %s joined couple %s (event stream)", client.Username, client.CoupleID)
+
+	// Replay what the client missed
+	err := replayMissed(coupleID, stream.cursor, func(data []byte) error {
+		return stream.write(data, true)
+	})
+	if err != nil {
+		log.Printf("Failed to replay events for %s: %v", client.Username, err)
+		return
+	}
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case data, ok := <-client.send:
+			if !ok {
+				// The hub evicted the stream for falling behind
+				return
+			}
+			if err := stream.send(data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := stream.comment("ping"); err != nil {
+				return
+			}
+		case <-ended:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/KevinChaves65/Project_Boo/middlewares"
+	"github.com/KevinChaves65/Project_Boo/models"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// tokenSubprotocol marks that the next offered subprotocol is an access token,
+	// for browsers that cannot set headers on the upgrade request
+	tokenSubprotocol = "access_token"
+
+	// authTimeout is how long a connection may stay open before sending its auth frame
+	authTimeout = 10 * time.Second
+	// sessionCheckInterval is how often an open connection re-checks its session
+	sessionCheckInterval = 30 * time.Second
+
+	// CloseUnauthorized is sent when the token is missing, invalid, expired or revoked
+	CloseUnauthorized = 4401
+	// CloseForbidden is sent when the user is not, or no longer, in the couple
+	CloseForbidden = 4403
+)
+
+// tokenFromRequest reads the access token from the upgrade request, if present
+func tokenFromRequest(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+
+	protocols := websocket.Subprotocols(r)
+	for i, protocol := range protocols {
+		if protocol == tokenSubprotocol && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
+	}
+	return ""
+}
+
+// authenticateFirstFrame waits for an auth frame carrying the access token
+func authenticateFirstFrame(ws *websocket.Conn) (*middlewares.Principal, error) {
+	ws.SetReadDeadline(time.Now().Add(authTimeout))
+	defer ws.SetReadDeadline(time.Time{})
+
+	var msg Message
+	if err := ws.ReadJSON(&msg); err != nil {
+		return nil, err
+	}
+	if msg.Type != AuthMessage || msg.Token == "" {
+		return nil, errors.New("first frame must be an auth message")
+	}
+	return middlewares.Authenticate(msg.Token)
+}
+
+// watchSession calls end when the access token expires, the session is
+// revoked or the user leaves the couple. Re-authenticating over the socket
+// sends a fresh principal on reauth.
+func watchSession(principal *middlewares.Principal, reauth <-chan *middlewares.Principal, done <-chan struct{}, end func(code int, reason string)) {
+	expiry := time.NewTimer(time.Until(principal.ExpiresAt))
+	defer expiry.Stop()
+	ticker := time.NewTicker(sessionCheckInterval)
+	defer ticker.Stop()
+
+	coupleID := *principal.CoupleID
+	for {
+		select {
+		case <-done:
+			return
+		case refreshed := <-reauth:
+			principal = refreshed
+			if !expiry.Stop() {
+				select {
+				case <-expiry.C:
+				default:
+				}
+			}
+			expiry.Reset(time.Until(principal.ExpiresAt))
+		case <-expiry.C:
+			end(CloseUnauthorized, "token expired")
+			return
+		case <-ticker.C:
+			session, err := models.GetActiveSession(principal.SessionID)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				end(CloseUnauthorized, "session revoked")
+				return
+			}
+			if err != nil {
+				// Checked again on the next tick
+				log.Printf("Failed to check session %s: %v", principal.SessionID.Hex(), err)
+				continue
+			}
+			current, err := middlewares.ResolvePrincipal(session)
+			if err == nil && (!current.HasCouple() || *current.CoupleID != coupleID) {
+				end(CloseForbidden, "couple changed")
+				return
+			}
+		}
+	}
+}
+
+// closeConnection sends a close frame with the given code and closes the socket.
+// WriteControl and Close are safe to call alongside other writers.
+func closeConnection(ws *websocket.Conn, code int, reason string) {
+	ws.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(time.Second),
+	)
+	ws.Close()
+}
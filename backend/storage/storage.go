@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+)
+
+// ErrBlobNotFound is returned by Get when no blob is stored under the key
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore stores opaque blobs by key. Callers encrypt blobs before storing
+// them, so implementations never see plaintext.
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+var Blobs BlobStore
+
+// ConnectBlobStore sets up the store selected by BLOB_STORAGE: "local"
+// (the default) or "s3" for S3-compatible services such as MinIO
+func ConnectBlobStore() {
+	var err error
+	switch os.Getenv("BLOB_STORAGE") {
+	case "s3":
+		Blobs, err = NewS3Store(S3ConfigFromEnv())
+	case "", "local":
+		dir := os.Getenv("BLOB_LOCAL_DIR")
+		if dir == "" {
+			dir = "data/blobs"
+		}
+		Blobs, err = NewLocalStore(dir)
+	default:
+		log.Fatalf("❌ Unknown BLOB_STORAGE %q", os.Getenv("BLOB_STORAGE"))
+	}
+	if err != nil {
+		log.Fatalf("❌ Blob storage error: %v", err)
+	}
+	log.Println("✅ Blob storage ready")
+}
+
+func GetBlobs() BlobStore {
+	if Blobs == nil {
+		log.Fatal("❌ Blob storage is not configured")
+	}
+	return Blobs
+}
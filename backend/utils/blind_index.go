@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+)
+
+// errNoSearchIndexKey is returned when neither SEARCH_INDEX_KEY nor
+// ENCRYPTION_KEY is set. The index key cannot follow the keyring: it has to
+// stay the same when encryption keys are rotated.
+var errNoSearchIndexKey = errors.New("no search index key is configured; set SEARCH_INDEX_KEY")
+
+// searchIndexKey reads SEARCH_INDEX_KEY, falling back to the original
+// encryption key. Changing it makes the existing search index useless until
+// it is rebuilt.
+func searchIndexKey() ([]byte, error) {
+	if key := os.Getenv("SEARCH_INDEX_KEY"); key != "" {
+		return []byte(key), nil
+	}
+	if key := os.Getenv("ENCRYPTION_KEY"); key != "" {
+		return []byte(key), nil
+	}
+	return nil, errNoSearchIndexKey
+}
+
+// CheckSearchIndexKey reports whether a search index key is configured. It is
+// checked at startup so tokens are never computed with an empty key.
+func CheckSearchIndexKey() error {
+	_, err := searchIndexKey()
+	return err
+}
+
+// blindIndexKey returns the search index key, which CheckSearchIndexKey has
+// made sure exists
+func blindIndexKey() []byte {
+	key, err := searchIndexKey()
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// coupleIndexKey derives the couple's own index key, so the same word gives
+// different tokens in different couples and tokens cannot be compared across
+// couples
+func coupleIndexKey(coupleID string) []byte {
+	mac := hmac.New(sha256.New, blindIndexKey())
+	mac.Write([]byte("couple:" + coupleID))
+	return mac.Sum(nil)
+}
+
+// BlindToken turns a search term of a couple into a keyed hash, so the index
+// can match terms without storing them. kind separates e.g. whole words from
+// prefixes.
+func BlindToken(coupleID, kind, term string) string {
+	mac := hmac.New(sha256.New, coupleIndexKey(coupleID))
+	mac.Write([]byte(kind + ":" + term))
+	// 128 bits is plenty to keep collisions negligible; hits are verified anyway
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
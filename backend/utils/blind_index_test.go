@@ -0,0 +1,35 @@
+package utils
+
+import "testing"
+
+func TestBlindTokenIsKeyedPerCouple(t *testing.T) {
+	t.Setenv("SEARCH_INDEX_KEY", "index-key")
+
+	first := BlindToken("couple-a", "w", "picnic")
+	if again := BlindToken("couple-a", "w", "picnic"); again != first {
+		t.Fatalf("token changed within a couple: %s, then %s", first, again)
+	}
+	if other := BlindToken("couple-b", "w", "picnic"); other == first {
+		t.Fatal("the same word gives the same token in two couples")
+	}
+	if prefix := BlindToken("couple-a", "p", "picnic"); prefix == first {
+		t.Fatal("words and prefixes share tokens")
+	}
+}
+
+func TestSearchIndexKeyIsRequired(t *testing.T) {
+	t.Setenv("SEARCH_INDEX_KEY", "")
+	t.Setenv("ENCRYPTION_KEY", "")
+	// A keyring alone is not enough: the index key must survive key rotation
+	t.Setenv("ENCRYPTION_KEYS", "k1:"+testKey(1))
+
+	if err := CheckSearchIndexKey(); err == nil {
+		t.Fatal("startup check passed without a search index key")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("a token was computed with an empty key")
+		}
+	}()
+	BlindToken("couple-a", "w", "picnic")
+}
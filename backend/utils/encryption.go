@@ -1,63 +1,197 @@
 package utils
 
 import (
-	"crypto/aes"
+	"bytes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"io"
-	"os"
+	"strings"
 )
 
+// Messages are sealed with AES-GCM into a versioned envelope:
+//
+//	g1:<key id>:<base64url(nonce || ciphertext || tag)>
+//
+// Messages stored before the envelope existed are plain hex of an AES-CTR
+// IV and ciphertext under ENCRYPTION_KEY. They still decrypt, but carry no
+// integrity check until the re-encryption job upgrades them.
+const envelopeVersion = "g1"
+
+// blobMagic starts every blob sealed with a keyring key. It is followed by
+// one byte with the key id's length, the key id, the nonce and the sealed data.
+var blobMagic = []byte("HBB1")
+
+var ErrMalformedCiphertext = errors.New("malformed ciphertext")
+
 func EncryptMessage(message string) (string, error) {
-	encryptionKey := os.Getenv("ENCRYPTION_KEY")
-	if encryptionKey == "" {
-		return "", errors.New("ENCRYPTION_KEY is not set in the environment variables")
+	ring, err := CurrentKeyring()
+	if err != nil {
+		return "", err
+	}
+	gcm, err := ring.aead(ring.ActiveKeyID())
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(message)+gcm.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
 	}
+	sealed := gcm.Seal(nonce, nonce, []byte(message), nil)
 
-	block, err := aes.NewCipher([]byte(encryptionKey))
+	return envelopeVersion + ":" + ring.ActiveKeyID() + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func DecryptMessage(encryptedMessage string) (string, error) {
+	ring, err := CurrentKeyring()
 	if err != nil {
 		return "", err
 	}
 
-	ciphertext := make([]byte, aes.BlockSize+len(message))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	keyID, payload, ok := parseEnvelope(encryptedMessage)
+	if !ok {
+		return decryptLegacyMessage(ring, encryptedMessage)
+	}
+
+	gcm, err := ring.aead(keyID)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", ErrMalformedCiphertext
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
 		return "", err
 	}
+	return string(plaintext), nil
+}
 
-	stream := cipher.NewCTR(block, iv)
-	stream.XORKeyStream(ciphertext[aes.BlockSize:], []byte(message))
+// CiphertextKeyID reports which key sealed a message; legacy messages have none
+func CiphertextKeyID(encryptedMessage string) string {
+	keyID, _, _ := parseEnvelope(encryptedMessage)
+	return keyID
+}
 
-	return hex.EncodeToString(ciphertext), nil
+// NeedsReencryption reports whether a message is not sealed with the active key
+func NeedsReencryption(encryptedMessage string) (bool, error) {
+	ring, err := CurrentKeyring()
+	if err != nil {
+		return false, err
+	}
+	return CiphertextKeyID(encryptedMessage) != ring.ActiveKeyID(), nil
 }
 
-func DecryptMessage(encryptedMessage string) (string, error) {
-	encryptionKey := os.Getenv("ENCRYPTION_KEY")
-	if encryptionKey == "" {
-		return "", errors.New("ENCRYPTION_KEY is not set in the environment variables")
+func parseEnvelope(encryptedMessage string) (keyID, payload string, ok bool) {
+	parts := strings.SplitN(encryptedMessage, ":", 3)
+	if len(parts) != 3 || parts[0] != envelopeVersion {
+		return "", "", false
 	}
+	return parts[1], parts[2], true
+}
 
+func decryptLegacyMessage(ring *Keyring, encryptedMessage string) (string, error) {
 	ciphertext, err := hex.DecodeString(encryptedMessage)
 	if err != nil {
 		return "", err
 	}
 
-	block, err := aes.NewCipher([]byte(encryptionKey))
+	block, err := ring.legacyBlock()
 	if err != nil {
 		return "", err
 	}
 
-	if len(ciphertext) < aes.BlockSize {
+	if len(ciphertext) < block.BlockSize() {
 		return "", errors.New("ciphertext too short")
 	}
 
-	iv := ciphertext[:aes.BlockSize]
-	ciphertext = ciphertext[aes.BlockSize:]
+	iv := ciphertext[:block.BlockSize()]
+	ciphertext = ciphertext[block.BlockSize():]
 
 	stream := cipher.NewCTR(block, iv)
 	stream.XORKeyStream(ciphertext, ciphertext)
 
 	return string(ciphertext), nil
 }
+
+// EncryptBlob encrypts binary data such as attachments with AES-GCM under the
+// active key
+func EncryptBlob(data []byte) ([]byte, error) {
+	ring, err := CurrentKeyring()
+	if err != nil {
+		return nil, err
+	}
+	keyID := ring.ActiveKeyID()
+	gcm, err := ring.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append(append([]byte{}, blobMagic...), byte(len(keyID)))
+	header = append(header, keyID...)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(append(header, nonce...), nonce, data, nil), nil
+}
+
+// BlobNeedsReencryption reports whether a blob is not sealed with the active key
+func BlobNeedsReencryption(sealed []byte) (bool, error) {
+	ring, err := CurrentKeyring()
+	if err != nil {
+		return false, err
+	}
+	return blobKeyID(sealed) != ring.ActiveKeyID(), nil
+}
+
+// blobKeyID reports which key sealed a blob; blobs without a header have none
+func blobKeyID(sealed []byte) string {
+	if !bytes.HasPrefix(sealed, blobMagic) || len(sealed) <= len(blobMagic) {
+		return ""
+	}
+	idLength := int(sealed[len(blobMagic)])
+	start := len(blobMagic) + 1
+	if len(sealed) < start+idLength {
+		return ""
+	}
+	return string(sealed[start : start+idLength])
+}
+
+// DecryptBlob reverses EncryptBlob and fails if the data was tampered with.
+// Blobs without a header were sealed directly with ENCRYPTION_KEY.
+func DecryptBlob(sealed []byte) ([]byte, error) {
+	ring, err := CurrentKeyring()
+	if err != nil {
+		return nil, err
+	}
+
+	var gcm cipher.AEAD
+	if bytes.HasPrefix(sealed, blobMagic) && len(sealed) > len(blobMagic) {
+		idLength := int(sealed[len(blobMagic)])
+		start := len(blobMagic) + 1
+		if len(sealed) < start+idLength {
+			return nil, ErrMalformedCiphertext
+		}
+		gcm, err = ring.aead(string(sealed[start : start+idLength]))
+		sealed = sealed[start+idLength:]
+	} else {
+		var block cipher.Block
+		if block, err = ring.legacyBlock(); err == nil {
+			gcm, err = cipher.NewGCM(block)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+const legacyKey = "0123456789abcdef0123456789abcdef"
+
+// useKeyring loads the keyring from the given environment and makes it the
+// current one for the rest of the test
+func useKeyring(t *testing.T, env map[string]string) *Keyring {
+	t.Helper()
+	for _, name := range []string{"ENCRYPTION_KEY", "ENCRYPTION_KEYS", "ENCRYPTION_ACTIVE_KEY"} {
+		t.Setenv(name, env[name])
+	}
+	ring, err := LoadKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyringOnce.Do(func() {})
+	previous, previousErr := keyring, keyringErr
+	keyring, keyringErr = ring, nil
+	t.Cleanup(func() { keyring, keyringErr = previous, previousErr })
+	return ring
+}
+
+func testKey(fill byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, 32))
+}
+
+// legacyEncrypt seals a message the way messages were stored before the
+// envelope: hex of an AES-CTR IV and ciphertext
+func legacyEncrypt(t *testing.T, message string) string {
+	t.Helper()
+	block, err := aes.NewCipher([]byte(legacyKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]byte, aes.BlockSize+len(message))
+	iv := out[:aes.BlockSize]
+	copy(iv, "fixed-test-iv-16")
+	cipher.NewCTR(block, iv).XORKeyStream(out[aes.BlockSize:], []byte(message))
+	return hex.EncodeToString(out)
+}
+
+func TestDecryptLegacyMessage(t *testing.T) {
+	useKeyring(t, map[string]string{"ENCRYPTION_KEY": legacyKey})
+
+	stored := legacyEncrypt(t, "hello from before")
+	plaintext, err := DecryptMessage(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != "hello from before" {
+		t.Fatalf("got %q", plaintext)
+	}
+	if CiphertextKeyID(stored) != "" {
+		t.Fatal("legacy ciphertexts have no key ID")
+	}
+	if stale, err := NeedsReencryption(stored); err != nil || !stale {
+		t.Fatalf("legacy message should need re-encryption, got %v, %v", stale, err)
+	}
+
+	// Without the original key legacy messages cannot be read
+	useKeyring(t, map[string]string{"ENCRYPTION_KEYS": "k1:" + testKey(1)})
+	if _, err := DecryptMessage(stored); err == nil {
+		t.Fatal("decrypted a legacy message without ENCRYPTION_KEY")
+	}
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	useKeyring(t, map[string]string{"ENCRYPTION_KEYS": "k1:" + testKey(1)})
+
+	sealed, err := EncryptMessage("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, "g1:k1:") {
+		t.Fatalf("got %q, want a g1:k1: envelope", sealed)
+	}
+	if again, _ := EncryptMessage("hello"); again == sealed {
+		t.Fatal("sealing twice gave the same ciphertext")
+	}
+	plaintext, err := DecryptMessage(sealed)
+	if err != nil || plaintext != "hello" {
+		t.Fatalf("got %q, %v", plaintext, err)
+	}
+	if stale, err := NeedsReencryption(sealed); err != nil || stale {
+		t.Fatalf("message under the active key should not need re-encryption, got %v, %v", stale, err)
+	}
+
+	// GCM rejects any change to the sealed bytes
+	payload, _ := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(sealed, "g1:k1:"))
+	payload[len(payload)-1] ^= 1
+	if _, err := DecryptMessage("g1:k1:" + base64.RawURLEncoding.EncodeToString(payload)); err == nil {
+		t.Fatal("decrypted a tampered message")
+	}
+	if _, err := DecryptMessage("g1:k1:!!!"); err == nil {
+		t.Fatal("decrypted a malformed envelope")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	useKeyring(t, map[string]string{"ENCRYPTION_KEY": legacyKey, "ENCRYPTION_KEYS": "k1:" + testKey(1)})
+	legacy := legacyEncrypt(t, "oldest")
+	underK1, err := EncryptMessage("older")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := EncryptBlob([]byte("attachment"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// k2 becomes active; everything sealed before stays readable
+	ring := useKeyring(t, map[string]string{
+		"ENCRYPTION_KEY":  legacyKey,
+		"ENCRYPTION_KEYS": "k1:" + testKey(1) + ",k2:" + testKey(2),
+	})
+	if ring.ActiveKeyID() != "k2" {
+		t.Fatalf("active key is %s, want the last listed", ring.ActiveKeyID())
+	}
+	for stored, want := range map[string]string{legacy: "oldest", underK1: "older"} {
+		plaintext, err := DecryptMessage(stored)
+		if err != nil || plaintext != want {
+			t.Fatalf("got %q, %v, want %q", plaintext, err, want)
+		}
+		if stale, _ := NeedsReencryption(stored); !stale {
+			t.Fatalf("%q should need re-encryption after rotation", stored)
+		}
+	}
+	if data, err := DecryptBlob(blob); err != nil || string(data) != "attachment" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+
+	resealed, err := EncryptMessage("older")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if CiphertextKeyID(resealed) != "k2" {
+		t.Fatalf("new data sealed with %s, want k2", CiphertextKeyID(resealed))
+	}
+
+	// Pinning the active key keeps sealing with it
+	pinned := useKeyring(t, map[string]string{
+		"ENCRYPTION_KEYS":       "k1:" + testKey(1) + ",k2:" + testKey(2),
+		"ENCRYPTION_ACTIVE_KEY": "k1",
+	})
+	if pinned.ActiveKeyID() != "k1" {
+		t.Fatalf("active key is %s, want k1", pinned.ActiveKeyID())
+	}
+
+	// Dropping a key from the ring makes its data unreadable
+	useKeyring(t, map[string]string{"ENCRYPTION_KEYS": "k2:" + testKey(2)})
+	if _, err := DecryptMessage(underK1); err == nil {
+		t.Fatal("decrypted a message whose key was removed")
+	}
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// defaultKeyID names the key taken from ENCRYPTION_KEY when no keyring is configured
+const defaultKeyID = "k0"
+
+// Keyring holds every key ciphertexts may have been sealed with. New data is
+// always sealed with the active key; the others are only used to decrypt.
+type Keyring struct {
+	keys   map[string][]byte
+	active string
+	// legacy is the raw ENCRYPTION_KEY used by the old unauthenticated format
+	legacy []byte
+}
+
+var (
+	keyring     *Keyring
+	keyringErr  error
+	keyringOnce sync.Once
+)
+
+// LoadKeyring reads the keyring from the environment:
+//
+//	ENCRYPTION_KEYS        id:base64key pairs separated by commas, e.g. "k1:...,k2:..."
+//	ENCRYPTION_ACTIVE_KEY  the id new data is sealed with (defaults to the last listed key)
+//	ENCRYPTION_KEY         the original key, kept as key "k0"; still used to read old
+//	                       ciphertexts and, without ENCRYPTION_KEYS, as the only key
+//
+// Without ENCRYPTION_KEYS new data keeps being sealed with ENCRYPTION_KEY
+// itself. To retire a key, make another one active and let the re-encryption
+// job complete; chat events and backplane frames are not migrated and only
+// stop using the old key once they expire.
+func LoadKeyring() (*Keyring, error) {
+	ring := &Keyring{keys: make(map[string][]byte)}
+	if legacy := os.Getenv("ENCRYPTION_KEY"); legacy != "" {
+		ring.legacy = []byte(legacy)
+		// Data sealed before ENCRYPTION_KEYS was configured stays readable
+		ring.keys[defaultKeyID] = ring.legacy
+		ring.active = defaultKeyID
+	}
+
+	if spec := os.Getenv("ENCRYPTION_KEYS"); spec != "" {
+		for _, entry := range strings.Split(spec, ",") {
+			id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+			if !ok || id == "" || strings.Contains(id, ":") {
+				return nil, fmt.Errorf("invalid ENCRYPTION_KEYS entry %q", entry)
+			}
+			key, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, fmt.Errorf("key %s is not valid base64: %w", id, err)
+			}
+			if len(key) != 32 {
+				return nil, fmt.Errorf("key %s must be 32 bytes", id)
+			}
+			ring.keys[id] = key
+			ring.active = id
+		}
+	}
+
+	if active := os.Getenv("ENCRYPTION_ACTIVE_KEY"); active != "" {
+		if _, ok := ring.keys[active]; !ok {
+			return nil, fmt.Errorf("ENCRYPTION_ACTIVE_KEY %q is not in the keyring", active)
+		}
+		ring.active = active
+	}
+	if ring.active == "" {
+		return nil, errors.New("no encryption key is configured; set ENCRYPTION_KEYS or ENCRYPTION_KEY")
+	}
+	return ring, nil
+}
+
+// CurrentKeyring returns the keyring loaded from the environment on first use
+func CurrentKeyring() (*Keyring, error) {
+	keyringOnce.Do(func() {
+		keyring, keyringErr = LoadKeyring()
+	})
+	return keyring, keyringErr
+}
+
+// ActiveKeyID is the id of the key new data is sealed with
+func (k *Keyring) ActiveKeyID() string {
+	return k.active
+}
+
+// LegacyKeyActive reports whether new data is still sealed with ENCRYPTION_KEY
+func (k *Keyring) LegacyKeyActive() bool {
+	return k.active == defaultKeyID
+}
+
+// aead returns the AES-GCM cipher of a key in the keyring
+func (k *Keyring) aead(id string) (cipher.AEAD, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// legacyBlock returns the AES cipher of the original ENCRYPTION_KEY
+func (k *Keyring) legacyBlock() (cipher.Block, error) {
+	if k.legacy == nil {
+		return nil, errors.New("ENCRYPTION_KEY is not set in the environment variables")
+	}
+	return aes.NewCipher(k.legacy)
+}
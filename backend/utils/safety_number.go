@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// safetyNumberVersion is mixed into the hash so the format can change later
+const safetyNumberVersion = "heyboo-safety-v1"
+
+// identityDigits turns one user's identity into 30 digits. Keys are sorted
+// so the result does not depend on the order devices were registered in.
+func identityDigits(userID string, publicKeys []string) string {
+	keys := append([]string(nil), publicKeys...)
+	sort.Strings(keys)
+
+	hash := sha512.New()
+	hash.Write([]byte(safetyNumberVersion))
+	hash.Write([]byte(userID))
+	for _, key := range keys {
+		hash.Write([]byte{0})
+		hash.Write([]byte(key))
+	}
+	sum := hash.Sum(nil)
+
+	// Six chunks of five bytes, each reduced to five digits
+	var digits strings.Builder
+	for i := 0; i < 6; i++ {
+		chunk := make([]byte, 8)
+		copy(chunk[3:], sum[i*5:i*5+5])
+		fmt.Fprintf(&digits, "%05d", binary.BigEndian.Uint64(chunk)%100000)
+	}
+	return digits.String()
+}
+
+// SafetyNumber derives the number two partners compare to verify each
+// other's device keys. Both sides get the same 60 digits, in groups of five,
+// and it changes whenever either partner's keys change.
+func SafetyNumber(userA string, keysA []string, userB string, keysB []string) string {
+	a, b := identityDigits(userA, keysA), identityDigits(userB, keysB)
+	if userA > userB {
+		a, b = b, a
+	}
+	combined := a + b
+
+	groups := make([]string, 0, len(combined)/5)
+	for i := 0; i < len(combined); i += 5 {
+		groups = append(groups, combined[i:i+5])
+	}
+	return strings.Join(groups, " ")
+}
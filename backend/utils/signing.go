@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"time"
+)
+
+// urlSigningKey reads ATTACHMENT_URL_SECRET, falling back to the JWT secret
+func urlSigningKey() []byte {
+	if secret := os.Getenv("ATTACHMENT_URL_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	return []byte(os.Getenv("JWT_SECRET_KEY"))
+}
+
+// SignResource signs a resource path until expires, so a link can be handed
+// to clients that cannot send an Authorization header (e.g. an <img> tag)
+func SignResource(resource string, expires time.Time) string {
+	mac := hmac.New(sha256.New, urlSigningKey())
+	mac.Write([]byte(resource + "\n" + strconv.FormatInt(expires.Unix(), 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyResourceSignature checks a signature made by SignResource and that it has not expired
+func VerifyResourceSignature(resource string, expires int64, signature string) bool {
+	if time.Now().Unix() > expires {
+		return false
+	}
+	expected := SignResource(resource, time.Unix(expires, 0))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
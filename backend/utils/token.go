@@ -1,6 +1,9 @@
 package utils
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"os"
 	"time"
@@ -8,22 +11,33 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 )
 
+const (
+	// AccessTokenTTL is how long an access token stays valid
+	AccessTokenTTL = 15 * time.Minute
+	// RefreshTokenTTL is how long a refresh token stays valid without being rotated
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
 type Claims struct {
-	Username string `json:"username"`
+	Username  string `json:"username"`
+	SessionID string `json:"sid"`
 	jwt.StandardClaims
 }
 
-func GenerateToken(username string) (string, error) {
+// GenerateToken issues a short-lived access token bound to a session
+func GenerateToken(username, sessionID string) (string, error) {
 	jwtSecretKey := os.Getenv("JWT_SECRET_KEY")
 	if jwtSecretKey == "" {
 		return "", errors.New("JWT_SECRET_KEY is not set in the environment variables")
 	}
 
-	expirationTime := time.Now().Add(24 * time.Hour)
+	now := time.Now()
 	claims := &Claims{
-		Username: username,
+		Username:  username,
+		SessionID: sessionID,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(AccessTokenTTL).Unix(),
 		},
 	}
 
@@ -38,6 +52,9 @@ func ParseToken(tokenString string) (*jwt.Token, error) {
 	}
 
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
 		return []byte(jwtSecretKey), nil
 	})
 	if err != nil {
@@ -50,3 +67,18 @@ func ParseToken(tokenString string) (*jwt.Token, error) {
 
 	return token, nil
 }
+
+// GenerateRefreshToken returns a random opaque refresh token
+func GenerateRefreshToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// HashToken returns the SHA-256 hash of a token so only hashes are stored
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}